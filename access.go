@@ -0,0 +1,261 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// accessFile is the name of the file in the directory of each root
+// which holds its access policy, if it has one. Because its name
+// begins with a ".", it is never served itself.
+const accessFile = ".grove-access.json"
+
+// Access levels which can be given to repositories and directories.
+const (
+	accessPublic     = "public"     // Served to anyone
+	accessRestricted = "restricted" // Served to the listed users
+	accessHidden     = "hidden"     // Behaves as if it does not exist
+)
+
+// Policy is the contents of an access policy file. It gives each
+// listed repository or directory an access level, which also applies
+// to everything below it unless something more specific is listed.
+// Paths inside of repositories cannot be listed, because their
+// contents can also be seen in logs, diffs, searches, and archives of
+// the whole repository.
+// Anything not listed is served according to its permission bits, as
+// usual, but listed paths are served according to their access level
+// alone, so that a project can be shared without making it readable
+// to everyone on the host.
+type Policy struct {
+	Groups map[string][]string    `json:"groups"` // Users, keyed by group
+	Paths  map[string]*PathPolicy `json:"paths"`  // Relative to the root
+}
+
+// PathPolicy is the access level of a repository or directory.
+type PathPolicy struct {
+	Access string   `json:"access"` // "public", "restricted", or "hidden"
+	Users  []string `json:"users"`  // Allowed if restricted, or "*"
+	Groups []string `json:"groups"` // Allowed if restricted
+}
+
+// policyCache holds the policy of a root, and the state of the file it
+// was read from, so that the file is read again when it changes.
+type policyCache struct {
+	mu     sync.Mutex
+	policy *Policy
+	info   os.FileInfo
+	err    error
+}
+
+// loadPolicy reads and checks the access policy file with the given
+// name, which is in the directory of a root.
+func loadPolicy(name string) (p *Policy, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p = &Policy{}
+	if err = json.NewDecoder(f).Decode(p); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	top := path.Dir(name)
+	paths := make(map[string]*PathPolicy, len(p.Paths))
+	for name, pp := range p.Paths {
+		if pp == nil {
+			return nil, fmt.Errorf("%s: %q has no access level",
+				accessFile, name)
+		}
+		switch pp.Access {
+		case accessPublic, accessRestricted, accessHidden:
+		default:
+			return nil, fmt.Errorf("%s: %q has unknown access level %q",
+				accessFile, name, pp.Access)
+		}
+		for _, g := range pp.Groups {
+			if _, ok := p.Groups[g]; !ok {
+				return nil, fmt.Errorf("%s: %q refers to unknown group %q",
+					accessFile, name, g)
+			}
+		}
+		rel := path.Clean("/" + name)
+		if repository, ok := repositoryAbove(top, rel); ok {
+			return nil, fmt.Errorf("%s: %q is inside of the repository %q, "+
+				"but only repositories and the directories above them "+
+				"can be listed", accessFile, name, repository)
+		}
+		paths[rel] = pp
+	}
+	p.Paths = paths
+	return p, nil
+}
+
+// repositoryAbove finds the repository, if any, which contains the
+// path rel within the directory top, other than rel itself. The
+// repository is given relative to top.
+func repositoryAbove(top, rel string) (repository string, ok bool) {
+	dirs := parents(top, path.Join(top, rel))
+	for _, dir := range dirs[1:] {
+		if isRepository(dir) {
+			return path.Clean("/" + strings.TrimPrefix(dir, top)), true
+		}
+	}
+	return "", false
+}
+
+// Policy retrieves the access policy of the root, reading it again if
+// the file has changed. If the root has no policy file, p is nil.
+func (r *Root) Policy() (p *Policy, err error) {
+	r.policy.mu.Lock()
+	defer r.policy.mu.Unlock()
+
+	name := path.Join(r.Dir, accessFile)
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		r.policy.policy, r.policy.info, r.policy.err = nil, nil, nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if old := r.policy.info; old == nil || !old.ModTime().Equal(fi.ModTime()) ||
+		old.Size() != fi.Size() {
+		r.policy.policy, r.policy.err = loadPolicy(name)
+		r.policy.info = fi
+	}
+	return r.policy.policy, r.policy.err
+}
+
+// Lookup finds the entry which applies to the given path within the
+// root, which is that of the path itself or of its closest listed
+// parent. If none applies, pp is nil.
+func (p *Policy) Lookup(rel string) (pp *PathPolicy) {
+	for rel = path.Clean("/" + rel); ; rel = path.Dir(rel) {
+		if pp, ok := p.Paths[rel]; ok {
+			return pp
+		}
+		if rel == "/" {
+			return nil
+		}
+	}
+}
+
+// Allows returns true if the given user, which is blank if no one is
+// logged in, is allowed to see a path with this entry.
+func (pp *PathPolicy) Allows(p *Policy, user string) bool {
+	switch pp.Access {
+	case accessPublic:
+		return true
+	case accessHidden:
+		return false
+	}
+	if len(user) == 0 {
+		return false
+	}
+	for _, u := range pp.Users {
+		if u == user || u == pushAnyUser {
+			return true
+		}
+	}
+	for _, g := range pp.Groups {
+		for _, u := range p.Groups[g] {
+			if u == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Access determines whether the given user, which is blank if no one
+// is logged in, may see the file or directory at the absolute path p,
+// according to the access policy of the root. If it is listed in the
+// policy, decided is true and status is http.StatusOK if the user is
+// allowed, http.StatusUnauthorized if they must log in, or the status
+// with which to refuse them. Otherwise, the permission bits decide.
+func (r *Root) Access(p, user string) (status int, decided bool) {
+	policy, err := r.Policy()
+	if err != nil {
+		// If the policy cannot be read, nothing in the root can be
+		// served safely.
+		l.Errf("Access policy of %q could not be read: %s\n", r.Dir, err)
+		return http.StatusInternalServerError, true
+	} else if policy == nil {
+		return 0, false
+	}
+	pp := policy.Lookup(strings.TrimPrefix(p, r.Dir))
+	switch {
+	case pp == nil:
+		return 0, false
+	case pp.Allows(policy, user):
+		return http.StatusOK, true
+	case pp.Access == accessHidden:
+		return http.StatusNotFound, true
+	case len(user) == 0:
+		return http.StatusUnauthorized, true
+	default:
+		return http.StatusForbidden, true
+	}
+}
+
+// CanServe determines whether the given user may see the file or
+// directory at the absolute path p, whose info is given, according to
+// both the access policy and the permission bits of the root. Names
+// beginning with a "." are never served. It returns http.StatusOK if
+// the user may see it, and otherwise the status with which to refuse
+// them.
+func (r *Root) CanServe(p string, info os.FileInfo, user string) (status int) {
+	if status, decided := r.Access(p, user); decided {
+		if status == http.StatusOK && strings.HasPrefix(info.Name(), ".") {
+			return http.StatusForbidden
+		}
+		return status
+	}
+	if !r.CheckPerms(info) {
+		return http.StatusForbidden
+	}
+	return http.StatusOK
+}
+
+// CanList determines whether the given user may see the directory at
+// the absolute path dir, as with CanServe. The directory of the root
+// itself can always be seen.
+func (r *Root) CanList(dir, user string) (status int) {
+	if dir == r.Dir {
+		return http.StatusOK
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return http.StatusNotFound
+	}
+	return r.CanServe(dir, fi, user)
+}
+
+// accessError returns the error which describes the given status from
+// Root.Access or Root.CanServe.
+func accessError(status int) error {
+	switch status {
+	case http.StatusUnauthorized:
+		return unauthorized
+	case http.StatusForbidden:
+		return forbidden
+	case http.StatusNotFound:
+		return notFound
+	default:
+		return internalServerError
+	}
+}
+
+// requestLogin sets the header which asks the client to log in, as
+// should accompany the status http.StatusUnauthorized.
+func requestLogin(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Grove"`)
+}
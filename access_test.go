@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(path.Join(dir, accessFile), []byte(`{
+	"groups": {"team": ["alice", "bob"]},
+	"paths": {
+		"clients/acme": {"access": "restricted", "users": ["carol"],
+			"groups": ["team"]},
+		"clients/acme/docs": {"access": "public"},
+		"secret": {"access": "hidden"}
+	}
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Root{Dir: dir}
+
+	tests := []struct {
+		p, user string
+		status  int
+		decided bool
+	}{
+		{"clients/acme", "carol", http.StatusOK, true},
+		{"clients/acme/src", "bob", http.StatusOK, true},
+		{"clients/acme", "dave", http.StatusForbidden, true},
+		{"clients/acme", "", http.StatusUnauthorized, true},
+		{"clients/acme/docs", "", http.StatusOK, true},
+		{"clients/acmeco", "", 0, false},
+		{"secret/repo", "alice", http.StatusNotFound, true},
+		{"other", "", 0, false},
+	}
+	for _, test := range tests {
+		status, decided := r.Access(path.Join(dir, test.p), test.user)
+		if status != test.status || decided != test.decided {
+			t.Errorf("%s as %q: expected %d (%t), got %d (%t)",
+				test.p, test.user, test.status, test.decided,
+				status, decided)
+		}
+	}
+}
+
+func TestLoadPolicyInsideRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"proj/.git", "group/repo/.git/refs"} {
+		if err = os.MkdirAll(path.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		p  string
+		ok bool
+	}{
+		{"proj", true},
+		{"/proj/", true},
+		{"group", true},
+		{"group/repo", true},
+		{"group/other", true},
+		{"missing/path", true},
+		{"proj/docs", false},
+		{"proj/.git", false},
+		{"group/repo/src/main.go", false},
+	}
+	name := path.Join(dir, accessFile)
+	for _, test := range tests {
+		err = ioutil.WriteFile(name, []byte(`{"paths": {"`+test.p+
+			`": {"access": "public"}}}`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadPolicy(name); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, expected it to be allowed: %t",
+				test.p, err, test.ok)
+		}
+	}
+}
@@ -6,7 +6,11 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -22,67 +26,542 @@ type APIResponse struct {
 	Description string    // Current branch description if available
 	Commits     []*Commit // Commits in which the most recent is first
 	Error       string    `json:",omitempty"` // Error string if present
+
+	repository, ref, file string // URL path, ref, and file, for feeds
 }
 
 var (
 	InvalidEncodingError = errors.New("api: invalid encoding requested")
 )
 
-func ServeAPI(w http.ResponseWriter, req *http.Request, g *git, ref string, maxCommits int) (err error) {
-	// First, determine the encoding and error if it isn't appropriate
-	// or supported. To do this, we need to check the api value and
-	// Accept header. We also want to include the Content-Type.
-	var e encoder
-	var c string // The Content-Type field in the http.Response
-	switch req.FormValue("api") {
-	case "json":
-		// The json.Encoder type implements our private encoder
-		// interface, because it has the function Encode().
-		c = "application/json"
-		e = json.NewEncoder(w)
-	case "xml":
-		// Same as above.
-		c = "application/xml"
-		e = xml.NewEncoder(w)
+// CompareResponse is the API form of the compare page. It lists the
+// commits on To which are not on From, and the changes introduced by
+// them.
+type CompareResponse struct {
+	GroveOwner string      // Owner of the grove instance
+	From       string      // Base of the comparison
+	To         string      // Tip of the comparison
+	Commits    []*Commit   // Commits in which the most recent is first
+	Files      []*FileDiff // Changes made on To since From
+	Error      string      `json:",omitempty"` // Error string if present
+
+	repository string // URL path of the repository, for feeds
+}
+
+// GroveResponse is the API form of a directory in the grove. It lists
+// the most recent commits across every repository within it.
+type GroveResponse struct {
+	GroveOwner string        // Owner of the grove instance
+	Commits    []*RepoCommit // Commits in which the most recent is first
+	Error      string        `json:",omitempty"` // Error string if present
+
+	path string // URL path of the directory, for feeds
+}
+
+// ServeAPI serves the log of the given ref, in the encoding requested
+// by the client. If file is not blank, only commits which affected it
+// are included, and if f is not nil, only those which pass it. The
+// repository is the URL path of g.
+func ServeAPI(w http.ResponseWriter, req *http.Request, g Repository, repository, ref, file string, f *LogFilter, maxCommits int) (err error) {
+	e, err := getEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	// If an encoding was provided, prepare a response.
+	r := &APIResponse{
+		GroveOwner: user,
+		repository: repository,
+		ref:        ref,
+		file:       file,
+	}
+	if isUnborn(g, ref) {
+		// A repository without any commits has no HEAD and an empty
+		// log.
+		r.Description = getRepoConfig(g.Dir()).Description
+		r.Commits = []*Commit{}
+		return encodeResponse(w, e, r, &r.Error, nil)
+	}
+	r.HEAD, err = g.SHA("HEAD")
+	if err == nil {
+		r.Description, err = g.GetBranchDescription(ref)
+	}
+	if err == nil && len(r.Description) == 0 {
+		r.Description = getRepoConfig(g.Dir()).Description
+	}
+	if err == nil && len(file) > 0 && f != nil {
+		r.Commits, err = g.CommitsMatching(ref, fileFilter(f, file),
+			maxCommits)
+	} else if err == nil && len(file) > 0 {
+		r.Commits, err = g.CommitsByFile(ref, file, maxCommits)
+	} else if err == nil {
+		r.Commits, err = logCommits(g, ref, f, maxCommits)
+	}
+
+	// Finally, encode to the http.ResponseWriter with whatever
+	// encoder was selected.
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// ServeCompareAPI serves the API form of the compare page for the
+// given range, which is of the form "<from>..<to>". The repository is
+// the URL path of g.
+func ServeCompareAPI(w http.ResponseWriter, req *http.Request, g Repository, repository, refs string, maxCommits int) (err error) {
+	e, err := getEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &CompareResponse{
+		GroveOwner: user,
+		repository: repository,
+	}
+	from, to, ok := splitRange(refs)
+	if !ok {
+		err = InvalidRefError
+	} else if !g.RefExists(from) || !g.RefExists(to) {
+		err = RefNotFoundError
+	} else {
+		r.From, r.To = from, to
+		r.Commits, err = g.Commits(from+".."+to, maxCommits)
+		if err == nil {
+			r.Files, err = g.Diff(from, to)
+		}
+	}
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// ServeGroveAPI serves the most recent commits across every repository
+// which the user may see within the given directory, or if it is
+// blank, within each of the given roots, in the encoding requested by
+// the client. The commits of each are those of its default branch, and
+// if f is not nil, only those which pass it. Up to maxCommits are
+// given, or all of them if it is not positive. The URL path of the
+// directory is given as dirPath.
+func ServeGroveAPI(w http.ResponseWriter, req *http.Request, rs []*Root, directory, dirPath, remoteUser string, f *LogFilter, maxCommits int) (err error) {
+	e, err := getEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &GroveResponse{
+		GroveOwner: user,
+		path:       dirPath,
+	}
+	for _, repo := range findRepositories(rs, directory, remoteUser) {
+		g := openRepository(repo.Dir)
+		commits, err := logCommits(g, getRepoConfig(repo.Dir).Ref(), f,
+			maxCommits)
+		if err != nil {
+			// Repositories without any commits, for example, are
+			// simply left out.
+			l.Debugf("Could not read log of %q: %s\n", repo.Dir, err)
+			continue
+		}
+		r.Commits = append(r.Commits, repoCommits(repo.Path, commits)...)
+	}
+	sort.Stable(commitsByDate(r.Commits))
+	if maxCommits > 0 && len(r.Commits) > maxCommits {
+		r.Commits = r.Commits[:maxCommits]
+	}
+	return encodeResponse(w, e, r, &r.Error, nil)
+}
+
+// IndexResponse is the API form of the repository index of a
+// directory in the grove.
+type IndexResponse struct {
+	GroveOwner   string         // Owner of the grove instance
+	Repositories []*RepoSummary // In the requested order
+	Error        string         `json:",omitempty"` // Error string if present
+
+	path string // URL path of the directory, for feeds
+}
+
+// ServeIndexAPI serves the index of the repositories which the user
+// may see within the given directory, or if it is blank, within each
+// of the given roots, in the encoding requested by the client. They
+// are sorted in the given order. The URL path of the directory is
+// given as dirPath.
+func ServeIndexAPI(w http.ResponseWriter, req *http.Request, rs []*Root, directory, dirPath, remoteUser, order string) (err error) {
+	e, err := getEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &IndexResponse{
+		GroveOwner: user,
+		Repositories: indexRepositories(rs, directory, dirPath,
+			remoteUser, order),
+		path: dirPath,
+	}
+	return encodeResponse(w, e, r, &r.Error, nil)
+}
+
+// SearchResponse is the API form of a search of one repository, or of
+// every repository within a directory in the grove.
+type SearchResponse struct {
+	GroveOwner string          // Owner of the grove instance
+	Query      *GrepQuery      // The search which was made
+	Results    []*SearchResult // Matching lines, by repository and file
+	Error      string          `json:",omitempty"` // Error string if present
+}
+
+// ServeSearchAPI serves the lines of the files of the given ref of g
+// which match the query, up to max of them, in the encoding requested
+// by the client. The repository is the URL path of g.
+func ServeSearchAPI(w http.ResponseWriter, req *http.Request, g Repository, repository, ref string, q *GrepQuery, max int) (err error) {
+	e, err := getDataEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &SearchResponse{
+		GroveOwner: user,
+		Query:      q,
+	}
+	r.Results, err = searchRepository(g, repository, ref, q, max)
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// ServeGroveSearchAPI serves the lines matching the query across every
+// repository which the user may see within the given directory, or if
+// it is blank, within each of the given roots, up to max of them, in
+// the encoding requested by the client.
+func ServeGroveSearchAPI(w http.ResponseWriter, req *http.Request, rs []*Root, directory, remoteUser string, q *GrepQuery, max int) (err error) {
+	e, err := getDataEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &SearchResponse{
+		GroveOwner: user,
+		Query:      q,
+	}
+	r.Results, err = searchRepositories(rs, directory, remoteUser, q, max)
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// RefsResponse is the API form of the list of branches or tags of a
+// repository.
+type RefsResponse struct {
+	GroveOwner string // Owner of the grove instance
+	Base       string // Default branch, to which the refs are compared
+	Refs       []*Ref // Most recently changed first
+	Error      string `json:",omitempty"` // Error string if present
+}
+
+// ServeRefsAPI serves the refs of g in the given namespace, along with
+// their tips and how far each has diverged from the default branch,
+// in the encoding requested by the client.
+func ServeRefsAPI(w http.ResponseWriter, req *http.Request, g Repository, namespace string) (err error) {
+	e, err := getDataEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &RefsResponse{
+		GroveOwner: user,
+		Base:       defaultBranch(g),
+	}
+	r.Refs, err = listRefs(g, namespace, r.Base)
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// TreeResponse is the API form of a directory within a repository. It
+// lists the files, directories, and submodules within it.
+type TreeResponse struct {
+	GroveOwner string       // Owner of the grove instance
+	Ref        string       // Ref as of which the directory is listed
+	Path       string       // Path of the directory in the repository
+	Entries    []*TreeEntry // Entries in the order git sorts them
+	Error      string       `json:",omitempty"` // Error string if present
+}
+
+// BlobResponse is the API form of a file within a repository. It
+// gives the metadata of the file along with its contents.
+type BlobResponse struct {
+	GroveOwner string // Owner of the grove instance
+	Ref        string // Ref as of which the file is read
+	*Blob
+	Error string `json:",omitempty"` // Error string if present
+}
+
+// ServeTreeAPI serves the entries of the given directory of g as of
+// ref, in the encoding requested by the client.
+func ServeTreeAPI(w http.ResponseWriter, req *http.Request, g Repository, ref, dir string) (err error) {
+	e, err := getDataEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &TreeResponse{
+		GroveOwner: user,
+		Ref:        ref,
+		Path:       dir,
+	}
+	r.Entries, err = g.Tree(ref, dir)
+	if err != nil && len(dir) == 0 && isUnborn(g, ref) {
+		// The top level of a repository without commits is empty.
+		r.Entries, err = []*TreeEntry{}, nil
+	}
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// ServeBlobAPI serves the given file of g as of ref, along with its
+// mode, SHA, and size, in the encoding requested by the client. The
+// contents of binary files are base64 encoded.
+func ServeBlobAPI(w http.ResponseWriter, req *http.Request, g Repository, ref, file string) (err error) {
+	e, err := getDataEncoder(w, req)
+	if err != nil {
+		return
+	}
+
+	r := &BlobResponse{
+		GroveOwner: user,
+		Ref:        ref,
+	}
+	r.Blob, _, err = readBlob(g, ref, file)
+	return encodeResponse(w, e, r, &r.Error, err)
+}
+
+// commitsByDate implements sort.Interface, sorting the most recent
+// commits first.
+type commitsByDate []*RepoCommit
+
+func (cs commitsByDate) Len() int           { return len(cs) }
+func (cs commitsByDate) Less(i, j int) bool { return cs[i].date.After(cs[j].date) }
+func (cs commitsByDate) Swap(i, j int)      { cs[i], cs[j] = cs[j], cs[i] }
+
+// feed implements feedSource.
+func (r *APIResponse) feed() (title, page string, commits []*RepoCommit) {
+	title = strings.Trim(r.repository, "/")
+	page = r.repository
+	if len(r.file) > 0 {
+		title += "/" + r.file
+		page += r.file + "?log&ref=" + url.QueryEscape(r.ref)
+	} else {
+		page += "?ref=" + url.QueryEscape(r.ref)
+	}
+	return title + " (" + r.ref + ")", page, repoCommits(r.repository,
+		r.Commits)
+}
+
+// feed implements feedSource.
+func (r *CompareResponse) feed() (title, page string, commits []*RepoCommit) {
+	page = r.repository + viewPrefix + viewCompare + "/" + r.From + ".." + r.To
+	return strings.Trim(r.repository, "/") + " (" + r.From + ".." +
+		r.To + ")", page, repoCommits(r.repository, r.Commits)
+}
+
+// feed implements feedSource.
+func (r *GroveResponse) feed() (title, page string, commits []*RepoCommit) {
+	return "Grove: " + r.path, r.path, r.Commits
+}
+
+// feed implements feedSource, with the most recent commit to each
+// repository.
+func (r *IndexResponse) feed() (title, page string, commits []*RepoCommit) {
+	for _, s := range r.Repositories {
+		if s.LastCommit != nil {
+			commits = append(commits, &RepoCommit{
+				Repository: s.Path,
+				Commit:     s.LastCommit,
+			})
+		}
+	}
+	sort.Stable(commitsByDate(commits))
+	return "Grove: " + r.path, r.path + "?index", commits
+}
+
+// encodeResponse encodes the response r using e. If gitErr is not
+// nil, its kind is stored in the field pointed to by errField and the
+// matching HTTP status is written first. The git error is returned so
+// that it can be logged, unless encoding fails.
+func encodeResponse(w http.ResponseWriter, e encoder, r interface{}, errField *string, gitErr error) (err error) {
+	if gitErr != nil {
+		*errField = ErrorKind(gitErr).Error()
+		w.WriteHeader(gitStatus(gitErr))
 	}
-	// If the api field wasn't submitted in the form, we should still
-	// check the Accept header.
-	accept := strings.Split(strings.Split(
-		req.Header.Get("Accept"), ";")[0],
-		",")
-	if e == nil && len(accept) != 0 {
-		// Now we must loop through each element in accept, because
-		// there can be multiple values to the Accept key. As soon as
-		// we find an acceptable encoding, break the loop.
-		for _, a := range accept {
-			switch {
-			case strings.HasSuffix(a, "/json"):
-				e = json.NewEncoder(w)
-			case strings.HasSuffix(a, "/xml"):
-				e = xml.NewEncoder(w)
+	if err = e.Encode(r); err != nil {
+		return
+	}
+	return gitErr
+}
+
+// mediaType is a type of content which the API can produce, along
+// with the value of the api field of the form which selects it.
+type mediaType struct {
+	Name     string // Such as "application/json"
+	Encoding string // Value of the api field, such as "json"
+}
+
+// mediaTypes are the types which the API can produce, in order of
+// preference when the client accepts several of them equally.
+var mediaTypes = []mediaType{
+	{"application/json", "json"},
+	{"application/xml", "xml"},
+	{"text/xml", "xml"},
+	{"application/yaml", "yaml"},
+	{"application/x-yaml", "yaml"},
+	{"text/yaml", "yaml"},
+	{"application/msgpack", "msgpack"},
+	{"application/x-msgpack", "msgpack"},
+	{"application/atom+xml", feedAtom},
+	{"application/rss+xml", feedRSS},
+}
+
+// acceptRange is a media range from an Accept header, such as
+// "text/*;q=0.5".
+type acceptRange struct {
+	Type    string  // Such as "text", or "*"
+	Subtype string  // Such as "xml", or "*"
+	Q       float64 // Quality, from 0 to 1
+}
+
+// parseAccept parses an Accept header, as described by RFC 7231,
+// section 5.3.2. Ranges which are malformed, or whose quality is not
+// a number from 0 to 1, are left out.
+func parseAccept(header string) (ranges []acceptRange) {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		slash := strings.Index(name, "/")
+		if slash <= 0 || slash == len(name)-1 {
+			continue
+		}
+		r := acceptRange{Type: name[:slash], Subtype: name[slash+1:], Q: 1}
+		if r.Type == "*" && r.Subtype != "*" {
+			continue
+		}
+		valid := true
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(kv[0]) != "q" {
+				continue
 			}
-			if e != nil {
-				c = a // Set the content type appropriately.
-				break
+			q, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || q < 0 || q > 1 {
+				valid = false
 			}
+			r.Q = q
+		}
+		if valid {
+			ranges = append(ranges, r)
 		}
 	}
-	// If the encoding is invalid or not provided, return this error.
-	if e == nil {
-		return InvalidEncodingError
+	return
+}
+
+// quality determines how acceptable the named media type is according
+// to the most specific of the ranges which matches it. If none match,
+// it is not acceptable, and its quality is zero.
+func quality(name string, ranges []acceptRange) (q float64) {
+	slash := strings.Index(name, "/")
+	t, sub := name[:slash], name[slash+1:]
+	best := -1 // Specificity of the best match so far
+	for _, r := range ranges {
+		var specificity int
+		switch {
+		case r.Type == t && r.Subtype == sub:
+			specificity = 2
+		case r.Type == t && r.Subtype == "*":
+			specificity = 1
+		case r.Type == "*":
+			specificity = 0
+		default:
+			continue
+		}
+		if specificity > best || (specificity == best && r.Q > q) {
+			best, q = specificity, r.Q
+		}
 	}
+	return
+}
 
-	// If an encoding was provided, prepare a response.
-	r := &APIResponse{
-		GroveOwner:  user,
-		HEAD:        g.SHA("HEAD"),
-		Description: g.GetBranchDescription(ref),
-		Commits:     g.Commits(ref, maxCommits),
+// negotiate selects the most acceptable to the client of the given
+// media types. If the api field of the form names an encoding, the
+// first type with that encoding is selected, and if there is none,
+// none are acceptable. Otherwise, they are weighed according to the
+// Accept header, and if there is none, the first is selected. If none
+// are acceptable, ok is false.
+func negotiate(req *http.Request, types []mediaType) (mt mediaType, ok bool) {
+	if api := req.FormValue("api"); len(api) > 0 {
+		for _, t := range types {
+			if t.Encoding == api {
+				return t, true
+			}
+		}
+		return mediaType{}, false
 	}
-	// Set the Content-Type appropriately in the header.
-	w.Header().Set("Content-Type", c)
+	header := strings.Join(req.Header["Accept"], ",")
+	if len(strings.TrimSpace(header)) == 0 {
+		return types[0], true
+	}
+	ranges := parseAccept(header)
+	best := 0.0
+	for _, t := range types {
+		if q := quality(t.Name, ranges); q > best {
+			mt, best, ok = t, q, true
+		}
+	}
+	return
+}
 
-	// Finally, encode to the http.ResponseWriter with whatever
-	// encoder was selected.
-	return e.Encode(r)
+// getEncoder determines the encoding requested by the client, and
+// returns an encoder which writes to w. It also sets the Content-Type
+// header appropriately. If the encoding is not supported, it responds
+// with 406 Not Acceptable, listing those which are, and returns
+// InvalidEncodingError.
+func getEncoder(w http.ResponseWriter, req *http.Request) (e encoder, err error) {
+	return negotiateEncoder(w, req, mediaTypes)
+}
+
+// getDataEncoder is the same as getEncoder, but feeds cannot be
+// requested. It is used for responses which do not implement
+// feedSource.
+func getDataEncoder(w http.ResponseWriter, req *http.Request) (e encoder, err error) {
+	var types []mediaType
+	for _, t := range mediaTypes {
+		if t.Encoding != feedAtom && t.Encoding != feedRSS {
+			types = append(types, t)
+		}
+	}
+	return negotiateEncoder(w, req, types)
+}
+
+// negotiateEncoder is the same as getEncoder, but only considers the
+// given media types.
+func negotiateEncoder(w http.ResponseWriter, req *http.Request, types []mediaType) (e encoder, err error) {
+	// The response depends on the Accept header, so caches must take
+	// it into account.
+	w.Header().Add("Vary", "Accept")
+	mt, ok := negotiate(req, types)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusNotAcceptable)
+		io.WriteString(w, http.StatusText(http.StatusNotAcceptable)+
+			"\n\nSupported types:\n")
+		for _, t := range types {
+			io.WriteString(w, t.Name+" (?api="+t.Encoding+")\n")
+		}
+		return nil, InvalidEncodingError
+	}
+
+	switch mt.Encoding {
+	case "json":
+		// The json.Encoder type implements our private encoder
+		// interface, because it has the function Encode().
+		e = json.NewEncoder(w)
+	case "xml":
+		// Same as above.
+		e = xml.NewEncoder(w)
+	case "yaml":
+		e = newYAMLEncoder(w)
+	case "msgpack":
+		e = newMsgpackEncoder(w)
+	case feedAtom, feedRSS:
+		e = newFeedEncoder(w, req, mt.Encoding)
+	}
+	w.Header().Set("Content-Type", mt.Name)
+	return e, nil
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		query, accept string
+		expected      string // Blank if nothing is acceptable
+	}{
+		{"", "", "application/json"},
+		{"", "*/*", "application/json"},
+		{"", "text/html, application/xml;q=0.9, */*;q=0.8",
+			"application/xml"},
+		{"", "application/json;q=0.1, application/yaml",
+			"application/yaml"},
+		{"", "application/json;q=0, */*;q=0.5", "application/xml"},
+		{"", "text/*", "text/xml"},
+		{"", "application/rss+xml", "application/rss+xml"},
+		{"", "text/html, application/xhtml+xml", ""},
+		{"", "application/json;q=2", ""},
+		{"api=msgpack", "application/json", "application/msgpack"},
+		{"api=csv", "*/*", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/proj/?"+test.query, nil)
+		if len(test.accept) > 0 {
+			req.Header.Set("Accept", test.accept)
+		}
+		mt, ok := negotiate(req, mediaTypes)
+		if !ok {
+			mt.Name = ""
+		}
+		if mt.Name != test.expected {
+			t.Errorf("%q with Accept %q: got %q, expected %q",
+				test.query, test.accept, mt.Name, test.expected)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// apiV1Prefix is the URL path, following the prefix, beneath which
+// version 1 of the API is served. Roots and directories cannot be
+// served at this path.
+const apiV1Prefix = "/api/v1/"
+
+// Pagination of lists in version 1 of the API.
+const (
+	defaultPerPage = 30  // Items per page if per_page is not given
+	maxPerPage     = 100 // Largest per_page which can be requested
+)
+
+var (
+	InvalidPageError = errors.New("api: invalid page")
+
+	methodNotAllowed = errors.New(
+		http.StatusText(http.StatusMethodNotAllowed))
+)
+
+// V1Response is the body of every response from version 1 of the API.
+// If the resource is a list, only one page of it is given as Data, and
+// Page, PerPage, and More describe that page. If the request failed,
+// Error describes why, and Data is left out.
+type V1Response struct {
+	GroveOwner string      // Owner of the grove instance
+	Data       interface{} `json:",omitempty"` // The requested resource
+	Page       int         `json:",omitempty"` // Page of the list, from 1
+	PerPage    int         `json:",omitempty"` // Most items in a page
+	More       bool        `json:",omitempty"` // Further pages follow
+	Error      *V1Error    `json:",omitempty"` // Reason for a failure
+}
+
+// V1Error describes a failed request to version 1 of the API.
+type V1Error struct {
+	Status  int    // HTTP status of the response
+	Message string // Kind of error, such as "git: ref not found"
+}
+
+// HandleAPI serves version 1 of the API, which is found beneath
+// apiV1Prefix. Its resources are:
+//
+//	repositories                              every visible repository
+//	repositories/<repo>                       one repository
+//	repositories/<repo>/branches              branches, with divergence
+//	repositories/<repo>/tags                  tags
+//	repositories/<repo>/commits               log, filtered by the form
+//	repositories/<repo>/commits/<ref>         one commit, with its diff
+//	repositories/<repo>/history/<path>        commits affecting a file
+//	repositories/<repo>/tree/<path>           entries of a directory
+//	repositories/<repo>/blobs/<path>          a file and its contents
+//	repositories/<repo>/compare/<from>..<to>  diffs between two refs
+//
+// The ref is selected with the ref field of the form, and lists are
+// paginated with the page and per_page fields. Responses are encoded
+// as requested by the client, or as JSON if any encoding will do.
+func HandleAPI(w http.ResponseWriter, req *http.Request) {
+	e, err := getDataEncoder(w, req)
+	if err != nil {
+		l.Debugf("API request %q from %q was not acceptable\n",
+			req.URL.Path, req.RemoteAddr)
+		return
+	}
+	r := &V1Response{GroveOwner: user}
+
+	var serveErr error
+	var status int
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		serveErr, status = methodNotAllowed, http.StatusMethodNotAllowed
+	} else if len(req.URL.Path) < prefixLength+len(apiV1Prefix) {
+		serveErr, status = notFound, http.StatusNotFound
+	} else {
+		// Invalid credentials are treated as no login at all, as in
+		// the web interface.
+		remoteUser, ok := authenticate(req)
+		if !ok {
+			remoteUser = ""
+		}
+		resource := req.URL.Path[prefixLength+len(apiV1Prefix):]
+		serveErr, status = serveV1(r, req, resource, remoteUser)
+	}
+
+	if serveErr != nil {
+		l.Errf("API request %q from %q caused error: %s",
+			req.URL.Path, req.RemoteAddr, serveErr)
+		r.Data, r.Page, r.PerPage, r.More = nil, 0, 0, false
+		r.Error = &V1Error{Status: status}
+		if status < http.StatusInternalServerError {
+			r.Error.Message = ErrorKind(serveErr).Error()
+		} else {
+			r.Error.Message = http.StatusText(status)
+		}
+		if status == http.StatusUnauthorized {
+			requestLogin(w)
+		}
+		w.WriteHeader(status)
+	} else if r.More || r.Page > 1 {
+		w.Header().Set("Link", pageLinks(req, r.Page, r.More))
+	}
+	if err := e.Encode(r); err != nil {
+		l.Errf("API response to %q from %q could not be encoded: %s",
+			req.URL.Path, req.RemoteAddr, err)
+	}
+}
+
+// serveV1 fills out the response to a request for the given resource,
+// which is a path relative to apiV1Prefix.
+func serveV1(r *V1Response, req *http.Request, resource, remoteUser string) (err error, status int) {
+	page, perPage, err := formPage(req)
+	if err != nil {
+		return err, http.StatusBadRequest
+	}
+
+	resource = strings.Trim(resource, "/")
+	if resource == "repositories" {
+		r.paginate(indexRepositories(roots, "", "/", remoteUser,
+			req.FormValue("sort")), page, perPage)
+		return nil, http.StatusOK
+	}
+	if !strings.HasPrefix(resource, "repositories/") {
+		return notFound, http.StatusNotFound
+	}
+
+	// Find the repository which the rest of the path is within, and
+	// check that the user may see it.
+	root, rest := findRoot(strings.TrimPrefix(resource, "repositories"))
+	if root == nil {
+		return notFound, http.StatusNotFound
+	}
+	p := path.Join(root.Dir, rest)
+	repository, ok := registry.Find(root.Dir, p)
+	if !ok {
+		return notFound, http.StatusNotFound
+	}
+	if status, err = checkRepository(root, repository, remoteUser); err != nil {
+		return err, status
+	}
+	g := openRepository(repository)
+	repoPath := root.URLPath() + repository[len(root.Dir):] + "/"
+
+	// The rest of the path selects the kind of resource, and its
+	// argument, such as a path or ref.
+	var kind, arg string
+	parts := strings.SplitN(strings.Trim(p[len(repository):], "/"), "/", 2)
+	if kind = parts[0]; len(parts) == 2 {
+		arg = strings.Trim(parts[1], "/")
+	}
+
+	// Use the default branch unless a ref was given, in which case it
+	// must exist. Logs may also be given a range of commits.
+	ref := req.FormValue("ref")
+	if len(ref) == 0 {
+		ref = getRepoConfig(repository).Ref()
+	} else if err, status = checkRef(g, ref, (kind == "commits" &&
+		len(arg) == 0) || kind == "history"); err != nil {
+		return err, status
+	}
+	switch kind {
+	case "":
+		s, ok := registry.Summary(repository)
+		if !ok {
+			s = summarize(repository)
+		}
+		s.Name = strings.Trim(repoPath, "/")
+		s.Path = repoPath
+		r.Data = s
+	case "branches", "tags":
+		namespace := refsBranches
+		if kind == "tags" {
+			namespace = refsTags
+		}
+		refs, err := listRefs(g, namespace, defaultBranch(g))
+		if err != nil {
+			return err, gitStatus(err)
+		}
+		r.paginate(refs, page, perPage)
+	case "commits":
+		if len(arg) > 0 {
+			info, err := g.Show(arg)
+			if err != nil {
+				return err, gitStatus(err)
+			}
+			r.Data = info
+			break
+		}
+		return r.paginateLog(g, ref, formFilter(req), page, perPage)
+	case "history":
+		if len(arg) == 0 {
+			return notFound, http.StatusNotFound
+		}
+		return r.paginateLog(g, ref, fileFilter(formFilter(req), arg),
+			page, perPage)
+	case "tree":
+		entries, err := g.Tree(ref, arg)
+		if err != nil {
+			return err, gitStatus(err)
+		}
+		r.paginate(entries, page, perPage)
+	case "blobs":
+		blob, _, err := readBlob(g, ref, arg)
+		if err != nil {
+			return err, gitStatus(err)
+		}
+		r.Data = blob
+	case "compare":
+		from, to, ok := splitRange(arg)
+		if !ok {
+			return InvalidRefError, http.StatusBadRequest
+		}
+		if !g.RefExists(from) || !g.RefExists(to) {
+			return RefNotFoundError, http.StatusNotFound
+		}
+		diffs, err := g.Diff(from, to)
+		if err != nil {
+			return err, gitStatus(err)
+		}
+		r.paginate(diffs, page, perPage)
+	default:
+		return notFound, http.StatusNotFound
+	}
+	return nil, http.StatusOK
+}
+
+// checkRef checks that the ref given in the form names a commit. A
+// range of commits, such as "master..topic", is only accepted if
+// ranges is true, and then both of its ends must name commits.
+func checkRef(g Repository, ref string, ranges bool) (err error, status int) {
+	refs := []string{ref}
+	if strings.Contains(ref, "..") {
+		from, to, ok := splitRange(ref)
+		if !ranges || !ok {
+			return InvalidRefError, http.StatusBadRequest
+		}
+		refs = []string{from, to}
+	}
+	for _, r := range refs {
+		if _, err = g.Resolve(r); err != nil {
+			return err, gitStatus(err)
+		}
+	}
+	return nil, http.StatusOK
+}
+
+// formPage reads the page and per_page fields of the form, which
+// select a page of a list. Pages are numbered from 1, and contain
+// defaultPerPage items unless another number, up to maxPerPage, is
+// given. Pages so far along that their offset would overflow are
+// rejected as well. Otherwise, it returns InvalidPageError.
+func formPage(req *http.Request) (page, perPage int, err error) {
+	page, perPage = 1, defaultPerPage
+	if v := req.FormValue("page"); len(v) > 0 {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, InvalidPageError
+		}
+	}
+	if v := req.FormValue("per_page"); len(v) > 0 {
+		perPage, err = strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return 0, 0, InvalidPageError
+		}
+	}
+	if page > math.MaxInt32/perPage {
+		return 0, 0, InvalidPageError
+	}
+	return page, perPage, nil
+}
+
+// paginate sets the Data of the response to the given page of list,
+// which must be a slice, and describes the page. Pages past the end
+// of the list are empty.
+func (r *V1Response) paginate(list interface{}, page, perPage int) {
+	v := reflect.ValueOf(list)
+	start := (page - 1) * perPage
+	if start < 0 {
+		start = 0
+	} else if start > v.Len() {
+		start = v.Len()
+	}
+	end := start + perPage
+	if end > v.Len() {
+		end = v.Len()
+	}
+	if v.IsNil() {
+		// Empty lists are encoded as such, rather than as null.
+		v = reflect.MakeSlice(v.Type(), 0, 0)
+	}
+	r.Data = v.Slice(start, end).Interface()
+	r.Page, r.PerPage, r.More = page, perPage, end < v.Len()
+}
+
+// paginateLog sets the Data of the response to the given page of the
+// log of ref, as filtered by f, which may be nil. Only the commits up
+// to the end of the page, and one more to determine whether there are
+// further pages, are read.
+func (r *V1Response) paginateLog(g Repository, ref string, f *LogFilter, page, perPage int) (err error, status int) {
+	commits, err := logCommits(g, ref, f, page*perPage+1)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	r.paginate(commits, page, perPage)
+	return nil, http.StatusOK
+}
+
+// pageLinks produces the value of the Link header which points to the
+// previous and next pages of a list, if there are any.
+func pageLinks(req *http.Request, page int, more bool) string {
+	link := func(n int, rel string) string {
+		u := *req.URL
+		q := u.Query()
+		q.Set("page", strconv.Itoa(n))
+		u.RawQuery = q.Encode()
+		return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+	}
+	var links []string
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if more {
+		links = append(links, link(page+1, "next"))
+	}
+	return strings.Join(links, ", ")
+}
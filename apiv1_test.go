@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	list := []string{"a", "b", "c", "d", "e"}
+	for _, test := range []struct {
+		page, perPage int
+		data          []string
+		more          bool
+	}{
+		{1, 2, []string{"a", "b"}, true},
+		{3, 2, []string{"e"}, false},
+		{1, 5, list, false},
+		{4, 2, []string{}, false},
+	} {
+		r := &V1Response{}
+		r.paginate(list, test.page, test.perPage)
+		if !reflect.DeepEqual(r.Data, test.data) || r.More != test.more {
+			t.Errorf("Page %d of %d: got %v, more %t; expected %v, more %t",
+				test.page, test.perPage, r.Data, r.More,
+				test.data, test.more)
+		}
+	}
+
+	// Empty lists must still be encoded as lists.
+	r := &V1Response{}
+	r.paginate([]string(nil), 1, 2)
+	if data, ok := r.Data.([]string); !ok || data == nil {
+		t.Errorf("Empty list was paginated as %#v", r.Data)
+	}
+}
+
+func TestFormPage(t *testing.T) {
+	for _, test := range []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"page=2&per_page=100", true},
+		{"page=0", false},
+		{"per_page=101", false},
+		{"page=9223372036854775807", false},
+		{"page=21474837&per_page=100", false},
+	} {
+		req, _ := http.NewRequest("GET", "/api/v1/repositories?"+test.query, nil)
+		if _, _, err := formPage(req); (err == nil) != test.ok {
+			t.Errorf("%q: got error %v", test.query, err)
+		}
+	}
+}
+
+func TestCheckRef(t *testing.T) {
+	g := prepareRefs(t)
+	defer removeTempDir()
+
+	for _, test := range []struct {
+		ref    string
+		ranges bool
+		status int
+	}{
+		{"master", false, http.StatusOK},
+		{"v1", false, http.StatusOK},
+		{"missing", false, http.StatusNotFound},
+		{"blobtag", false, http.StatusNotFound},
+		{"treetag", false, http.StatusNotFound},
+		{"master..topic", false, http.StatusBadRequest},
+		{"master..topic", true, http.StatusOK},
+		{"master...topic", true, http.StatusOK},
+		{"master..missing", true, http.StatusNotFound},
+		{"..topic", true, http.StatusBadRequest},
+		{"-p", false, http.StatusBadRequest},
+	} {
+		if _, status := checkRef(g, test.ref, test.ranges); status != test.status {
+			t.Errorf("%q (ranges: %t): got status %d, expected %d",
+				test.ref, test.ranges, status, test.status)
+		}
+	}
+}
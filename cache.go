@@ -0,0 +1,421 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"container/list"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// objectCache holds data read from repositories as of a particular
+// commit, which can never change. It is shared by all repositories,
+// and is nil if caching is disabled.
+var objectCache *lruCache
+
+// lruCache is a cache of bounded total size, which discards the least
+// recently used entries when it is full. It is safe for concurrent
+// use.
+type lruCache struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	order   *list.List // Most recently used first
+	entries map[string]*list.Element
+}
+
+// cacheEntry is the value of each element in lruCache.order.
+type cacheEntry struct {
+	key   string
+	value interface{}
+	size  int
+}
+
+// newLRUCache creates an lruCache which holds up to maxSize bytes, as
+// estimated by the sizes given to Add.
+func newLRUCache(maxSize int) *lruCache {
+	return &lruCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get retrieves the value stored under key, and marks it as recently
+// used.
+func (c *lruCache) Get(key string) (value interface{}, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).value, true
+}
+
+// Add stores value under key, with the given approximate size in
+// bytes, and discards the least recently used entries until the cache
+// is no larger than its maximum size. Values larger than the maximum
+// are not stored at all.
+func (c *lruCache) Add(key string, value interface{}, size int) {
+	if size > c.maxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.order.Remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, value, size})
+	c.size += size
+	for c.size > c.maxSize {
+		e := c.order.Back()
+		entry := e.Value.(*cacheEntry)
+		c.order.Remove(e)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+	}
+}
+
+// cachedRepo wraps a Repository so that files, directory listings, and
+// logs are kept in objectCache, keyed by the full SHA of the commit
+// they were read from. Refs are resolved to a SHA first. Resolutions
+// are cached as well, but keyed by the state of the repository's refs,
+// so that they are abandoned as soon as any ref changes.
+type cachedRepo struct {
+	Repository
+
+	refs string // State of the refs, determined on first use
+}
+
+// cacheEntryOverhead is added to the size of each cache entry to
+// account for the key and bookkeeping.
+const cacheEntryOverhead = 128
+
+// Resolve retrieves the full SHA of the commit named by the given
+// reference.
+func (r *cachedRepo) Resolve(ref string) (sha string, err error) {
+	if sha, ok := r.resolve(ref); ok {
+		return sha, nil
+	}
+	return r.Repository.Resolve(ref)
+}
+
+// IsDir determines whether the given path is a file or directory as
+// of the given ref.
+func (r *cachedRepo) IsDir(ref, file string) (isDir bool, err error) {
+	key, ok := r.key("isdir", ref, file)
+	if !ok {
+		return r.Repository.IsDir(ref, file)
+	}
+	if v, ok := objectCache.Get(key); ok {
+		return v.(bool), nil
+	}
+	if isDir, err = r.Repository.IsDir(ref, file); err == nil {
+		objectCache.Add(key, isDir, cacheEntryOverhead)
+	}
+	return
+}
+
+// GetFile retrieves the contents of a file as of the given commit.
+// The contents must not be modified.
+func (r *cachedRepo) GetFile(commit, file string) (contents []byte, err error) {
+	key, ok := r.key("file", commit, file)
+	if !ok {
+		return r.Repository.GetFile(commit, file)
+	}
+	if v, ok := objectCache.Get(key); ok {
+		return v.([]byte), nil
+	}
+	if contents, err = r.Repository.GetFile(commit, file); err == nil {
+		objectCache.Add(key, contents, len(contents)+cacheEntryOverhead)
+	}
+	return
+}
+
+// GetDir lists the names in a directory as of the given commit. The
+// list must not be modified.
+func (r *cachedRepo) GetDir(commit, dir string) (files []string, err error) {
+	key, ok := r.key("dir", commit, dir)
+	if !ok {
+		return r.Repository.GetDir(commit, dir)
+	}
+	if v, ok := objectCache.Get(key); ok {
+		return v.([]string), nil
+	}
+	if files, err = r.Repository.GetDir(commit, dir); err == nil {
+		size := cacheEntryOverhead
+		for _, f := range files {
+			size += len(f) + 16
+		}
+		objectCache.Add(key, files, size)
+	}
+	return
+}
+
+// Tree lists the entries of a directory as of the given commit. The
+// list must not be modified.
+func (r *cachedRepo) Tree(commit, dir string) (entries []*TreeEntry, err error) {
+	key, ok := r.key("tree", commit, dir)
+	if !ok {
+		return r.Repository.Tree(commit, dir)
+	}
+	if v, ok := objectCache.Get(key); ok {
+		return v.([]*TreeEntry), nil
+	}
+	if entries, err = r.Repository.Tree(commit, dir); err == nil {
+		size := cacheEntryOverhead
+		for _, e := range entries {
+			size += len(e.Name) + 96
+		}
+		objectCache.Add(key, entries, size)
+	}
+	return
+}
+
+// Commits parses the log and returns an array of Commit types, up to
+// the given max.
+func (r *cachedRepo) Commits(ref string, max int) (commits []*Commit, err error) {
+	key, ok := r.key("log", ref, strconv.Itoa(max))
+	if !ok {
+		return r.Repository.Commits(ref, max)
+	}
+	return r.cachedLog(key, func() ([]*Commit, error) {
+		return r.Repository.Commits(ref, max)
+	})
+}
+
+// CommitsByFile retrieves a list of commits which modify or otherwise
+// affect a file, up to the given maximum number of commits.
+func (r *cachedRepo) CommitsByFile(ref, file string, max int) (commits []*Commit, err error) {
+	key, ok := r.key("filelog", ref, strconv.Itoa(max)+"\x00"+file)
+	if !ok {
+		return r.Repository.CommitsByFile(ref, file, max)
+	}
+	return r.cachedLog(key, func() ([]*Commit, error) {
+		return r.Repository.CommitsByFile(ref, file, max)
+	})
+}
+
+// CommitsMatching retrieves a list of the commits in the log of ref
+// which pass the filter, up to the given maximum number of commits.
+// Logs restricted by date are not cached, because dates such as "last
+// week" are relative.
+func (r *cachedRepo) CommitsMatching(ref string, f *LogFilter, max int) (commits []*Commit, err error) {
+	if len(f.After) > 0 || len(f.Before) > 0 {
+		return r.Repository.CommitsMatching(ref, f, max)
+	}
+	key, ok := r.key("matching", ref, strconv.Itoa(max)+"\x00"+
+		strings.Join(f.args(), "\x00"))
+	if !ok {
+		return r.Repository.CommitsMatching(ref, f, max)
+	}
+	return r.cachedLog(key, func() ([]*Commit, error) {
+		return r.Repository.CommitsMatching(ref, f, max)
+	})
+}
+
+// AheadBehind counts the commits which are on ref but not base, and
+// those which are on base but not ref.
+func (r *cachedRepo) AheadBehind(base, ref string) (ahead, behind int, err error) {
+	baseSHA, ok := r.resolve(base)
+	if !ok {
+		return r.Repository.AheadBehind(base, ref)
+	}
+	key, ok := r.key("aheadbehind", ref, baseSHA)
+	if !ok {
+		return r.Repository.AheadBehind(base, ref)
+	}
+	if v, ok := objectCache.Get(key); ok {
+		counts := v.([2]int)
+		return counts[0], counts[1], nil
+	}
+	if ahead, behind, err = r.Repository.AheadBehind(base, ref); err == nil {
+		objectCache.Add(key, [2]int{ahead, behind}, cacheEntryOverhead)
+	}
+	return
+}
+
+// Grep searches the files of the given ref for lines matching the
+// query, up to the given maximum number of matches. The list must not
+// be modified.
+func (r *cachedRepo) Grep(ref string, q *GrepQuery, max int) (matches []*GrepMatch, err error) {
+	key, ok := r.key("grep", ref, strconv.Itoa(max)+"\x00"+
+		strconv.FormatBool(q.Regexp)+"\x00"+
+		strconv.FormatBool(q.IgnoreCase)+"\x00"+q.Pattern)
+	if !ok {
+		return r.Repository.Grep(ref, q, max)
+	}
+	if v, ok := objectCache.Get(key); ok {
+		return v.([]*GrepMatch), nil
+	}
+	if matches, err = r.Repository.Grep(ref, q, max); err == nil {
+		size := cacheEntryOverhead
+		for _, m := range matches {
+			size += len(m.File) + len(m.Text) + cacheEntryOverhead
+		}
+		objectCache.Add(key, matches, size)
+	}
+	return
+}
+
+// cachedLog retrieves a log from the cache, or uses log to read it and
+// then stores it. Because the relative times of the commits change,
+// it returns copies of the cached commits with their times updated.
+func (r *cachedRepo) cachedLog(key string, log func() ([]*Commit, error)) (commits []*Commit, err error) {
+	if v, ok := objectCache.Get(key); ok {
+		cached := v.([]*Commit)
+		commits = make([]*Commit, len(cached))
+		for n, c := range cached {
+			commit := *c
+			commit.Time = relativeTime(commit.date)
+			commits[n] = &commit
+		}
+		return commits, nil
+	}
+
+	if commits, err = log(); err != nil {
+		return nil, err
+	}
+	cached := make([]*Commit, len(commits))
+	size := cacheEntryOverhead
+	for n, c := range commits {
+		commit := *c
+		cached[n] = &commit
+		size += len(c.SHA) + len(c.Author) + len(c.Email) +
+			len(c.Subject) + len(c.Body) + cacheEntryOverhead
+	}
+	objectCache.Add(key, cached, size)
+	return commits, nil
+}
+
+// key produces the cache key for the given kind of data as of ref,
+// which is resolved to a commit SHA. If ref cannot be resolved, or
+// its meaning may change over time, ok is false.
+func (r *cachedRepo) key(kind, ref, arg string) (key string, ok bool) {
+	sha, ok := r.resolve(ref)
+	if !ok {
+		return "", false
+	}
+	return kind + "\x00" + r.Dir() + "\x00" + sha + "\x00" + arg, true
+}
+
+// resolve determines the full SHA of the commit named by ref, using
+// objectCache if possible. If ref cannot be resolved, or its meaning
+// may change even if the refs do not, ok is false.
+func (r *cachedRepo) resolve(ref string) (sha string, ok bool) {
+	if isFullSHA(ref) {
+		return ref, true
+	}
+	if strings.Contains(ref, "@{") {
+		// Reflog entries, such as "master@{yesterday}", change
+		// without any change to the refs.
+		return "", false
+	}
+
+	if len(r.refs) == 0 {
+		var err error
+		if r.refs, err = refsState(r.Dir()); err != nil {
+			l.Debugf("Not caching refs of %q: %s\n", r.Dir(), err)
+			return "", false
+		}
+	}
+	key := "ref\x00" + r.Dir() + "\x00" + r.refs + "\x00" + ref
+	if v, ok := objectCache.Get(key); ok {
+		return v.(string), true
+	}
+	sha, err := r.Repository.Resolve(ref)
+	if err != nil {
+		return "", false
+	}
+	objectCache.Add(key, sha, len(sha)+cacheEntryOverhead)
+	return sha, true
+}
+
+// refsState summarizes the state of the refs of the repository whose
+// top level is dir, including HEAD and packed refs, such that any
+// change to them changes the result.
+func refsState(dir string) (state string, err error) {
+	gitDir, commonDir, err := gitDirs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	h := fnv.New64a()
+	add := func(name string, fi os.FileInfo) {
+		h.Write([]byte(name + "\x00" +
+			strconv.FormatInt(fi.ModTime().UnixNano(), 10) + "\x00" +
+			strconv.FormatInt(fi.Size(), 10) + "\x00"))
+	}
+	for _, name := range []string{
+		path.Join(gitDir, "HEAD"),
+		path.Join(commonDir, "packed-refs"),
+	} {
+		if fi, err := os.Stat(name); err == nil {
+			add(name, fi)
+		}
+	}
+	err = filepath.Walk(path.Join(commonDir, "refs"),
+		func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			add(name, fi)
+			return nil
+		})
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// isFullSHA returns true if ref is a complete, lowercase SHA, which
+// always names the same object.
+func isFullSHA(ref string) bool {
+	if len(ref) != 40 {
+		return false
+	}
+	for _, c := range ref {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// setImmutable sets the headers of a response which can never change,
+// such as a file as of a commit named by its full SHA, so that clients
+// can keep it indefinitely. The tag must identify the content. If the
+// client already has it, as indicated by If-None-Match, it writes the
+// status 304 Not Modified and returns true.
+func setImmutable(w http.ResponseWriter, req *http.Request, tag string) (notModified bool) {
+	h := fnv.New64a()
+	h.Write([]byte(tag))
+	etag := `"` + strconv.FormatUint(h.Sum64(), 16) + `"`
+
+	// Responses to logged in users may be restricted by the access
+	// policy, so they must not be kept by shared caches.
+	visibility := "public"
+	if len(req.Header.Get("Authorization")) > 0 {
+		visibility = "private"
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control",
+		visibility+", max-age=31536000, immutable")
+	for _, match := range strings.Split(req.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimPrefix(strings.TrimSpace(match), "W/")
+		if match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
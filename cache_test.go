@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(10)
+	c.Add("a", 1, 4)
+	c.Add("b", 2, 4)
+
+	// Using "a" should make "b" the least recently used, so that it is
+	// discarded to make room for "c".
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Fatalf("Expected 1 for \"a\", got %v", v)
+	}
+	c.Add("c", 3, 4)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("Expected \"b\" to be discarded")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Errorf("Expected \"a\" to be kept")
+	}
+
+	// Values larger than the cache should not be stored.
+	c.Add("d", 4, 11)
+	if _, ok := c.Get("d"); ok {
+		t.Errorf("Expected \"d\" not to be stored")
+	}
+	if c.size != 8 {
+		t.Errorf("Expected size 8, got %d", c.size)
+	}
+}
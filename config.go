@@ -0,0 +1,227 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// configPaths are the places in which a configuration file is searched
+// for, in order, if -config is not given. A leading "~" is replaced
+// with the home directory.
+var configPaths = []string{
+	"~/.config/grove/config.json",
+	"/etc/grove/config.json",
+}
+
+// configExcluded are the flags which cannot be set in a configuration
+// file, because they are actions rather than settings.
+var configExcluded = map[string]bool{
+	"config":       true,
+	"version":      true,
+	"version-full": true,
+	"show-bind":    true,
+	"show-port":    true,
+	"show-res":     true,
+}
+
+// repoConfigs holds the settings for individual repositories, keyed by
+// their absolute paths. It is filled by applyRepositories.
+var repoConfigs = make(map[string]*RepoConfig)
+
+// Config is the contents of a configuration file, which is a JSON
+// object. Any flag can be set in it using its name as the key, such as
+// "port" or "theme", but flags given on the command line take
+// precedence. The directory to serve can be given as "root", or
+// several can be given names as "roots". Settings for individual
+// repositories are given as "repositories".
+type Config struct {
+	Root         string                 // Directory to serve
+	Roots        map[string]*RootConfig // Keyed by name
+	Repositories map[string]*RepoConfig // Keyed by URL path
+
+	Flags map[string]string // Values of flags, keyed by name
+}
+
+// RootConfig holds the settings for a root which is served under its
+// name.
+type RootConfig struct {
+	Dir   string `json:"dir"`   // Directory to serve
+	Perms string `json:"perms"` // As with the -perms flag
+}
+
+// RepoConfig holds the settings for an individual repository.
+type RepoConfig struct {
+	Hidden        bool     `json:"hidden"`         // Do not serve at all
+	Description   string   `json:"description"`    // Shown on the main page
+	DefaultBranch string   `json:"default-branch"` // Used when no ref is given
+	Push          []string `json:"push"`           // Users who may push, or "*"
+}
+
+// UnmarshalJSON decodes a configuration file, converting the values of
+// flags to strings as they would be given on the command line.
+func (c *Config) UnmarshalJSON(b []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	c.Flags = make(map[string]string)
+	for name, raw := range fields {
+		var err error
+		switch name {
+		case "root":
+			err = json.Unmarshal(raw, &c.Root)
+		case "roots":
+			err = json.Unmarshal(raw, &c.Roots)
+		case "repositories":
+			err = json.Unmarshal(raw, &c.Repositories)
+		default:
+			var value interface{}
+			if err = json.Unmarshal(raw, &value); err != nil {
+				break
+			}
+			switch v := value.(type) {
+			case string:
+				c.Flags[name] = v
+			case bool:
+				c.Flags[name] = strconv.FormatBool(v)
+			case float64:
+				c.Flags[name] = strconv.FormatFloat(v, 'f', -1, 64)
+			default:
+				err = errors.New("expected a string, number, or boolean")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// loadConfig reads the configuration file with the given name, or, if
+// it is blank, the first one found in configPaths. If there is no
+// configuration file, it returns an empty Config.
+func loadConfig(name string) (c *Config, err error) {
+	c = &Config{}
+	if len(name) == 0 {
+		for _, p := range configPaths {
+			p = expandHome(p)
+			if _, err := os.Stat(p); err == nil {
+				name = p
+				break
+			}
+		}
+		if len(name) == 0 {
+			return c, nil
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = json.NewDecoder(f).Decode(c); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return c, nil
+}
+
+// applyFlags sets each flag given in the Config, unless it was already
+// set on the command line.
+func (c *Config) applyFlags() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range c.Flags {
+		if f := flag.Lookup(name); f == nil || configExcluded[name] {
+			return fmt.Errorf("unknown setting %q", name)
+		} else if set[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for %q: %s",
+				value, name, err)
+		}
+	}
+	return nil
+}
+
+// getRoots produces the roots given in the Config. If there are none,
+// the working directory is served.
+func (c *Config) getRoots() (rs []*Root, err error) {
+	if len(c.Root) > 0 || len(c.Roots) == 0 {
+		r := &Root{Perms: Perms}
+		if r.Dir, err = absPath(expandHome(c.Root)); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	for name, rc := range c.Roots {
+		if rc == nil {
+			return nil, fmt.Errorf("root %q has no settings", name)
+		}
+		r := &Root{Name: name, Perms: Perms}
+		if len(rc.Perms) > 0 {
+			if r.Perms, err = parsePerms(rc.Perms); err != nil {
+				return nil, fmt.Errorf("root %q: %s", name, err)
+			}
+		}
+		if r.Dir, err = absPath(expandHome(rc.Dir)); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// applyRepositories fills repoConfigs with the settings for individual
+// repositories, now that the roots being served are known. Each is
+// named by its URL path, such as "work/grove".
+func (c *Config) applyRepositories() error {
+	for name, rc := range c.Repositories {
+		root, rest := findRoot("/" + strings.Trim(name, "/"))
+		if root == nil {
+			return fmt.Errorf("repository %q is not in any root", name)
+		}
+		if rc != nil {
+			repoConfigs[path.Join(root.Dir, rest)] = rc
+		}
+	}
+	return nil
+}
+
+// getRepoConfig retrieves the settings for the repository at the given
+// absolute path. If there are none, it returns the defaults.
+func getRepoConfig(repository string) *RepoConfig {
+	if rc, ok := repoConfigs[path.Clean(repository)]; ok {
+		return rc
+	}
+	return &RepoConfig{}
+}
+
+// Ref returns the ref to use when none is given, which is the default
+// branch if one is set, and defaultRef otherwise.
+func (rc *RepoConfig) Ref() string {
+	if len(rc.DefaultBranch) > 0 {
+		return rc.DefaultBranch
+	}
+	return defaultRef
+}
+
+// expandHome replaces a leading "~" in the given path with the home
+// directory.
+func expandHome(p string) string {
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return path.Join(os.Getenv("HOME"), p[1:])
+	}
+	return p
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConfigUnmarshal(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{
+		"port": 8080,
+		"web": false,
+		"theme": "solarized",
+		"root": "~/dev",
+		"repositories": {
+			"grove": {"default-branch": "development", "hidden": true}
+		}
+	}`), &c)
+	if err != nil {
+		t.Fatalf("Failed to parse configuration: %s", err)
+	}
+
+	expected := map[string]string{
+		"port":  "8080",
+		"web":   "false",
+		"theme": "solarized",
+	}
+	for name, value := range expected {
+		if c.Flags[name] != value {
+			t.Errorf("Expected %q for %q, got %q", value, name, c.Flags[name])
+		}
+	}
+	if c.Root != "~/dev" {
+		t.Errorf("Expected root \"~/dev\", got %q", c.Root)
+	}
+	if rc := c.Repositories["grove"]; rc == nil || !rc.Hidden ||
+		rc.Ref() != "development" {
+		t.Errorf("Repository settings not parsed: %+v", rc)
+	}
+
+	if err = json.Unmarshal([]byte(`{"port": [8080]}`), &c); err == nil {
+		t.Errorf("Expected an error for a list value")
+	}
+}
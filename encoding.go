@@ -0,0 +1,320 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+)
+
+// The YAML and MessagePack encoders first convert values as
+// encoding/json would, so that the field names, and the fields which
+// are left out, are the same in every encoding. The JSON is read back
+// into a tree of plain values, in which objects keep the order of
+// their members:
+//
+//	[]jsonMember   for objects
+//	[]interface{}  for arrays
+//	string, json.Number, bool, or nil for everything else
+
+// jsonMember is a member of a JSON object.
+type jsonMember struct {
+	Key   string
+	Value interface{}
+}
+
+// jsonTree converts v to JSON, and reads it back as a tree of plain
+// values.
+func jsonTree(v interface{}) (tree interface{}, err error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return readJSONValue(dec)
+}
+
+// readJSONValue reads the next value from dec, keeping the order of
+// the members of objects.
+func readJSONValue(dec *json.Decoder) (v interface{}, err error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t {
+	case json.Delim('{'):
+		members := []jsonMember{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, jsonMember{key.(string), value})
+		}
+		_, err = dec.Token() // The closing brace
+		return members, err
+	case json.Delim('['):
+		items := []interface{}{}
+		for dec.More() {
+			item, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		_, err = dec.Token() // The closing bracket
+		return items, err
+	}
+	return t, nil
+}
+
+// yamlEncoder implements encoder by writing each value as a YAML
+// document in block style.
+type yamlEncoder struct {
+	w io.Writer
+}
+
+// newYAMLEncoder creates a yamlEncoder which writes to w.
+func newYAMLEncoder(w io.Writer) *yamlEncoder {
+	return &yamlEncoder{w: w}
+}
+
+// Encode writes v as a YAML document, beginning with "---".
+func (e *yamlEncoder) Encode(v interface{}) (err error) {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString("---")
+	switch tree := tree.(type) {
+	case []jsonMember:
+		if len(tree) > 0 {
+			b.WriteString("\n")
+			writeYAMLMap(&b, tree, "", "")
+			break
+		}
+		b.WriteString(" {}\n")
+	case []interface{}:
+		if len(tree) > 0 {
+			b.WriteString("\n")
+			writeYAMLList(&b, tree, "")
+			break
+		}
+		b.WriteString(" []\n")
+	default:
+		b.WriteString(" " + yamlScalar(tree) + "\n")
+	}
+	_, err = e.w.Write(b.Bytes())
+	return
+}
+
+// writeYAML writes a value which follows a key or list marker that
+// has already been written. Nested maps and lists begin on the next
+// line, at the given indentation.
+func writeYAML(b *bytes.Buffer, v interface{}, indent string) {
+	switch v := v.(type) {
+	case []jsonMember:
+		if len(v) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLMap(b, v, indent, indent)
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLList(b, v, indent)
+	default:
+		b.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+// writeYAMLMap writes each member of a map on its own line at the
+// given indentation, except that the first member is preceded by
+// first, so that it can share the line of a list marker.
+func writeYAMLMap(b *bytes.Buffer, members []jsonMember, first, indent string) {
+	for n, m := range members {
+		if n == 0 {
+			b.WriteString(first)
+		} else {
+			b.WriteString(indent)
+		}
+		b.WriteString(yamlScalar(m.Key) + ":")
+		writeYAML(b, m.Value, indent+"  ")
+	}
+}
+
+// writeYAMLList writes each item of a list on its own line at the
+// given indentation. Maps begin on the same line as their marker.
+func writeYAMLList(b *bytes.Buffer, items []interface{}, indent string) {
+	for _, item := range items {
+		if m, ok := item.([]jsonMember); ok && len(m) > 0 {
+			writeYAMLMap(b, m, indent+"- ", indent+"  ")
+			continue
+		}
+		b.WriteString(indent + "-")
+		writeYAML(b, item, indent+"  ")
+	}
+}
+
+// yamlPlain matches strings which can be written in YAML without
+// quotes, as long as they are not also one of yamlReserved.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./@+ -]*$`)
+
+// yamlReserved are the plain scalars which YAML parsers may read as
+// something other than a string.
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true,
+	"on": true, "off": true, "y": true, "n": true,
+	"null": true,
+}
+
+// yamlScalar formats a string, number, boolean, or null for YAML.
+// Strings are left unquoted only if they cannot be mistaken for
+// anything else, and are otherwise quoted as in JSON, which YAML
+// accepts.
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case json.Number:
+		return v.String()
+	case string:
+		if yamlPlain.MatchString(v) && !strings.HasSuffix(v, " ") &&
+			!yamlReserved[strings.ToLower(v)] {
+			return v
+		}
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return "null"
+}
+
+// msgpackEncoder implements encoder by writing each value in the
+// MessagePack format. Objects become maps with string keys, and
+// numbers become integers where possible, and otherwise 64-bit floats.
+type msgpackEncoder struct {
+	w io.Writer
+}
+
+// newMsgpackEncoder creates a msgpackEncoder which writes to w.
+func newMsgpackEncoder(w io.Writer) *msgpackEncoder {
+	return &msgpackEncoder{w: w}
+}
+
+// Encode writes v in the MessagePack format.
+func (e *msgpackEncoder) Encode(v interface{}) (err error) {
+	tree, err := jsonTree(v)
+	if err != nil {
+		return
+	}
+	var b bytes.Buffer
+	writeMsgpack(&b, tree)
+	_, err = e.w.Write(b.Bytes())
+	return
+}
+
+// writeMsgpack writes a value from a tree produced by jsonTree in the
+// MessagePack format, using the smallest representation of each.
+func writeMsgpack(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		b.WriteByte(0xc0)
+	case bool:
+		if v {
+			b.WriteByte(0xc3)
+		} else {
+			b.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			writeMsgpackInt(b, i)
+		} else {
+			f, _ := v.Float64()
+			b.WriteByte(0xcb)
+			binary.Write(b, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeMsgpackHeader(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		b.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			writeMsgpack(b, item)
+		}
+	case []jsonMember:
+		writeMsgpackHeader(b, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for _, m := range v {
+			writeMsgpack(b, m.Key)
+			writeMsgpack(b, m.Value)
+		}
+	}
+}
+
+// writeMsgpackHeader writes the type and length of a string, array, or
+// map. Lengths below fixMax are added to fix, and longer ones follow
+// the 8-bit, 16-bit, or 32-bit type byte. Arrays and maps have no
+// 8-bit form, which is given as zero.
+func writeMsgpackHeader(b *bytes.Buffer, n int, fix byte, fixMax int, t8, t16, t32 byte) {
+	switch {
+	case n < fixMax:
+		b.WriteByte(fix | byte(n))
+	case n <= math.MaxUint8 && t8 != 0:
+		b.Write([]byte{t8, byte(n)})
+	case n <= math.MaxUint16:
+		b.WriteByte(t16)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	default:
+		b.WriteByte(t32)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	}
+}
+
+// writeMsgpackInt writes an integer in the smallest MessagePack form
+// which holds it.
+func writeMsgpackInt(b *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		b.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		b.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		b.Write([]byte{0xcc, byte(i)})
+	case i >= 0 && i <= math.MaxUint16:
+		b.WriteByte(0xcd)
+		binary.Write(b, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		b.WriteByte(0xce)
+		binary.Write(b, binary.BigEndian, uint32(i))
+	case i >= math.MinInt8 && i < 0:
+		b.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16 && i < 0:
+		b.WriteByte(0xd1)
+		binary.Write(b, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i < 0:
+		b.WriteByte(0xd2)
+		binary.Write(b, binary.BigEndian, int32(i))
+	default:
+		b.WriteByte(0xd3)
+		binary.Write(b, binary.BigEndian, i)
+	}
+}
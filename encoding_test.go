@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// encodingTest is a value to encode, as a pointer to a struct so that
+// the encoders see the same field names and tags as encoding/json.
+type encodingTest struct {
+	Name  string
+	Count int
+	Tags  []string
+	Empty string `json:",omitempty"`
+	Inner *struct{ Ok bool }
+}
+
+func TestYAMLEncoder(t *testing.T) {
+	v := &encodingTest{
+		Name:  "two words",
+		Count: -3,
+		Tags:  []string{"true", "a: b", ""},
+		Inner: &struct{ Ok bool }{true},
+	}
+	expected := `---
+Name: two words
+Count: -3
+Tags:
+  - "true"
+  - "a: b"
+  - ""
+Inner:
+  Ok: true
+`
+	var b bytes.Buffer
+	if err := newYAMLEncoder(&b).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != expected {
+		t.Errorf("Got:\n%s\nExpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	tests := []struct {
+		v        interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{7, []byte{0x07}},
+		{-1, []byte{0xff}},
+		{200, []byte{0xcc, 0xc8}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"ab", []byte{0xa2, 'a', 'b'}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{&struct{ A int }{1}, []byte{0x81, 0xa1, 'A', 0x01}},
+		{string(make([]byte, 40)), append([]byte{0xd9, 40},
+			make([]byte, 40)...)},
+	}
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := newMsgpackEncoder(&b).Encode(test.v); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b.Bytes(), test.expected) {
+			t.Errorf("%#v: got % x, expected % x", test.v, b.Bytes(),
+				test.expected)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Encodings of the API which produce feeds, as used in the api field
+// of the form.
+const (
+	feedAtom = "atom"
+	feedRSS  = "rss"
+)
+
+// feedSource is implemented by API responses which can be encoded as
+// feeds. The title describes the feed, page is the URL path of the
+// webpage it corresponds to, and commits are its entries, most recent
+// first.
+type feedSource interface {
+	feed() (title, page string, commits []*RepoCommit)
+}
+
+// RepoCommit is a Commit along with the repository it belongs to.
+type RepoCommit struct {
+	Repository string // URL path of the repository, with a trailing slash
+	*Commit
+}
+
+// requestsFeed determines whether the client asked for a feed, either
+// with the api field of the form or in the Accept header.
+func requestsFeed(req *http.Request) bool {
+	mt, ok := negotiate(req, mediaTypes)
+	return ok && (mt.Encoding == feedAtom || mt.Encoding == feedRSS)
+}
+
+// feedEncoder implements encoder by writing a feedSource as an Atom
+// or RSS feed, with absolute links to the pages of the grove.
+type feedEncoder struct {
+	w      io.Writer
+	format string // feedAtom or feedRSS
+	base   string // Scheme, host, and prefix of the grove
+	self   string // Full URL of the feed
+}
+
+// newFeedEncoder creates a feedEncoder which writes a feed of the
+// given format to w, in response to req.
+func newFeedEncoder(w io.Writer, req *http.Request, format string) *feedEncoder {
+	base := requestScheme(req) + "://" + req.Host + *fPrefix
+	self := base + req.URL.Path
+	if len(req.URL.RawQuery) > 0 {
+		self += "?" + req.URL.RawQuery
+	}
+	return &feedEncoder{w: w, format: format, base: base, self: self}
+}
+
+// Encode writes v as a feed. It must implement feedSource.
+func (e *feedEncoder) Encode(v interface{}) (err error) {
+	src, ok := v.(feedSource)
+	if !ok {
+		return InvalidEncodingError
+	}
+	title, page, commits := src.feed()
+	if _, err = io.WriteString(e.w, xml.Header); err != nil {
+		return
+	}
+	enc := xml.NewEncoder(e.w)
+	if e.format == feedRSS {
+		err = enc.Encode(e.rss(title, page, commits))
+	} else {
+		err = enc.Encode(e.atom(title, page, commits))
+	}
+	return
+}
+
+// link produces the absolute URL of the page of the given commit.
+func (e *feedEncoder) link(c *RepoCommit) string {
+	return e.base + c.Repository + viewPrefix + viewCommit + "/" + c.SHA
+}
+
+// updated returns the time of the most recent of the commits, or the
+// current time if there are none.
+func updated(commits []*RepoCommit) time.Time {
+	if len(commits) == 0 {
+		return time.Now()
+	}
+	return commits[0].date
+}
+
+// atomFeed is an Atom feed, as described by RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string       `xml:"title"`
+	ID      string       `xml:"id"`
+	Updated string       `xml:"updated"`
+	Links   []*atomLink  `xml:"link"`
+	Author  *atomPerson  `xml:"author"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  *atomPerson `xml:"author"`
+	Link    *atomLink   `xml:"link"`
+	Content *atomText   `xml:"content,omitempty"`
+}
+
+// atom produces an Atom feed of the given commits.
+func (e *feedEncoder) atom(title, page string, commits []*RepoCommit) *atomFeed {
+	// The feed must have an author, so use the owner of the grove if
+	// it is known.
+	owner := user
+	if len(owner) == 0 {
+		owner = "Grove"
+	}
+	f := &atomFeed{
+		Title:   title,
+		ID:      e.self,
+		Updated: updated(commits).Format(time.RFC3339),
+		Links: []*atomLink{
+			{Href: e.self, Rel: "self"},
+			{Href: e.base + page, Rel: "alternate", Type: "text/html"},
+		},
+		Author:  &atomPerson{Name: owner},
+		Entries: make([]*atomEntry, len(commits)),
+	}
+	for n, c := range commits {
+		link := e.link(c)
+		f.Entries[n] = &atomEntry{
+			Title:   c.Subject,
+			ID:      link,
+			Updated: c.date.Format(time.RFC3339),
+			Author:  &atomPerson{Name: c.Author, Email: c.Email},
+			Link:    &atomLink{Href: link, Rel: "alternate"},
+		}
+		if body := strings.TrimSpace(c.Body); len(body) > 0 {
+			f.Entries[n].Content = &atomText{Type: "text", Text: body}
+		}
+	}
+	return f
+}
+
+// rssFeed is an RSS 2.0 feed.
+type rssFeed struct {
+	XMLName xml.Name    `xml:"rss"`
+	Version string      `xml:"version,attr"`
+	Channel *rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	Description   string     `xml:"description"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	Items         []*rssItem `xml:"item"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Description string   `xml:"description,omitempty"`
+	Author      string   `xml:"author"`
+	GUID        *rssGUID `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+}
+
+// rss produces an RSS 2.0 feed of the given commits.
+func (e *feedEncoder) rss(title, page string, commits []*RepoCommit) *rssFeed {
+	ch := &rssChannel{
+		Title:         title,
+		Link:          e.base + page,
+		Description:   title,
+		LastBuildDate: updated(commits).Format(time.RFC1123Z),
+		Items:         make([]*rssItem, len(commits)),
+	}
+	for n, c := range commits {
+		link := e.link(c)
+		ch.Items[n] = &rssItem{
+			Title:       c.Subject,
+			Link:        link,
+			Description: strings.TrimSpace(c.Body),
+			Author:      c.Email + " (" + c.Author + ")",
+			GUID:        &rssGUID{IsPermaLink: true, Value: link},
+			PubDate:     c.date.Format(time.RFC1123Z),
+		}
+	}
+	return &rssFeed{Version: "2.0", Channel: ch}
+}
+
+// repoCommits pairs each of the commits with the repository at the
+// given URL path.
+func repoCommits(repository string, commits []*Commit) []*RepoCommit {
+	rcs := make([]*RepoCommit, len(commits))
+	for n, c := range commits {
+		rcs[n] = &RepoCommit{Repository: repository, Commit: c}
+	}
+	return rcs
+}
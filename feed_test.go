@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFeedEncoder(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/proj/?api=atom", nil)
+	req.Host = "example.com"
+	r := &APIResponse{
+		Commits: []*Commit{{
+			SHA:     "0123456789abcdef0123456789abcdef01234567",
+			Author:  "Alice",
+			Email:   "alice@example.com",
+			Subject: "Fix <things>",
+			date:    time.Unix(1380000000, 0).UTC(),
+		}},
+		repository: "/proj/",
+		ref:        "master",
+	}
+
+	for _, format := range []string{feedAtom, feedRSS} {
+		var b bytes.Buffer
+		if err := newFeedEncoder(&b, req, format).Encode(r); err != nil {
+			t.Fatalf("%s: failed to encode: %s", format, err)
+		}
+		var feed struct {
+			Title   string   `xml:"title"`
+			Links   []string `xml:"entry>id"`
+			Channel struct {
+				Title string   `xml:"title"`
+				Links []string `xml:"item>link"`
+			} `xml:"channel"`
+		}
+		if err := xml.Unmarshal(b.Bytes(), &feed); err != nil {
+			t.Fatalf("%s: invalid XML: %s\n%s", format, err, b.String())
+		}
+		title, links := feed.Title, feed.Links
+		if format == feedRSS {
+			title, links = feed.Channel.Title, feed.Channel.Links
+		}
+		expected := "http://example.com/proj/-/commit/" + r.Commits[0].SHA
+		if title != "proj (master)" || len(links) != 1 ||
+			links[0] != expected {
+			t.Errorf("%s: unexpected feed:\n%s", format, b.String())
+		}
+	}
+}
@@ -3,61 +3,309 @@ package main
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Commit struct {
-	SHA     string // Full SHA of the commit
-	Author  string // Author of the commit
-	Email   string // Email attached to the commit
-	Time    string // Relative time of the commit
-	Subject string // Subject of the commit
-	Body    string // Body of the commit
+	SHA            string   // Full SHA of the commit
+	Tree           string   // Full SHA of the commit's tree
+	Parents        []string // Full SHAs of the parent commits
+	Author         string   // Author of the commit
+	Email          string   // Email attached to the commit
+	AuthorDate     string   // Time of authorship, in RFC 3339 format
+	Committer      string   // Committer of the commit
+	CommitterEmail string   // Email of the committer
+	CommitDate     string   // Time of the commit, in RFC 3339 format
+	Time           string   // Relative time of the commit, for display
+	Subject        string   // Subject of the commit
+	Body           string   // Body of the commit
+	Signature      string   `json:",omitempty"` // GPG status, if checked
+
+	date time.Time // Commit time, from which Time is derived
+}
+
+// Statuses of the GPG signatures of commits, which are given in
+// Commit.Signature. They are only checked for commits retrieved by
+// Show. Elsewhere, the status is blank, and it is left out of API
+// responses.
+const (
+	signatureNone         = "none"         // Not signed
+	signatureGood         = "good"         // Valid, from a trusted key
+	signatureBad          = "bad"          // Invalid
+	signatureUntrusted    = "untrusted"    // Valid, from an untrusted key
+	signatureExpired      = "expired"      // Valid, but expired
+	signatureExpiredKey   = "expired key"  // Valid, from an expired key
+	signatureRevokedKey   = "revoked key"  // Valid, from a revoked key
+	signatureUnverifiable = "unverifiable" // Cannot be checked
+)
+
+// gitSignatures maps the codes given by git's "%G?" format to the
+// statuses of signatures.
+var gitSignatures = map[string]string{
+	"N": signatureNone,
+	"G": signatureGood,
+	"B": signatureBad,
+	"U": signatureUntrusted,
+	"X": signatureExpired,
+	"Y": signatureExpiredKey,
+	"R": signatureRevokedKey,
+	"E": signatureUnverifiable,
+}
+
+// CommitInfo is a Commit with the additional details which are shown
+// on its own page, as retrieved by Show.
+type CommitInfo struct {
+	*Commit
+	Diffs []*FileDiff // Changes introduced by the commit
+}
+
+// FileDiff is the portion of a unified diff which applies to a single
+// file.
+type FileDiff struct {
+	OldPath   string // Path before the change, blank if added
+	NewPath   string // Path after the change, blank if deleted
+	Additions int    // Number of lines added
+	Deletions int    // Number of lines removed
+	Binary    bool   // True if git considers the file to be binary
+	Patch     string // Hunks of the diff, from the first "@@" on
+}
+
+// BlameLine is a single line of a file, annotated with the commit
+// which last changed it.
+type BlameLine struct {
+	SHA    string    // Full SHA of the commit
+	Author string    // Author of the commit
+	Email  string    // Email attached to the commit
+	Time   time.Time // Time of authorship
+	Line   int       // Line number in the file, starting at 1
+	Text   string    // Contents of the line
+}
+
+// TreeEntry is a file, directory, or submodule within a directory of
+// a repository.
+type TreeEntry struct {
+	Name string // Name within the directory
+	Mode string // Octal mode, such as "100644"
+	Type string // Object type: "blob", "tree", or "commit"
+	SHA  string // Full SHA of the object
+	Size int64  // Size in bytes of blobs, and zero otherwise
+}
+
+// Ref is a branch or tag, along with the commit at its tip.
+type Ref struct {
+	Name    string  // Short name, such as "master" or "v1.0"
+	Commit  *Commit // Tip, with its SHA, author, time, and subject
+	Tagger  string  `json:",omitempty"` // Creator of an annotated tag
+	Message string  `json:",omitempty"` // Message of an annotated tag
+	Ahead   int     // Commits on the ref which are not on the base
+	Behind  int     // Commits on the base which are not on the ref
+}
+
+// Namespaces of refs which can be listed with Refs.
+const (
+	refsBranches = "refs/heads/"
+	refsTags     = "refs/tags/"
+)
+
+// LogFilter restricts the commits listed in a log. Fields which are
+// blank do not restrict it.
+type LogFilter struct {
+	Author    string // Pattern matching the author's name or email
+	Committer string // Pattern matching the committer's name or email
+	Grep      string // Pattern matching the commit message
+	After     string // Earliest commit date, in any form git accepts
+	Before    string // Latest commit date, in any form git accepts
+	Path      string // Path within the repository which was affected
+	Follow    bool   // Follow Path through renames
+}
+
+// args produces the arguments to git log which apply the filter. The
+// patterns are extended regular expressions.
+func (f *LogFilter) args() (args []string) {
+	args = append(args, "--extended-regexp")
+	for _, opt := range []struct{ name, value string }{
+		{"--author=", f.Author},
+		{"--committer=", f.Committer},
+		{"--grep=", f.Grep},
+		{"--after=", f.After},
+		{"--before=", f.Before},
+	} {
+		if len(opt.value) > 0 {
+			args = append(args, opt.name+opt.value)
+		}
+	}
+	if len(f.Path) > 0 {
+		if f.Follow {
+			args = append(args, "--follow")
+		}
+		args = append(args, "--", f.Path)
+	}
+	return
+}
+
+// GrepQuery describes a search of the contents of a repository.
+type GrepQuery struct {
+	Pattern    string // Text or regular expression to search for
+	Regexp     bool   // Pattern is an extended regular expression
+	IgnoreCase bool   // Letters match regardless of case
+}
+
+// GrepMatch is a line of a file which matched a search.
+type GrepMatch struct {
+	File string // Path within the repository
+	Line int    // Line number in the file, starting at 1
+	Text string // Contents of the line
 }
 
 const (
 	gitHttpBackend = "git-http-backend"
-	gitLogFmt      = "%H%n%cr%n%an%n%ae%n%s%n%b"
-	gitLogSep      = "----GROVE-LOG-SEPARATOR----"
+
+	// gitLogFmt is the format in which parseLog has git log describe
+	// each commit. The fields are separated by NULs, and with -z, so
+	// are the commits, so no field can be mistaken for another. The
+	// signature status is left blank, because checking it would run
+	// gpg for every signed commit in the log.
+	gitLogFmt = "%H%x00%T%x00%P%x00%ct%x00%an%x00%ae%x00%aI%x00" +
+		"%cn%x00%ce%x00%cI%x00%x00%s%x00%b"
+
+	// gitRefFmt is the format in which Refs has git for-each-ref
+	// describe each ref. Fields prefixed by "*" describe the object
+	// which an annotated tag points to, and are blank otherwise.
+	gitRefFmt = "%(refname:short)%00%(objecttype)%00" +
+		"%(objectname)%00%(*objectname)%00" +
+		"%(authorname)%00%(*authorname)%00" +
+		"%(authoremail)%00%(*authoremail)%00" +
+		"%(committerdate:unix)%00%(*committerdate:unix)%00" +
+		"%(subject)%00%(*subject)%00%(taggername)%00%(body)%00" +
+		"%(*objecttype)%00"
+	gitRefFields = 15
+
+	// gitShowFmt is the format used by Show. It has the same fields
+	// as gitLogFmt, but gives the signature status, and the last field
+	// is also followed by a NUL, so that the diff can be split off
+	// after it.
+	gitShowFmt = "%H%x00%T%x00%P%x00%ct%x00%an%x00%ae%x00%aI%x00" +
+		"%cn%x00%ce%x00%cI%x00%G?%x00%s%x00%b%x00"
+
+	// gitCommitFields is the number of fields describing each commit
+	// in gitLogFmt and gitShowFmt.
+	gitCommitFields = 13
 )
 
 type git struct {
 	Path string // Directory path
 }
 
+// Dir returns the directory in which git is invoked, which is the top
+// level of the repository.
+func (g *git) Dir() string {
+	return g.Path
+}
+
+// GitError is returned by the methods of git when an invocation of
+// git fails. Kind is one of RefNotFoundError, PathNotFoundError,
+// NotRepositoryError, or GitFailedError, and Stderr holds whatever
+// git printed to explain the failure.
+type GitError struct {
+	Kind   error    // Category of the failure
+	Args   []string // Arguments passed to git
+	Stderr string   // Standard error output of git
+	Err    error    // Underlying error from os/exec
+}
+
+func (e *GitError) Error() string {
+	s := e.Kind.Error() + " (git " + strings.Join(e.Args, " ") + ")"
+	if len(e.Stderr) > 0 {
+		s += ": " + e.Stderr
+	} else if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+var (
+	RefNotFoundError    = errors.New("git: ref not found")
+	PathNotFoundError   = errors.New("git: path not found")
+	NotRepositoryError  = errors.New("git: not a repository")
+	GitFailedError      = errors.New("git: command failed")
+	InvalidRefError     = errors.New("git: invalid ref")
+	InvalidPatternError = errors.New("git: invalid pattern")
+)
+
+// gitErrorKinds maps fragments of git's error messages to the kind
+// of GitError that they indicate. They are checked in order.
+var gitErrorKinds = []struct {
+	Fragment string
+	Kind     error
+}{
+	{"not a git repository", NotRepositoryError},
+	{"must be run in a work tree", NotRepositoryError},
+	{"does not exist in", PathNotFoundError},
+	{"exists on disk, but not in", PathNotFoundError},
+	{"no such path", PathNotFoundError},
+	{"invalid object name", RefNotFoundError},
+	{"not a valid object name", RefNotFoundError},
+	{"Not a valid object name", RefNotFoundError},
+	{"unknown revision", RefNotFoundError},
+	{"bad revision", RefNotFoundError},
+	{"bad object", RefNotFoundError},
+	{"Needed a single revision", RefNotFoundError},
+	{"does not have any commits yet", RefNotFoundError},
+	{"command line, '", InvalidPatternError}, // In --grep or git grep
+	{"header, '", InvalidPatternError},       // In --author or --committer
+}
+
+// ErrorKind returns the Kind of err if it is a *GitError, and err
+// itself otherwise.
+func ErrorKind(err error) error {
+	if e, ok := err.(*GitError); ok {
+		return e.Kind
+	}
+	return err
+}
+
 // Set a number of git variables.
-func gitVarExecPath() (execPath string) {
+func gitVarExecPath() (execPath string, err error) {
 	// Use 'git --exec-path' to get the path of the git executables.
 	g := &git{}
-	execPath, _ = g.execute("--exec-path")
-	execPath = strings.TrimRight(execPath, "\n")
-	return
+	execPath, err = g.execute("--exec-path")
+	return strings.TrimRight(execPath, "\n"), err
 }
 
-func (g *git) User() (user string) {
+func (g *git) User() (user string, err error) {
 	// Use 'git config --global user.name to retrieve the variable.
-	user, _ = g.execute("config", "--global", "user.name")
-	return strings.TrimRight(user, "\n")
+	return g.config("--global", "user.name")
 }
 
-func (g *git) Email() (email string) {
+func (g *git) Email() (email string, err error) {
 	// Use 'git config user.email to retrieve the variable. Note that
 	// it does not use '--global' so it can vary by repository.
-	email, _ = g.execute("config", "user.email")
-	return strings.TrimRight(email, "\n")
+	return g.config("user.email")
 }
 
-func (g *git) Branch(ref string) (branch string) {
-	branch, _ = g.execute("rev-parse", "--abbrev-ref", ref)
-	return strings.TrimRight(branch, "\n")
+func (g *git) Branch(ref string) (branch string, err error) {
+	if strings.HasPrefix(ref, "-") {
+		return "", InvalidRefError
+	}
+	branch, err = g.execute("rev-parse", "--abbrev-ref", ref)
+	return strings.TrimRight(branch, "\n"), err
 }
 
-func (g *git) Branches() (branches []string) {
+func (g *git) Branches() (branches []string, err error) {
 	// Retrieve a list of branches separated by "\n" and indented by
 	// either two spaces or "* ".
-	branchList, _ := g.execute("branch", "--no-color")
+	branchList, err := g.execute("branch", "--no-color")
+	if err != nil || len(branchList) == 0 {
+		return nil, err
+	}
 	// Prepare the slice by counting the number of newlines, including
 	// the final one.
 	branches = make([]string, strings.Count(branchList, "\n"))
@@ -72,23 +320,26 @@ func (g *git) Branches() (branches []string) {
 
 // TopLevel invokes git rev-parse in order to determine the top level
 // of current git repository. If it is not called from a git
-// repository, it will return a blank string.
-func (g *git) TopLevel() (toplevel string) {
-	toplevel, _ = g.execute("rev-parse", "--show-toplevel")
-	return strings.TrimRight(toplevel, "\n")
+// repository, it will return NotRepositoryError.
+func (g *git) TopLevel() (toplevel string, err error) {
+	toplevel, err = g.execute("rev-parse", "--show-toplevel")
+	return strings.TrimRight(toplevel, "\n"), err
 }
 
 // Prefix invokes git rev-parse in order to retrieve the
 // relative-to-the-toplevel path of the current Path. If it is not
-// called from a git repository, it will return a blank string.
-func (g *git) Prefix() (prefix string) {
-	prefix, _ = g.execute("rev-parse", "--show-prefix")
-	return strings.TrimRight(prefix, "\n")
+// called from a git repository, it will return NotRepositoryError.
+func (g *git) Prefix() (prefix string, err error) {
+	prefix, err = g.execute("rev-parse", "--show-prefix")
+	return strings.TrimRight(prefix, "\n"), err
 }
 
 // IsDir invokes git cat-file to determine whether the given path is a
 // file or directory within a git repository.
 func (g *git) IsDir(ref, file string) (isDir bool, err error) {
+	if strings.HasPrefix(ref, "-") {
+		return false, InvalidRefError
+	}
 	output, err := g.execute("cat-file", "-t", ref+":"+file)
 	return (output == "tree\n"), err
 }
@@ -97,137 +348,697 @@ func (g *git) IsDir(ref, file string) (isDir bool, err error) {
 // description from the repository configuration file, if it's set. It
 // will attempt to parse branch names from refs like
 // `<oldRef>..<newRef>`.
-func (g *git) GetBranchDescription(branch string) (description string) {
+func (g *git) GetBranchDescription(branch string) (description string, err error) {
 	// Attempt to parse the branch name if it looks like it's in the
 	// form of a comparison.
 	if idx := strings.LastIndex(branch, ".."); idx > -1 {
 		branch = branch[idx+2:] // Add 2 to ignore the ".."
 	} // Otherwise, just continue.
-	output, _ := g.execute("config", "branch."+branch+".description")
-	return strings.TrimRight(output, "\n")
+	return g.config("branch." + branch + ".description")
 }
 
 // GetFile retrives the contents of a file from the repository. The
 // commit is either a SHA or pointer (such as HEAD, or HEAD^).
-func (g *git) GetFile(commit, file string) (contents []byte) {
-	contents, _ = g.executeB("--no-pager", "show", commit+":"+file)
-	return contents
+func (g *git) GetFile(commit, file string) (contents []byte, err error) {
+	if strings.HasPrefix(commit, "-") {
+		return nil, InvalidRefError
+	}
+	return g.executeB("--no-pager", "show", commit+":"+file)
 }
 
 // Retrieve a list of items in a directory from the repository. The
 // commit is either a SHA or a pointer (such as HEAD, or HEAD^).
-func (g *git) GetDir(commit, dir string) (files []string) {
-	output, _ := g.execute("--no-pager", "show", "--name-only", commit+":"+dir)
+func (g *git) GetDir(commit, dir string) (files []string, err error) {
+	if strings.HasPrefix(commit, "-") {
+		return nil, InvalidRefError
+	}
+	output, err := g.execute("--no-pager", "show", "--name-only", commit+":"+dir)
+	if err != nil {
+		return nil, err
+	}
 	parts := strings.SplitN(output, "\n\n", 2) // Split on the blank line
 	if len(parts) == 2 && strings.HasPrefix(parts[0], "tree") {
-		return strings.Split(strings.TrimRight(parts[1], "\n"), "\n")
+		return strings.Split(strings.TrimRight(parts[1], "\n"), "\n"), nil
+	}
+	return
+}
+
+// Tree invokes git ls-tree to list the entries of a directory as of
+// the given commit, including their modes, types, and sizes. If the
+// directory does not exist, it returns PathNotFoundError.
+func (g *git) Tree(commit, dir string) (entries []*TreeEntry, err error) {
+	if strings.HasPrefix(commit, "-") {
+		return nil, InvalidRefError
+	}
+	args := []string{"ls-tree", "-l", "-z", commit}
+	if dir = strings.Trim(dir, "/"); len(dir) > 0 {
+		args = append(args, "--", dir+"/")
+	}
+	output, err := g.execute(args...)
+	if err != nil {
+		return nil, err
+	}
+	entries = parseLsTree(output)
+	if len(entries) == 0 && len(dir) > 0 {
+		// Git cannot store empty directories, so the path is either
+		// missing or not a directory.
+		return nil, PathNotFoundError
+	}
+	return entries, nil
+}
+
+// parseLsTree is a low-level utility for parsing the output of git
+// ls-tree -l -z. Each entry is of the form
+// "<mode> <type> <sha> <size>\t<path>\x00", where the size is padded
+// with spaces, and is "-" for anything but blobs.
+func parseLsTree(output string) (entries []*TreeEntry) {
+	for _, line := range strings.Split(output, "\x00") {
+		tab := strings.Index(line, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 4 {
+			continue
+		}
+		e := &TreeEntry{
+			Name: line[tab+1:],
+			Mode: fields[0],
+			Type: fields[1],
+			SHA:  fields[2],
+		}
+		if i := strings.LastIndex(e.Name, "/"); i >= 0 {
+			e.Name = e.Name[i+1:]
+		}
+		e.Size, _ = strconv.ParseInt(fields[3], 10, 64)
+		entries = append(entries, e)
 	}
 	return
 }
 
 // SHA retrieves the short form (minimum 8 characters) of the given
 // reference.
-func (g *git) SHA(ref string) (sha string) {
-	commit, _ := g.execute("rev-parse", "--short=8", ref)
-	return strings.TrimRight(commit, "\n")
+func (g *git) SHA(ref string) (sha string, err error) {
+	if strings.HasPrefix(ref, "-") {
+		return "", InvalidRefError
+	}
+	commit, err := g.execute("rev-parse", "--short=8", ref)
+	return strings.TrimRight(commit, "\n"), err
+}
+
+// Resolve retrieves the full SHA of the commit named by the given
+// reference.
+func (g *git) Resolve(ref string) (sha string, err error) {
+	if len(ref) == 0 || strings.HasPrefix(ref, "-") {
+		return "", InvalidRefError
+	}
+	commit, err := g.execute("rev-parse", "--verify", ref+"^{commit}")
+	return strings.TrimRight(commit, "\n"), err
 }
 
 // Tags retrieves a list of all tag names from the repository.
-func (g *git) Tags() (tags []string) {
-	t, _ := g.execute("tag", "--list")
-	return strings.Split(strings.TrimRight(t, "\n"), "\n")
+func (g *git) Tags() (tags []string, err error) {
+	t, err := g.execute("tag", "--list")
+	if err != nil || len(t) == 0 {
+		return nil, err
+	}
+	return strings.Split(strings.TrimRight(t, "\n"), "\n"), nil
 }
 
-func (g *git) TotalCommits() (commits int) {
-	c, _ := g.execute("rev-list", "--all")
-	return len(strings.Split(strings.TrimRight(c, "\n"), "\n"))
+// Refs invokes git for-each-ref to list the refs in the given
+// namespace, such as refsBranches, along with their tips, most
+// recently changed first. Ahead and Behind are left as zero.
+func (g *git) Refs(namespace string) (refs []*Ref, err error) {
+	output, err := g.execute("for-each-ref", "--sort=-creatordate",
+		"--format="+gitRefFmt, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return parseRefs(output), nil
+}
+
+// parseRefs is a low-level utility for parsing the output of git
+// for-each-ref in gitRefFmt. Each field ends with a NUL, and each ref
+// with a newline, but fields such as the message can also contain
+// newlines.
+func parseRefs(output string) (refs []*Ref) {
+	fields := strings.Split(output, "\x00")
+	for len(fields) > gitRefFields {
+		f := fields[:gitRefFields]
+		fields = fields[gitRefFields:]
+		f[0] = strings.TrimPrefix(f[0], "\n")
+
+		// Unless the ref is an annotated tag, the commit is described
+		// by the ordinary fields.
+		ref := &Ref{Name: f[0]}
+		objectType, sha, author, email, date, subject :=
+			f[1], f[2], f[4], f[6], f[8], f[10]
+		if f[1] == "tag" {
+			objectType, sha, author, email, date, subject =
+				f[14], f[3], f[5], f[7], f[9], f[11]
+			ref.Tagger = f[12]
+			ref.Message = strings.TrimSpace(f[10] + "\n\n" + f[13])
+		}
+		if objectType != "commit" {
+			// Tags can point to objects other than commits, such as
+			// blobs, trees, or other tags.
+			continue
+		}
+		c := &Commit{
+			SHA:     sha,
+			Author:  author,
+			Email:   strings.Trim(email, "<>"),
+			Subject: subject,
+		}
+		if sec, err := strconv.ParseInt(date, 10, 64); err == nil {
+			c.date = time.Unix(sec, 0)
+			c.Time = relativeTime(c.date)
+		}
+		ref.Commit = c
+		refs = append(refs, ref)
+	}
+	return
+}
+
+// AheadBehind counts the commits which are on ref but not base, and
+// those which are on base but not ref.
+func (g *git) AheadBehind(base, ref string) (ahead, behind int, err error) {
+	// Refuse refs which git would interpret as options.
+	if strings.HasPrefix(base, "-") || strings.HasPrefix(ref, "-") {
+		return 0, 0, InvalidRefError
+	}
+	output, err := g.execute("rev-list", "--left-right", "--count",
+		base+"..."+ref, "--")
+	if err != nil {
+		return 0, 0, err
+	}
+	counts := strings.Fields(output)
+	if len(counts) != 2 {
+		return 0, 0, GitFailedError
+	}
+	behind, _ = strconv.Atoi(counts[0])
+	ahead, _ = strconv.Atoi(counts[1])
+	return ahead, behind, nil
+}
+
+func (g *git) TotalCommits() (commits int, err error) {
+	c, err := g.execute("rev-list", "--all")
+	if err != nil || len(c) == 0 {
+		return 0, err
+	}
+	return strings.Count(c, "\n"), nil
 }
 
 func (g *git) RefExists(ref string) (exists bool) {
 	// If the exit status of 'git rev-list -n 1 <ref>' is nonzero, the
 	// ref does not exist in the current repository.
-	_, err := g.execute("rev-list", "-n 1", ref)
+	if len(ref) == 0 || strings.HasPrefix(ref, "-") {
+		return false
+	}
+	_, err := g.execute("rev-list", "-n 1", ref, "--")
 	return err == nil
 }
 
 // Commits parses the log and returns an array of Commit types, up to
 // the given max.
-func (g *git) Commits(ref string, max int) (commits []*Commit) {
+func (g *git) Commits(ref string, max int) (commits []*Commit, err error) {
 	return g.parseLog(ref, max)
 }
 
 // CommitsByFile retrieves a list of commits which modify or otherwise
 // affect a file, up to the given maximum number of commits.
-func (g *git) CommitsByFile(ref, file string, max int) (commits []*Commit) {
+func (g *git) CommitsByFile(ref, file string, max int) (commits []*Commit, err error) {
 	return g.parseLog(ref, max, "--follow", "--", file)
 }
 
-// parseLog is a low-level utility for calling `git log` and producing
-// a []*Commit with no phantom commits. It invokes gitParseCommit to
-// parse individual commits.
-func (g *git) parseLog(ref string, max int, arguments ...string) (commits []*Commit) {
-	// First, we have to go through the arduous process of creating
-	// the command.
-	command := []string{"--no-pager", "log", ref,
-		"--format=format:" + gitLogFmt + gitLogSep}
-	if max > 0 {
-		command = append(command, "-n "+strconv.Itoa(max))
+// CommitsMatching retrieves a list of the commits in the log of ref
+// which pass the filter, up to the given maximum number of commits.
+func (g *git) CommitsMatching(ref string, f *LogFilter, max int) (commits []*Commit, err error) {
+	return g.parseLog(ref, max, f.args()...)
+}
+
+// Show invokes git show to retrieve the details of a single commit,
+// including its parents, committer, and the diff that it introduces.
+// Tags are peeled to the commits they point to.
+func (g *git) Show(ref string) (info *CommitInfo, err error) {
+	// Refuse refs which git would interpret as options.
+	if strings.HasPrefix(ref, "-") {
+		return nil, InvalidRefError
+	}
+	// Otherwise, git show would describe an annotated tag before the
+	// commit.
+	output, err := g.execute("--no-pager", "show", "--no-color",
+		"--no-ext-diff", "-M", "--patch",
+		"--format=format:"+gitShowFmt, ref+"^{commit}", "--")
+	if err != nil {
+		return nil, err
 	}
-	command = append(command, arguments...)
 
-	log, _ := g.execute(command...)
-	// Now we must parse the output of that command.
-	commitLogs := strings.Split(log, gitLogSep)
-	// We will have a phantom commit here, though, so we must remove
-	// it.
-	commitLogs = commitLogs[:len(commitLogs)-1]
+	fields := strings.SplitN(output, "\x00", gitCommitFields+1)
+	if len(fields) != gitCommitFields+1 {
+		return nil, InvalidRefError
+	}
+	info = &CommitInfo{
+		Commit: gitParseCommit(fields[:gitCommitFields]),
+		Diffs:  parseDiff(fields[gitCommitFields]),
+	}
+	return
+}
+
+// Diff invokes git diff to retrieve the changes introduced on "to"
+// since it diverged from "from", as in `git diff <from>...<to>`.
+func (g *git) Diff(from, to string) (diffs []*FileDiff, err error) {
+	// Refuse refs which git would interpret as options.
+	if strings.HasPrefix(from, "-") || strings.HasPrefix(to, "-") {
+		return nil, InvalidRefError
+	}
+	output, err := g.execute("--no-pager", "diff", "--no-color",
+		"--no-ext-diff", "-M", from+"..."+to, "--")
+	if err != nil {
+		return nil, err
+	}
+	return parseDiff(output), nil
+}
 
-	commits = make([]*Commit, len(commitLogs))
-	for n, l := range commitLogs {
-		commits[n] = gitParseCommit(strings.Split(l, "\n"))
+// Blame invokes git blame to annotate each line of a file with the
+// commit which last changed it, as of the given ref.
+func (g *git) Blame(ref, file string) (lines []*BlameLine, err error) {
+	// Refuse refs which git would interpret as options.
+	if strings.HasPrefix(ref, "-") {
+		return nil, InvalidRefError
+	}
+	output, err := g.execute("--no-pager", "blame", "--porcelain",
+		ref, "--", file)
+	if err != nil {
+		return nil, err
+	}
+	return parseBlame(output), nil
+}
+
+// parseBlame is a low-level utility for parsing the output of git
+// blame --porcelain. Each line of the file is preceded by a header
+// of the form "<sha> <original line> <final line> [<group size>]",
+// and the first time a commit appears, the header is followed by
+// information about it, such as "author <name>".
+func parseBlame(output string) (lines []*BlameLine) {
+	commits := make(map[string]*BlameLine)
+	var current *BlameLine // Commit info for the current line
+	var n int              // Line number of the current line
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "\t") {
+			// The line itself ends the entry.
+			if current != nil {
+				l := *current
+				l.Line, l.Text = n, line[1:]
+				lines = append(lines, &l)
+			}
+			current = nil
+			continue
+		}
+
+		if current == nil {
+			// This must be a header.
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				continue
+			}
+			if current = commits[fields[0]]; current == nil {
+				current = &BlameLine{SHA: fields[0]}
+				commits[fields[0]] = current
+			}
+			n, _ = strconv.Atoi(fields[2])
+			continue
+		}
+
+		// Otherwise, it's information about the commit.
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "author":
+			current.Author = parts[1]
+		case "author-mail":
+			current.Email = strings.Trim(parts[1], "<>")
+		case "author-time":
+			if sec, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+				current.Time = time.Unix(sec, 0)
+			}
+		}
 	}
 	return
 }
 
-// gitParseCommit is a low-level utility for parsing log formats of
-// the following format. They are generated like this by gitLogFmt.
-//    <full hash>
-//    <commit time relative>
-//    <author name>
-//    <nonwrapped commit message>
-func gitParseCommit(log []string) (commit *Commit) {
-	commit = new(Commit)
-	for _, l := range log {
-		if len(commit.SHA) == 0 {
-			// If l is empty, then this will be run again.
-			commit.SHA = l
+// Archive invokes git archive to write the files of the given ref, or
+// only those within dir if it is not blank, to w in the given format,
+// such as "tar.gz" or "zip". Each path in the archive begins with the
+// prefix.
+func (g *git) Archive(w io.Writer, ref, format, prefix, dir string) (err error) {
+	// Refuse refs which git would interpret as options.
+	if strings.HasPrefix(ref, "-") {
+		return InvalidRefError
+	}
+	args := []string{"archive", "--format=" + format,
+		"--prefix=" + prefix, ref}
+	if len(dir) > 0 {
+		args = append(args, "--", dir)
+	}
+	return g.executeTo(w, args...)
+}
+
+// Grep invokes git grep to search the files of the given ref for
+// lines matching the query, and returns up to max of them, or all of
+// them if max is not positive. Binary files are not searched.
+func (g *git) Grep(ref string, q *GrepQuery, max int) (matches []*GrepMatch, err error) {
+	// Refuse refs which git would interpret as options.
+	if strings.HasPrefix(ref, "-") {
+		return nil, InvalidRefError
+	}
+	args := []string{"--no-pager", "grep", "-n", "-I", "-z",
+		"--full-name", "--no-color"}
+	if q.Regexp {
+		args = append(args, "-E")
+	} else {
+		args = append(args, "-F")
+	}
+	if q.IgnoreCase {
+		args = append(args, "-i")
+	}
+	if max > 0 {
+		// This limits the matches per file, so the total is limited
+		// below.
+		args = append(args, "--max-count", strconv.Itoa(max))
+	}
+	output, err := g.execute(append(args, "-e", q.Pattern, ref, "--")...)
+	if err != nil {
+		// git grep fails without any message if nothing matched.
+		if e, ok := err.(*GitError); ok && len(e.Stderr) == 0 {
+			if _, ok = e.Err.(*exec.ExitError); ok {
+				return nil, nil
+			}
+		}
+		return nil, err
+	}
+	matches = parseGrep(output, ref)
+	if max > 0 && len(matches) > max {
+		matches = matches[:max]
+	}
+	return matches, nil
+}
+
+// parseGrep is a low-level utility for parsing the output of git grep
+// -n -z on the given ref. Each line is of the form
+// "<ref>:<file>\x00<line number>\x00<text>".
+func parseGrep(output, ref string) (matches []*GrepMatch) {
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(line, "\x00", 3)
+		if len(parts) != 3 {
 			continue
 		}
-		if len(commit.Time) == 0 {
-			commit.Time = l
+		n, err := strconv.Atoi(parts[1])
+		if err != nil {
 			continue
 		}
-		if len(commit.Author) == 0 {
-			commit.Author = l
+		matches = append(matches, &GrepMatch{
+			File: strings.TrimPrefix(parts[0], ref+":"),
+			Line: n,
+			Text: parts[2],
+		})
+	}
+	return
+}
+
+// relativeTime formats the time which has passed since t in the same
+// manner as git's relative dates, such as "3 days ago". Each unit is
+// rounded from the last, as git does, so that the results match.
+func relativeTime(t time.Time) string {
+	diff := int64(time.Since(t) / time.Second)
+	if diff < 0 {
+		return "in the future"
+	}
+	if diff < 90 {
+		return plural(diff, "second") + " ago"
+	}
+	// Turn it into minutes.
+	if diff = (diff + 30) / 60; diff < 90 {
+		return plural(diff, "minute") + " ago"
+	}
+	// Turn it into hours.
+	if diff = (diff + 30) / 60; diff < 36 {
+		return plural(diff, "hour") + " ago"
+	}
+	// We deal with number of days from here on.
+	if diff = (diff + 12) / 24; diff < 14 {
+		return plural(diff, "day") + " ago"
+	}
+	// Say weeks for the past 10 weeks or so.
+	if diff < 70 {
+		return plural((diff+3)/7, "week") + " ago"
+	}
+	// Say months for the past 12 months or so.
+	if diff < 365 {
+		return plural((diff+15)/30, "month") + " ago"
+	}
+	// Give years and months for 5 years or so.
+	if diff < 1825 {
+		totalMonths := (diff*12*2 + 365) / (365 * 2)
+		years, months := totalMonths/12, totalMonths%12
+		if months > 0 {
+			return plural(years, "year") + ", " +
+				plural(months, "month") + " ago"
+		}
+		return plural(years, "year") + " ago"
+	}
+	// Otherwise, just years.
+	return plural((diff+183)/365, "year") + " ago"
+}
+
+// plural formats n with the given unit, which is made plural unless n
+// is 1.
+func plural(n int64, unit string) string {
+	if n != 1 {
+		unit += "s"
+	}
+	return strconv.FormatInt(n, 10) + " " + unit
+}
+
+// parseDiff is a low-level utility for splitting the output of git
+// diff (or the patch section of git show) into the changes for each
+// file. It understands both ordinary and combined (merge) diffs.
+func parseDiff(patch string) (diffs []*FileDiff) {
+	var d *FileDiff
+	var hunks bool  // Whether we are past the header of d
+	var parents int // Number of columns in front of each hunk line
+	for _, line := range strings.Split(patch, "\n") {
+		if strings.HasPrefix(line, "diff --git ") ||
+			strings.HasPrefix(line, "diff --cc ") ||
+			strings.HasPrefix(line, "diff --combined ") {
+			d = &FileDiff{}
+			diffs = append(diffs, d)
+			hunks = false
+
+			// Guess the paths from the header, in case there are no
+			// "---" and "+++" lines, such as in a pure rename.
+			if names := strings.TrimPrefix(line, "diff --git "); names != line {
+				if idx := strings.Index(names, " b/"); idx > -1 {
+					d.OldPath = strings.TrimPrefix(names[:idx], "a/")
+					d.NewPath = names[idx+3:]
+				}
+			} else {
+				d.NewPath = line[strings.Index(line[5:], " ")+6:]
+				d.OldPath = d.NewPath
+			}
 			continue
 		}
-		if len(commit.Email) == 0 {
-			commit.Email = l
+		if d == nil || len(line) == 0 {
+			// Ignore anything before the first file, and the
+			// trailing newline.
 			continue
 		}
-		if len(commit.Subject) == 0 {
-			commit.Subject = l
+
+		if !hunks {
+			switch {
+			case strings.HasPrefix(line, "@@"):
+				hunks = true
+				parents = len(line) - len(strings.TrimLeft(line, "@")) - 1
+			case strings.HasPrefix(line, "--- "):
+				d.OldPath = diffPath(line[4:], "a/")
+			case strings.HasPrefix(line, "+++ "):
+				d.NewPath = diffPath(line[4:], "b/")
+			case strings.HasPrefix(line, "rename from "):
+				d.OldPath = line[12:]
+			case strings.HasPrefix(line, "rename to "):
+				d.NewPath = line[10:]
+			case strings.HasPrefix(line, "new file mode"):
+				d.OldPath = ""
+			case strings.HasPrefix(line, "deleted file mode"):
+				d.NewPath = ""
+			case strings.HasPrefix(line, "Binary files "):
+				d.Binary = true
+			}
+			if !hunks {
+				continue
+			}
+		}
+
+		d.Patch += line + "\n"
+		if len(line) < parents || strings.HasPrefix(line, "@@") {
 			continue
 		}
+		switch columns := line[:parents]; {
+		case strings.Contains(columns, "+"):
+			d.Additions++
+		case strings.Contains(columns, "-"):
+			d.Deletions++
+		}
+	}
+	return
+}
 
-		commit.Body += l + "\n"
+// diffPath strips the given prefix from a path in a "---" or "+++"
+// line of a diff, and returns a blank string for /dev/null.
+func diffPath(p, prefix string) string {
+	if p == "/dev/null" {
+		return ""
 	}
+	return strings.TrimPrefix(p, prefix)
+}
+
+// parseLog is a low-level utility for calling `git log` and producing
+// a []*Commit. The output is parsed by a logReader as git produces it,
+// rather than being collected first.
+func (g *git) parseLog(ref string, max int, arguments ...string) (commits []*Commit, err error) {
+	if strings.HasPrefix(ref, "-") {
+		return nil, InvalidRefError
+	}
+
+	// First, we have to go through the arduous process of creating
+	// the command.
+	command := []string{"--no-pager", "log", "-z", ref,
+		"--format=format:" + gitLogFmt}
+	if max > 0 {
+		command = append(command, "-n "+strconv.Itoa(max))
+	}
+	command = append(command, arguments...)
+
+	// Then read the commits from git as it writes them. If git fails,
+	// its error is returned by the reader.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(g.executeTo(pw, command...))
+	}()
+	defer pr.Close() // Stops git if the log cannot be parsed
+	lr := newLogReader(pr)
+	for {
+		commit, err := lr.Next()
+		if err == io.EOF {
+			return commits, nil
+		} else if err != nil {
+			return nil, err
+		}
+		commits = append(commits, commit)
+	}
+}
+
+// logReader reads commits one at a time from the output of git log -z
+// in gitLogFmt, without holding more than one commit in memory.
+type logReader struct {
+	r *bufio.Reader
+}
+
+// newLogReader creates a logReader which reads the output of git log
+// from r.
+func newLogReader(r io.Reader) *logReader {
+	return &logReader{r: bufio.NewReader(r)}
+}
 
-	// Now, remove the trailing "\n" characters.
-	commit.Body = strings.TrimRight(commit.Body, "\n")
+// Next reads the next commit. After the last one, it returns io.EOF,
+// and if the output ends partway through a commit, it returns
+// io.ErrUnexpectedEOF.
+func (lr *logReader) Next() (commit *Commit, err error) {
+	fields := make([]string, gitCommitFields)
+	for n := range fields {
+		// Every field ends with a NUL, except for the last field of
+		// the last commit, which ends with the output.
+		field, err := lr.r.ReadString(0)
+		if err == io.EOF {
+			switch {
+			case n == 0 && len(field) == 0:
+				return nil, io.EOF
+			case n < gitCommitFields-1:
+				return nil, io.ErrUnexpectedEOF
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		fields[n] = strings.TrimSuffix(field, "\x00")
+	}
+	return gitParseCommit(fields), nil
+}
+
+// gitParseCommit is a low-level utility for parsing the fields which
+// gitLogFmt and gitShowFmt give for each commit, in order:
+//
+//	<full hash>
+//	<full hash of the tree>
+//	<full hashes of the parents, separated by spaces>
+//	<commit time as a Unix timestamp>
+//	<author name>
+//	<author email>
+//	<author time in strict ISO 8601 format>
+//	<committer name>
+//	<committer email>
+//	<commit time in strict ISO 8601 format>
+//	<signature status code, blank in gitLogFmt>
+//	<subject>
+//	<body, which may span several lines>
+//
+// There must be exactly gitCommitFields of them, but any may be blank.
+func gitParseCommit(fields []string) (commit *Commit) {
+	commit = &Commit{
+		SHA:            fields[0],
+		Tree:           fields[1],
+		Parents:        strings.Fields(fields[2]),
+		Author:         fields[4],
+		Email:          fields[5],
+		AuthorDate:     rfc3339(fields[6]),
+		Committer:      fields[7],
+		CommitterEmail: fields[8],
+		CommitDate:     rfc3339(fields[9]),
+		Signature:      gitSignatures[fields[10]],
+		Subject:        fields[11],
+		Body:           strings.TrimRight(fields[12], "\n"),
+	}
+	if sec, err := strconv.ParseInt(fields[3], 10, 64); err == nil {
+		commit.date = time.Unix(sec, 0)
+		commit.Time = relativeTime(commit.date)
+	}
 	return
 }
 
+// rfc3339 normalizes a time given by git in strict ISO 8601 format to
+// the form produced by Go's time.RFC3339, so that every backend gives
+// the same string. If it cannot be parsed, it is returned as is.
+func rfc3339(iso string) string {
+	t, err := time.Parse(time.RFC3339, iso)
+	if err != nil {
+		return iso
+	}
+	return t.Format(time.RFC3339)
+}
+
+// config retrieves a variable using git config. If the variable is
+// not set, it returns a blank string and no error.
+func (g *git) config(args ...string) (value string, err error) {
+	value, err = g.execute(append([]string{"config"}, args...)...)
+	if e, ok := err.(*GitError); ok && len(e.Stderr) == 0 {
+		// git config exits with a nonzero status and prints nothing
+		// if the variable is missing.
+		return "", nil
+	}
+	return strings.TrimRight(value, "\n"), err
+}
+
 // execute invokes exec.Command() with the given command, arguments,
 // and working directory. All CR ('\r') characters are removed in
 // output.
@@ -236,11 +1047,58 @@ func (g *git) execute(args ...string) (output string, err error) {
 	return string(out), err
 }
 
+// executeB is the same as execute, but produces a []byte. If git
+// fails, the error is a *GitError describing the failure.
 func (g *git) executeB(args ...string) (output []byte, err error) {
 	cmd := exec.Command("git", args...)
 	if len(g.Path) != 0 {
 		cmd.Dir = g.Path
 	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	out, err := cmd.Output()
-	return out, err
+	if err != nil {
+		return out, newGitError(args, stderr.String(), err)
+	}
+	return out, nil
+}
+
+// executeTo is the same as execute, but writes the output of git to w
+// as it is produced, rather than collecting it.
+func (g *git) executeTo(w io.Writer, args ...string) (err error) {
+	cmd := exec.Command("git", args...)
+	if len(g.Path) != 0 {
+		cmd.Dir = g.Path
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return newGitError(args, stderr.String(), err)
+	}
+	return nil
+}
+
+// newGitError creates a *GitError for a failed invocation of git,
+// determining its Kind from the messages in stderr.
+func newGitError(args []string, stderr string, err error) *GitError {
+	e := &GitError{
+		Kind:   GitFailedError,
+		Args:   args,
+		Stderr: strings.TrimSpace(stderr),
+		Err:    err,
+	}
+	if _, ok := err.(*os.PathError); ok {
+		// If git could not be started in the directory, then the
+		// directory does not exist.
+		e.Kind = PathNotFoundError
+		return e
+	}
+	for _, k := range gitErrorKinds {
+		if strings.Contains(e.Stderr, k.Fragment) {
+			e.Kind = k.Kind
+			break
+		}
+	}
+	return e
 }
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logRecord produces a commit as git log -z writes it in gitLogFmt.
+func logRecord(fields ...string) string {
+	return strings.Join(fields, "\x00")
+}
+
+func TestLogReader(t *testing.T) {
+	const (
+		sha1   = "1111111111111111111111111111111111111111"
+		sha2   = "2222222222222222222222222222222222222222"
+		tree   = "3333333333333333333333333333333333333333"
+		date   = "2013-07-04T12:00:00+02:00"
+		author = "Luke Evers"
+	)
+	plain := logRecord(sha1, tree, sha2, "1372932000", author,
+		"luke@example.com", date, author, "luke@example.com", date,
+		"", "Subject", "")
+	plainCommit := &Commit{
+		SHA: sha1, Tree: tree, Parents: []string{sha2},
+		Author: author, Email: "luke@example.com", AuthorDate: date,
+		Committer: author, CommitterEmail: "luke@example.com",
+		CommitDate: date, Subject: "Subject",
+	}
+
+	tests := []struct {
+		name     string
+		log      string
+		expected []*Commit
+		err      error
+	}{
+		{"empty", "", nil, nil},
+		{"plain", plain, []*Commit{plainCommit}, nil},
+		{"empty email and subject", logRecord(sha1, tree, "",
+			"1372932000", author, "", date, author, "", date, "N", "",
+			"Body"), []*Commit{{
+			SHA: sha1, Tree: tree, Parents: []string{}, Author: author,
+			AuthorDate: date, Committer: author, CommitDate: date,
+			Signature: signatureNone, Body: "Body",
+		}}, nil},
+		{"everything empty", logRecord(make([]string,
+			gitCommitFields)...), []*Commit{{Parents: []string{}}}, nil},
+		{"separator in body", logRecord(sha1, tree, sha2+" "+sha1,
+			"1372932000", author, "luke@example.com", date, author,
+			"luke@example.com", date, "G", "Merge",
+			"----GROVE-LOG-SEPARATOR----\n\n"+sha2+"\n"), []*Commit{{
+			SHA: sha1, Tree: tree, Parents: []string{sha2, sha1},
+			Author: author, Email: "luke@example.com", AuthorDate: date,
+			Committer: author, CommitterEmail: "luke@example.com",
+			CommitDate: date, Signature: signatureGood, Subject: "Merge",
+			Body: "----GROVE-LOG-SEPARATOR----\n\n" + sha2,
+		}}, nil},
+		{"several", plain + "\x00" + plain,
+			[]*Commit{plainCommit, plainCommit}, nil},
+		{"truncated", plain[:len(plain)-len("\x00Subject\x00")],
+			nil, io.ErrUnexpectedEOF},
+	}
+	for _, test := range tests {
+		lr := newLogReader(strings.NewReader(test.log))
+		var commits []*Commit
+		var err error
+		for {
+			var commit *Commit
+			if commit, err = lr.Next(); err != nil {
+				break
+			}
+			// The relative time changes as the test runs.
+			commit.Time, commit.date = "", time.Time{}
+			commits = append(commits, commit)
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if err != test.err {
+			t.Errorf("%s: got error %v, expected %v",
+				test.name, err, test.err)
+			continue
+		}
+		if test.err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(commits, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v",
+				test.name, commits, test.expected)
+		}
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-log-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each commit is made with the given author email and message.
+	tests := []struct {
+		email, message string
+		subject, body  string
+	}{
+		{"luke@example.com", "Plain", "Plain", ""},
+		{"", "No email", "No email", ""},
+		{"luke@example.com", "", "", ""},
+		{"luke@example.com", "Separator\n\n----GROVE-LOG-SEPARATOR----\n" +
+			"Not a commit", "Separator",
+			"----GROVE-LOG-SEPARATOR----\nNot a commit"},
+		{"", "\n\nBody only", "Body only", ""},
+	}
+	run := func(env []string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), env...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s\n%s", args, err, out)
+		}
+	}
+	run(nil, "init", "-q")
+	for _, test := range tests {
+		run([]string{
+			"GIT_AUTHOR_NAME=Luke Evers",
+			"GIT_AUTHOR_EMAIL=" + test.email,
+			"GIT_COMMITTER_NAME=Alexander Bauer",
+			"GIT_COMMITTER_EMAIL=" + test.email,
+		}, "commit", "-q", "--allow-empty", "--allow-empty-message",
+			"--cleanup=verbatim", "-m", test.message)
+	}
+
+	commits, err := (&git{Path: dir}).Commits("HEAD", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != len(tests) {
+		t.Fatalf("got %d commits, expected %d", len(commits), len(tests))
+	}
+	for n, test := range tests {
+		// The log is newest first.
+		c := commits[len(commits)-1-n]
+		if c.Author != "Luke Evers" || c.Email != test.email ||
+			c.Committer != "Alexander Bauer" ||
+			c.CommitterEmail != test.email ||
+			c.Subject != test.subject || c.Body != test.body {
+			t.Errorf("commit %d: got %+v", n, c)
+		}
+		if (n == 0) != (len(c.Parents) == 0) {
+			t.Errorf("commit %d: got parents %v", n, c.Parents)
+		}
+	}
+}
+
+// prepareRefs prepares a repository as prepareRepository does, and
+// adds a branch, "topic", one commit ahead of master, along with tags
+// of several kinds: "v1" is annotated, "light" is lightweight, and
+// "blobtag" and "treetag" point to a blob and a tree rather than to a
+// commit.
+func prepareRefs(t *testing.T) (g *git) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	for _, args := range [][]string{
+		{"branch", "-m", "master"},
+		{"tag", "-a", "v1", "-m", "Version 1"},
+		{"tag", "light"},
+		{"tag", "blobtag", "HEAD:1Kb.bin"},
+		{"tag", "-a", "treetag", "-m", "A tree", "HEAD^{tree}"},
+		{"checkout", "-q", "-b", "topic"},
+		{"commit", "-q", "--allow-empty", "-m", "Topic"},
+		{"checkout", "-q", "master"},
+	} {
+		if _, err = g.execute(args...); err != nil {
+			removeTempDir()
+			t.Fatalf("Failed to prepare refs: %s", err)
+		}
+	}
+	return g
+}
+
+func TestShow(t *testing.T) {
+	g := prepareRefs(t)
+	defer removeTempDir()
+	master, err := g.Resolve("master")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref, sha string
+		err      error
+	}{
+		{"master", master, nil},
+		{"v1", master, nil},
+		{"light", master, nil},
+		{master[:8], master, nil},
+		{"blobtag", "", RefNotFoundError},
+		{"treetag", "", RefNotFoundError},
+		{"missing", "", RefNotFoundError},
+		{"-p", "", InvalidRefError},
+	}
+	for _, test := range tests {
+		info, err := g.Show(test.ref)
+		if ErrorKind(err) != test.err {
+			t.Errorf("%s: got error %v, expected %v",
+				test.ref, err, test.err)
+		} else if err == nil && (info.SHA != test.sha ||
+			info.Signature != signatureNone ||
+			len(info.Diffs) != 1 || info.Diffs[0].NewPath != "1Kb.bin") {
+			t.Errorf("%s: got %+v, with diffs %+v",
+				test.ref, info.Commit, info.Diffs)
+		}
+	}
+}
+
+// TestSignatureUnchecked checks that signatures, which are not checked
+// for commits in logs, are left out of their encodings, but that those
+// which are known to be missing are not.
+func TestSignatureUnchecked(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+
+	commits, err := g.Commits("HEAD", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := g.Show("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name   string
+		commit *Commit
+		field  string
+	}{
+		{"log", commits[0], ""},
+		{"show", info.Commit, `"Signature":"none"`},
+	} {
+		b, err := json.Marshal(test.commit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(test.field) == 0 && strings.Contains(string(b), "Signature") {
+			t.Errorf("%s: unchecked signature given in %s", test.name, b)
+		} else if !strings.Contains(string(b), test.field) {
+			t.Errorf("%s: expected %s in %s", test.name, test.field, b)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+
+	// Changes on "topic" edit, add, rename, and delete files, and
+	// a change on master after it diverged is not among them.
+	rename := strings.Repeat("A line which is long enough to be found.\n", 10)
+	steps := []struct {
+		files map[string]string // Contents, or blank to remove
+		args  []string
+	}{
+		{map[string]string{"a.txt": "one\ntwo\n", "old.txt": rename},
+			[]string{"commit", "-q", "-m", "Base"}},
+		{nil, []string{"checkout", "-q", "-b", "topic"}},
+		{map[string]string{"a.txt": "one\n2\nthree\n", "added.txt": "new\n",
+			"1Kb.bin": ""}, []string{"mv", "old.txt", "new.txt"}},
+		{nil, []string{"commit", "-q", "-m", "Topic"}},
+		{nil, []string{"checkout", "-q", "-"}},
+		{map[string]string{"master.txt": "later\n"},
+			[]string{"commit", "-q", "-m", "Later"}},
+	}
+	for _, step := range steps {
+		for name, contents := range step.files {
+			if len(contents) == 0 {
+				_, err = g.execute("rm", "-q", name)
+			} else if err = ioutil.WriteFile(g.Path+"/"+name,
+				[]byte(contents), 0644); err == nil {
+				_, err = g.execute("add", name)
+			}
+			if err != nil {
+				t.Fatalf("Failed to change %s: %s", name, err)
+			}
+		}
+		if _, err = g.execute(step.args...); err != nil {
+			t.Fatalf("git %s: %s", step.args, err)
+		}
+	}
+
+	expected := []FileDiff{
+		{OldPath: "1Kb.bin", Binary: true},
+		{OldPath: "a.txt", NewPath: "a.txt", Additions: 2, Deletions: 1,
+			Patch: "@@ -1,2 +1,3 @@\n one\n-two\n+2\n+three\n"},
+		{NewPath: "added.txt", Additions: 1, Patch: "@@ -0,0 +1 @@\n+new\n"},
+		{OldPath: "old.txt", NewPath: "new.txt"},
+	}
+	diffs, err := g.Diff("master", "topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != len(expected) {
+		t.Fatalf("got %d diffs, expected %d", len(diffs), len(expected))
+	}
+	for n, d := range diffs {
+		if *d != expected[n] {
+			t.Errorf("diff %d: got %+v, expected %+v", n, *d, expected[n])
+		}
+	}
+}
+
+func TestParseBlame(t *testing.T) {
+	const (
+		sha1 = "1111111111111111111111111111111111111111"
+		sha2 = "2222222222222222222222222222222222222222"
+	)
+	luke := BlameLine{SHA: sha1, Author: "Luke Evers",
+		Email: "luke@example.com", Time: time.Unix(1372932000, 0)}
+	alexander := BlameLine{SHA: sha2, Author: "Alexander Bauer",
+		Email: "sasha@example.com", Time: time.Unix(1372935600, 0)}
+	line := func(b BlameLine, n int, text string) *BlameLine {
+		b.Line, b.Text = n, text
+		return &b
+	}
+
+	tests := []struct {
+		name     string
+		output   string
+		expected []*BlameLine
+	}{
+		{"empty", "", nil},
+		// Information about a commit is only given the first time
+		// it appears.
+		{"repeated commit", sha1 + " 1 1 2\n" +
+			"author Luke Evers\n" +
+			"author-mail <luke@example.com>\n" +
+			"author-time 1372932000\n" +
+			"author-tz +0200\n" +
+			"summary Initial commit\n" +
+			"filename main.go\n" +
+			"\tpackage main\n" +
+			sha1 + " 2 2\n" +
+			"\t\n" +
+			sha2 + " 1 3 1\n" +
+			"author Alexander Bauer\n" +
+			"author-mail <sasha@example.com>\n" +
+			"author-time 1372935600\n" +
+			"previous " + sha1 + " main.go\n" +
+			"filename main.go\n" +
+			"\tfunc main() {\n" +
+			sha1 + " 3 4 1\n" +
+			"\t}\n", []*BlameLine{
+			line(luke, 1, "package main"),
+			line(luke, 2, ""),
+			line(alexander, 3, "func main() {"),
+			line(luke, 4, "}"),
+		}},
+		{"tab in line", sha1 + " 1 1 1\nauthor Luke Evers\n" +
+			"author-mail <luke@example.com>\nauthor-time 1372932000\n" +
+			"\t\tindented\n", []*BlameLine{line(luke, 1, "\tindented")}},
+	}
+	for _, test := range tests {
+		lines := parseBlame(test.output)
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v",
+				test.name, lines, test.expected)
+		}
+	}
+}
+
+func TestBlame(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+	for _, contents := range []string{"one\ntwo\n", "one\n2\n"} {
+		err = ioutil.WriteFile(g.Path+"/text", []byte(contents), 0644)
+		if err == nil {
+			_, err = g.execute("add", "text")
+		}
+		if err == nil {
+			_, err = g.execute("commit", "-q", "-m", contents)
+		}
+		if err != nil {
+			t.Fatalf("Failed to commit: %s", err)
+		}
+	}
+	head, err := g.Resolve("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := g.Resolve("HEAD^")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref  string
+		shas []string
+		err  error
+	}{
+		{"HEAD", []string{parent, head}, nil},
+		{"HEAD^", []string{parent, parent}, nil},
+		{"HEAD~2", nil, PathNotFoundError}, // Before the file was added
+		{"missing", nil, RefNotFoundError},
+		{"-p", nil, InvalidRefError},
+	}
+	for _, test := range tests {
+		lines, err := g.Blame(test.ref, "text")
+		if ErrorKind(err) != test.err {
+			t.Errorf("%s: got error %v, expected %v",
+				test.ref, err, test.err)
+			continue
+		}
+		var shas []string
+		for n, l := range lines {
+			if l.Line != n+1 {
+				t.Errorf("%s: got line %d at %d", test.ref, l.Line, n+1)
+			}
+			shas = append(shas, l.SHA)
+		}
+		if !reflect.DeepEqual(shas, test.shas) {
+			t.Errorf("%s: got commits %v, expected %v",
+				test.ref, shas, test.shas)
+		}
+	}
+}
+
+func TestCommitsByFile(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+	if err = os.Mkdir(g.Path+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// "a.txt" is renamed to "c.txt", whose history should include
+	// that of "a.txt".
+	long := strings.Repeat("A line which is long enough to be found.\n", 10)
+	steps := []struct {
+		file, contents, subject string
+	}{
+		{"a.txt", long, "Add a"},
+		{"sub/b.txt", "b\n", "Add b"},
+		{"a.txt", long + "More\n", "Edit a"},
+		{"c.txt", "", "Rename a"},
+		{"sub/b.txt", "b\nb\n", "Edit b"},
+	}
+	for _, step := range steps {
+		if len(step.contents) == 0 {
+			_, err = g.execute("mv", "a.txt", step.file)
+		} else if err = ioutil.WriteFile(g.Path+"/"+step.file,
+			[]byte(step.contents), 0644); err == nil {
+			_, err = g.execute("add", step.file)
+		}
+		if err == nil {
+			_, err = g.execute("commit", "-q", "-m", step.subject)
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", step.subject, err)
+		}
+	}
+
+	tests := []struct {
+		ref, file string
+		max       int
+		subjects  []string
+	}{
+		{"HEAD", "c.txt", 0, []string{"Rename a", "Edit a", "Add a"}},
+		{"HEAD", "sub/b.txt", 0, []string{"Edit b", "Add b"}},
+		{"HEAD", "sub/b.txt", 1, []string{"Edit b"}},
+		{"HEAD", "sub", 0, []string{"Edit b", "Add b"}},
+		{"HEAD~2", "a.txt", 0, []string{"Edit a", "Add a"}},
+		{"HEAD", "missing", 0, nil},
+	}
+	for _, test := range tests {
+		commits, err := g.CommitsByFile(test.ref, test.file, test.max)
+		if err != nil {
+			t.Errorf("%s as of %s: %s", test.file, test.ref, err)
+			continue
+		}
+		var subjects []string
+		for _, c := range commits {
+			subjects = append(subjects, c.Subject)
+		}
+		if !reflect.DeepEqual(subjects, test.subjects) {
+			t.Errorf("%s as of %s: got %q, expected %q",
+				test.file, test.ref, subjects, test.subjects)
+		}
+	}
+}
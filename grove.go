@@ -9,6 +9,7 @@ import (
 	_ "log"
 	"os"
 	"path"
+	"time"
 )
 
 var (
@@ -30,10 +31,12 @@ var (
 )
 
 const (
-	usage = "usage: %s [repositorydir]\n"
+	usage = "usage: %s [[name=]repositorydir ...]\n"
 )
 
 var (
+	fConfig = flag.String("config", "", "configuration file to use")
+
 	fQuiet = flag.Bool("q", false, "disable logging output")
 	//	fVerbose = flag.Bool("v", false, "enable verbose output")
 	fDebug = flag.Bool("debug", false, "enable debugging output")
@@ -42,9 +45,21 @@ var (
 	fPort   = flag.String("port", Port, "port to listen on")
 	fRes    = flag.String("res", Resources, "resources directory")
 	fPrefix = flag.String("prefix", Prefix, "prefix to use in links")
+	fPerms  = flag.String("perms", "world", "who must be able to read files for them to be served (world, group, or owner)")
+
+	fWeb     = flag.Bool("web", true, "enable web browsing")
+	fTheme   = flag.String("theme", Theme, "use a particular theme")
+	fBackend = flag.String("backend", backendExec, "read repositories by invoking git (exec) or directly (native)")
+	fCache   = flag.Int("cache", 64, "megabytes of memory to use for caching repository contents (0 to disable)")
+	fRescan  = flag.Duration("rescan", 5*time.Minute, "how often to look for new and removed repositories (0 to disable)")
+
+	fPush        = flag.Bool("push", false, "allow users in the credentials file to push")
+	fCredentials = flag.String("credentials", "", "file of users and bcrypt password hashes for logging in")
 
-	fWeb   = flag.Bool("web", true, "enable web browsing")
-	fTheme = flag.String("theme", Theme, "use a particular theme")
+	fTLSCert       = flag.String("tls-cert", "", "serve HTTPS using this certificate file")
+	fTLSKey        = flag.String("tls-key", "", "private key file for -tls-cert")
+	fTLSSelfSigned = flag.Bool("tls-self-signed", false, "serve HTTPS, generating a self-signed certificate if there is none")
+	fRedirectPort  = flag.String("redirect-port", "", "port on which to redirect HTTP to HTTPS (none if blank)")
 
 	fShowVersion  = flag.Bool("version", false, "print major version and exit")
 	fShowFVersion = flag.Bool("version-full", false, "print full version and exit")
@@ -56,6 +71,14 @@ var (
 func main() {
 	flag.Parse()
 
+	// Load the configuration file, if there is one, and use it to set
+	// any flags which were not given. Errors are reported once logging
+	// is set up.
+	config, configErr := loadConfig(*fConfig)
+	if configErr == nil {
+		configErr = config.applyFlags()
+	}
+
 	// Open a new logger with an appropriate log level.
 	if *fQuiet {
 		LogLevel = -1 // Disable ALL output
@@ -86,26 +109,62 @@ func main() {
 		return
 	}
 
+	if configErr != nil {
+		l.Fatalf("Error loading configuration: %s\n", configErr)
+	}
+
 	l.Infof("Starting Grove version %s\n", Version)
 
-	// Determine the directory to serve.
-	var repodir string
-	if flag.NArg() > 0 {
-		repodir = path.Clean(flag.Arg(0))
+	// Determine which files may be served.
+	var err error
+	if Perms, err = parsePerms(*fPerms); err != nil {
+		l.Fatalf("Error in -perms: %s\n", err)
+	}
 
-		if !path.IsAbs(repodir) {
-			wd, err := os.Getwd()
+	// Determine the directories to serve. If they are not given, use
+	// the roots from the configuration file, or the working
+	// directory.
+	var rs []*Root
+	if flag.NArg() > 0 {
+		for _, arg := range flag.Args() {
+			r, err := parseRoot(arg)
 			if err != nil {
-				l.Fatalf("Error getting working directory: %s\n", err)
+				l.Fatalf("Cannot serve %q: %s\n", arg, err)
 			}
-			repodir = path.Join(wd, repodir)
+			rs = append(rs, r)
 		}
-	} else {
-		wd, err := os.Getwd()
-		if err != nil {
-			l.Fatalf("Error getting working directory: %s\n", err)
+	} else if rs, err = config.getRoots(); err != nil {
+		l.Fatalf("Error loading configuration: %s\n", err)
+	}
+	if err = setRoots(rs); err != nil {
+		l.Fatalf("Cannot serve directories: %s\n", err)
+	}
+	if err = config.applyRepositories(); err != nil {
+		l.Fatalf("Error loading configuration: %s\n", err)
+	}
+
+	// Check to make sure that the backend is one we know of.
+	if *fBackend != backendExec && *fBackend != backendNative {
+		l.Fatalf("Unknown backend %q\n", *fBackend)
+	}
+
+	// Load the credentials of the users who can log in, which are
+	// needed for pushing and for restricted access.
+	if len(*fCredentials) > 0 {
+		if credentials, err = loadCredentials(expandHome(*fCredentials)); err != nil {
+			l.Fatalf("Error loading credentials: %s\n", err)
 		}
-		repodir = wd
+	} else if *fPush {
+		l.Fatalf("Pushing requires a credentials file\n")
+	}
+
+	if len(*fRedirectPort) > 0 && !tlsEnabled() {
+		l.Fatalf("Redirecting to HTTPS requires TLS to be enabled\n")
+	}
+
+	// Set up the cache, unless it is disabled.
+	if *fCache > 0 {
+		objectCache = newLRUCache(*fCache << 20)
 	}
 
 	// Check to make sure that the CSS style is available, and exit if
@@ -118,5 +177,5 @@ func main() {
 		l.Fatalf("Theme %q could not be loaded: is a directory\n", *fTheme)
 	}
 
-	Serve(repodir)
+	Serve()
 }
@@ -18,8 +18,15 @@ if [ -z $GROVE ]; then
 	GROVE=$(which grove)
 fi
 
-# Attempt to locate the directory from which to serve files if not set
-if [ -z "$SRC" ]; then
+# Pass along the configuration file, if set
+if [ ! -z "$CONFIG" ]; then
+	OPTIONS="$OPTIONS -config $CONFIG"
+fi
+
+# Attempt to locate the directory from which to serve files if not set,
+# unless a configuration file may set it instead
+if [ -z "$SRC" ] && [ -z "$CONFIG" ] && [ ! -e ~/.config/grove/config.json ] \
+	&& [ ! -e /etc/grove/config.json ]; then
 	if [ -e ~/dev ]; then
 		SRC=~/dev
 	elif [ -e ~/src ]; then
@@ -45,7 +52,8 @@ PID=$(pgrep -u "$(whoami)" -f -d " " $GROVE)
 
 start()
 {
-	if [ -z "$SRC" ]; then
+	if [ -z "$SRC" ] && [ -z "$CONFIG" ] && [ ! -e ~/.config/grove/config.json ] \
+		&& [ ! -e /etc/grove/config.json ]; then
 		echo "Could not determine the directory to serve"
 		return 1
 	fi
@@ -59,7 +67,7 @@ start()
 	fi
 
 	$GROVE $OPTIONS $SRC >> $LOG &
-	echo "Started $GROVE serving $SRC"
+	echo "Started $GROVE serving ${SRC:-the configured directory}"
 	return 0
 }
 
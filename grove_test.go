@@ -2,6 +2,7 @@ package main
 
 import (
 	"crypto/rand"
+	"github.com/inhies/go-utils/log"
 	"html/template"
 	"io/ioutil"
 	"net/http"
@@ -12,6 +13,12 @@ import (
 
 var tempDir string
 
+func init() {
+	// Tests do not run main, which creates the logger, so create one
+	// here which discards everything.
+	l, _ = log.NewLevel(-1, false, ioutil.Discard, "", 0)
+}
+
 type LogResponseWriter struct {
 	Logf func(string, ...interface{})
 
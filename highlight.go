@@ -0,0 +1,624 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// language describes enough of the syntax of a programming language
+// to highlight its comments, strings, keywords, and numbers.
+type language struct {
+	LineComments   []string        // Markers which begin comments
+	BlockComment   [2]string       // Markers around block comments
+	SpacedComments bool            // Line comments must follow a space
+	Quotes         string          // Characters around strings
+	Multiline      string          // Those of Quotes which can span lines
+	TripleQuotes   bool            // Strings can be in """ or '''
+	Keywords       map[string]bool // Reserved words
+	FoldCase       bool            // Keywords are given in lower case, but match any case
+}
+
+// words produces a set of the space-separated words in s.
+func words(s string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		set[w] = true
+	}
+	return set
+}
+
+const (
+	cKeywords = "auto break case char const continue default do " +
+		"double else enum extern float for goto if inline int long " +
+		"register restrict return short signed sizeof static struct " +
+		"switch typedef union unsigned void volatile while NULL"
+	cppKeywords = cKeywords + " bool catch class const_cast delete " +
+		"dynamic_cast explicit false friend mutable namespace new " +
+		"nullptr operator private protected public reinterpret_cast " +
+		"static_cast template this throw true try typeid typename " +
+		"using virtual"
+	jsKeywords = "break case catch class const continue debugger " +
+		"default delete do else export extends finally for function " +
+		"if import in instanceof let new return super switch this " +
+		"throw try typeof var void while with yield true false null " +
+		"undefined"
+)
+
+// languages are those which can be highlighted, by name.
+var languages = map[string]*language{
+	"go": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'`",
+		Multiline:    "`",
+		Keywords: words("break case chan const continue default " +
+			"defer else fallthrough for func go goto if import " +
+			"interface map package range return select struct switch " +
+			"type var nil true false iota"),
+	},
+	"c": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		Keywords:     words(cKeywords),
+	},
+	"cpp": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		Keywords:     words(cppKeywords),
+	},
+	"java": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		Keywords: words("abstract assert boolean break byte case " +
+			"catch char class const continue default do double else " +
+			"enum extends final finally float for goto if implements " +
+			"import instanceof int interface long native new package " +
+			"private protected public return short static super " +
+			"switch synchronized this throw throws transient try void " +
+			"volatile while true false null"),
+	},
+	"javascript": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'`",
+		Multiline:    "`",
+		Keywords:     words(jsKeywords),
+	},
+	"typescript": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'`",
+		Multiline:    "`",
+		Keywords: words(jsKeywords + " abstract any as async await " +
+			"boolean declare enum implements interface keyof module " +
+			"namespace never number private protected public readonly " +
+			"string type unknown"),
+	},
+	"python": {
+		LineComments: []string{"#"},
+		Quotes:       "\"'",
+		TripleQuotes: true,
+		Keywords: words("and as assert break class continue def del " +
+			"elif else except exec finally for from global if import " +
+			"in is lambda nonlocal not or pass print raise return try " +
+			"while with yield True False None"),
+	},
+	"ruby": {
+		LineComments: []string{"#"},
+		Quotes:       "\"'",
+		Keywords: words("alias and begin break case class def defined? " +
+			"do else elsif end ensure false for if in module next nil " +
+			"not or redo rescue retry return self super then true undef " +
+			"unless until when while yield"),
+	},
+	"sh": {
+		LineComments:   []string{"#"},
+		SpacedComments: true,
+		Quotes:         "\"'",
+		Multiline:      "\"'",
+		Keywords: words("case do done elif else esac exit export fi " +
+			"for function if in local return select then until while"),
+	},
+	"perl": {
+		LineComments:   []string{"#"},
+		SpacedComments: true,
+		Quotes:         "\"'",
+		Keywords: words("do else elsif for foreach if last local my " +
+			"next our package redo require return sub unless until use " +
+			"while"),
+	},
+	"rust": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"",
+		Multiline:    "\"",
+		Keywords: words("as break const continue crate else enum extern " +
+			"false fn for if impl in let loop match mod move mut pub ref " +
+			"return self Self static struct super trait true type unsafe " +
+			"use where while"),
+	},
+	"csharp": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		Keywords: words("abstract as base bool break byte case catch " +
+			"char checked class const continue decimal default delegate " +
+			"do double else enum event explicit extern false finally " +
+			"fixed float for foreach goto if implicit in int interface " +
+			"internal is lock long namespace new null object operator " +
+			"out override params private protected public readonly ref " +
+			"return sbyte sealed short sizeof static string struct " +
+			"switch this throw true try typeof uint ulong unsafe ushort " +
+			"using var virtual void volatile while"),
+	},
+	"kotlin": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		TripleQuotes: true,
+		Keywords: words("as break class continue do else false for fun " +
+			"if import in interface is null object override package " +
+			"private protected public return super this throw true try " +
+			"typealias val var when while"),
+	},
+	"scala": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		TripleQuotes: true,
+		Keywords: words("abstract case catch class def do else extends " +
+			"false final finally for forSome if implicit import lazy " +
+			"match new null object override package private protected " +
+			"return sealed super this throw trait true try type val var " +
+			"while with yield"),
+	},
+	"swift": {
+		LineComments: []string{"//"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"",
+		TripleQuotes: true,
+		Keywords: words("as break case catch class continue default " +
+			"defer do else enum extension fallthrough false for func " +
+			"guard if import in init inout internal is let nil " +
+			"operator private protocol public repeat return self Self " +
+			"static struct subscript super switch throw throws true try " +
+			"var where while"),
+	},
+	"php": {
+		LineComments: []string{"//", "#"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		Multiline:    "\"'",
+		Keywords: words("abstract and array as break case catch class " +
+			"clone const continue declare default do echo else elseif " +
+			"empty enddeclare endfor endforeach endif endswitch endwhile " +
+			"extends false final finally for foreach function global " +
+			"if implements include include_once instanceof interface " +
+			"isset list namespace new null or print private protected " +
+			"public require require_once return static switch throw " +
+			"trait true try unset use var while xor"),
+	},
+	"haskell": {
+		LineComments: []string{"--"},
+		BlockComment: [2]string{"{-", "-}"},
+		// Single quotes also mark names, as in "x'", so only double
+		// quotes are taken to begin strings.
+		Quotes: "\"",
+		Keywords: words("case class data default deriving do else " +
+			"family forall foreign if import in infix infixl infixr " +
+			"instance let module newtype of qualified then type where"),
+	},
+	"sql": {
+		LineComments: []string{"--"},
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "'\"",
+		Multiline:    "'",
+		Keywords: words("add all alter and as asc begin between by case " +
+			"check column commit constraint create default delete desc " +
+			"distinct drop else end exists foreign from group having if " +
+			"in index inner insert into is join key left like limit not " +
+			"null on or order outer primary references rollback select " +
+			"set table then union unique update values view when where"),
+		FoldCase: true,
+	},
+	"lisp": {
+		LineComments: []string{";"},
+		BlockComment: [2]string{"#|", "|#"},
+		Quotes:       "\"",
+		Multiline:    "\"",
+		Keywords: words("and case cond define defmacro defn defun do " +
+			"if lambda let loop nil not or quote setq t unless when"),
+	},
+	"css": {
+		BlockComment: [2]string{"/*", "*/"},
+		Quotes:       "\"'",
+		Keywords:     words("important inherit initial none auto"),
+	},
+	"yaml": {
+		LineComments:   []string{"#"},
+		SpacedComments: true,
+		Quotes:         "\"'",
+		Keywords:       words("true false null yes no on off"),
+	},
+	"ini": {
+		LineComments: []string{"#", ";"},
+		Quotes:       "\"",
+		Keywords:     words("true false"),
+	},
+	"make": {
+		LineComments: []string{"#"},
+		Keywords: words("define else endef endif export ifdef ifeq " +
+			"ifndef ifneq include override unexport vpath"),
+	},
+	"lua": {
+		LineComments: []string{"--"},
+		BlockComment: [2]string{"--[[", "]]"},
+		Quotes:       "\"'",
+		Keywords: words("and break do else elseif end false for " +
+			"function goto if in local nil not or repeat return then " +
+			"true until while"),
+	},
+}
+
+// languageAliases maps other names for languages, as used in file
+// extensions, interpreters, and modelines, to those in languages.
+var languageAliases = map[string]string{
+	"h": "c", "cc": "cpp", "cxx": "cpp", "hpp": "cpp", "hh": "cpp",
+	"c++": "cpp", "js": "javascript", "mjs": "javascript",
+	"node": "javascript", "nodejs": "javascript", "py": "python",
+	"rb": "ruby", "bash": "sh", "zsh": "sh", "dash": "sh", "ksh": "sh",
+	"shell-script": "sh", "pl": "perl", "pm": "perl", "cperl": "perl",
+	"rs": "rust", "ts": "typescript", "tsx": "typescript",
+	"cs": "csharp", "kt": "kotlin", "kts": "kotlin", "sc": "scala",
+	"hs": "haskell", "lhs": "haskell", "el": "lisp",
+	"emacs-lisp": "lisp", "cl": "lisp", "scm": "lisp", "ss": "lisp",
+	"scheme": "lisp", "clj": "lisp", "clojure": "lisp", "scss": "css",
+	"yml": "yaml", "toml": "ini", "cfg": "ini", "conf": "ini",
+	"gitconfig": "ini", "mk": "make", "makefile": "make",
+	"gnumakefile": "make",
+}
+
+// lookupLanguage finds the language with the given name or alias, or
+// returns nil if there is none.
+func lookupLanguage(name string) *language {
+	name = strings.ToLower(name)
+	if alias, ok := languageAliases[name]; ok {
+		name = alias
+	}
+	return languages[name]
+}
+
+// detectLanguage determines the language of a file from, in order, a
+// vim or Emacs modeline, the interpreter named by a shebang line, and
+// the extension of its name, or the whole name if it has none. If it cannot be determined, it returns
+// nil.
+func detectLanguage(file string, contents []byte) *language {
+	lines := strings.SplitN(string(contents), "\n", 2)
+	if name := modeline(string(contents)); len(name) > 0 {
+		if lang := lookupLanguage(name); lang != nil {
+			return lang
+		}
+	}
+	if strings.HasPrefix(lines[0], "#!") {
+		// The interpreter is either the program itself, or the
+		// argument to env, as in "#!/usr/bin/env python3".
+		fields := strings.Fields(lines[0][2:])
+		if len(fields) > 1 && path.Base(fields[0]) == "env" {
+			fields = fields[1:]
+		}
+		if len(fields) > 0 {
+			name := strings.TrimRight(path.Base(fields[0]), "0123456789.")
+			if lang := lookupLanguage(name); lang != nil {
+				return lang
+			}
+		}
+	}
+	if ext := path.Ext(file); len(ext) > 0 {
+		return lookupLanguage(ext[1:])
+	}
+	// Some files are known by their whole names, such as "Makefile".
+	return lookupLanguage(path.Base(file))
+}
+
+// modeline finds the language named by a vim modeline in the first or
+// last five lines of the contents, such as "vim: set ft=python:", or
+// an Emacs modeline in the first two, such as "-*- mode: ruby -*-".
+// If there is none, it returns a blank string.
+func modeline(contents string) string {
+	lines := strings.Split(contents, "\n")
+	for n, line := range lines {
+		if n >= 5 && n < len(lines)-5 {
+			continue
+		}
+		if n < 2 {
+			if name := emacsMode(line); len(name) > 0 {
+				return name
+			}
+		}
+		for _, marker := range []string{"vim:", "vi:", "ex:"} {
+			idx := strings.Index(line, marker)
+			if idx < 0 {
+				continue
+			}
+			for _, opt := range strings.FieldsFunc(line[idx+len(marker):],
+				func(r rune) bool { return r == ' ' || r == ':' || r == '\t' }) {
+				parts := strings.SplitN(opt, "=", 2)
+				if len(parts) == 2 && (parts[0] == "ft" ||
+					parts[0] == "filetype" || parts[0] == "syntax") {
+					return parts[1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// emacsMode finds the mode named by an Emacs modeline in the line,
+// which is either alone, as in "-*- python -*-", or given as one of
+// several variables, as in "-*- mode: python; coding: utf-8 -*-".
+func emacsMode(line string) string {
+	start := strings.Index(line, "-*-")
+	if start < 0 {
+		return ""
+	}
+	end := strings.Index(line[start+3:], "-*-")
+	if end < 0 {
+		return ""
+	}
+	vars := strings.TrimSpace(line[start+3 : start+3+end])
+	if !strings.Contains(vars, ":") {
+		return strings.TrimSuffix(vars, "-mode")
+	}
+	for _, v := range strings.Split(vars, ";") {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) == 2 && strings.TrimSpace(parts[0]) == "mode" {
+			return strings.TrimSuffix(strings.TrimSpace(parts[1]), "-mode")
+		}
+	}
+	return ""
+}
+
+// token is a piece of source code, along with the class which it is
+// highlighted with, if any.
+type token struct {
+	Class string
+	Text  string
+}
+
+// Classes given to tokens, which the themes style.
+const (
+	classComment = "comment"
+	classString  = "string"
+	classKeyword = "keyword"
+	classNumber  = "constant numeric"
+)
+
+// tokenize splits the source code into tokens of the given language.
+// Text which is not highlighted is gathered into tokens without a
+// class.
+func tokenize(src string, lang *language) (tokens []token) {
+	plain := 0 // Start of the text not yet in a token
+	emit := func(start, end int, class string) {
+		if start > plain {
+			tokens = append(tokens, token{Text: src[plain:start]})
+		}
+		tokens = append(tokens, token{Class: class, Text: src[start:end]})
+		plain = end
+	}
+	// until finds the end of the text beginning at i which is closed
+	// by the marker, or the end of the source if it is not closed.
+	until := func(i int, marker string) int {
+		if end := strings.Index(src[i:], marker); end >= 0 {
+			return i + end + len(marker)
+		}
+		return len(src)
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		rest := src[i:]
+		switch {
+		case len(lang.BlockComment[0]) > 0 &&
+			strings.HasPrefix(rest, lang.BlockComment[0]):
+			end := until(i+len(lang.BlockComment[0]), lang.BlockComment[1])
+			emit(i, end, classComment)
+			i = end
+		case lang.isLineComment(src, i):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			emit(i, i+end, classComment)
+			i += end
+		case lang.TripleQuotes && (strings.HasPrefix(rest, `"""`) ||
+			strings.HasPrefix(rest, "'''")):
+			end := until(i+3, rest[:3])
+			emit(i, end, classString)
+			i = end
+		case strings.IndexByte(lang.Quotes, c) >= 0:
+			end := scanString(src, i, strings.IndexByte(lang.Multiline, c) >= 0)
+			emit(i, end, classString)
+			i = end
+		case isIdentStart(c):
+			end := i + 1
+			for end < len(src) && (isIdentStart(src[end]) ||
+				isDigit(src[end])) {
+				end++
+			}
+			word := src[i:end]
+			if lang.FoldCase {
+				word = strings.ToLower(word)
+			}
+			if lang.Keywords[word] {
+				emit(i, end, classKeyword)
+			}
+			i = end
+		case isDigit(c):
+			end := i + 1
+			for end < len(src) && (isIdentStart(src[end]) ||
+				isDigit(src[end]) || src[end] == '.') {
+				end++
+			}
+			emit(i, end, classNumber)
+			i = end
+		default:
+			i++
+		}
+	}
+	if plain < len(src) {
+		tokens = append(tokens, token{Text: src[plain:]})
+	}
+	return
+}
+
+// isLineComment returns true if a line comment of the language begins
+// at position i of src.
+func (lang *language) isLineComment(src string, i int) bool {
+	if lang.SpacedComments && i > 0 && src[i-1] != ' ' &&
+		src[i-1] != '\t' && src[i-1] != '\n' {
+		return false
+	}
+	for _, marker := range lang.LineComments {
+		if strings.HasPrefix(src[i:], marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanString finds the end of the string beginning with the quote at
+// position i of src, skipping escaped characters. Unless multiline is
+// true, the string also ends at the end of the line.
+func scanString(src string, i int, multiline bool) int {
+	quote := src[i]
+	for i++; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1
+		case '\n':
+			if !multiline {
+				return i
+			}
+		}
+	}
+	return len(src)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// highlight renders source code as HTML, with each line numbered and
+// given the anchor "L<n>", so that it can be linked to. If lang is not
+// nil, its tokens are wrapped in spans with classes that the themes
+// style.
+func highlight(src string, lang *language) template.HTML {
+	// Files usually end with a newline, which does not begin another
+	// line.
+	src = strings.TrimSuffix(src, "\n")
+	tokens := []token{{Text: src}}
+	if lang != nil {
+		tokens = tokenize(src, lang)
+	}
+
+	var buf bytes.Buffer
+	n := 0
+	startLine := func() {
+		n++
+		num := strconv.Itoa(n)
+		buf.WriteString(`<span class="line" id="L` + num + `">` +
+			`<a class="line-number" href="#L` + num + `" data-line="` +
+			num + `"></a>`)
+	}
+	buf.WriteString(`<pre class="code">`)
+	startLine()
+	for _, tok := range tokens {
+		for k, segment := range strings.Split(tok.Text, "\n") {
+			if k > 0 {
+				buf.WriteString("\n</span>")
+				startLine()
+			}
+			if len(segment) == 0 {
+				continue
+			}
+			if len(tok.Class) == 0 {
+				buf.WriteString(html.EscapeString(segment))
+				continue
+			}
+			buf.WriteString(`<span class="` + tok.Class + `">` +
+				html.EscapeString(segment) + "</span>")
+		}
+	}
+	buf.WriteString("</span></pre>")
+	return template.HTML(buf.String())
+}
+
+// highlightTokens writes source code as HTML to buf, with its tokens
+// in the given language wrapped in spans as highlight does, but
+// without numbering its lines.
+func highlightTokens(buf *bytes.Buffer, src string, lang *language) {
+	for _, tok := range tokenize(src, lang) {
+		if len(tok.Class) == 0 {
+			buf.WriteString(html.EscapeString(tok.Text))
+			continue
+		}
+		buf.WriteString(`<span class="` + tok.Class + `">` +
+			html.EscapeString(tok.Text) + "</span>")
+	}
+}
+
+// rainbowAliases maps file extensions to the names by which rainbow.js
+// knows the languages which it highlights in the browser. Others are
+// given as they are, and rainbow.js applies only its generic patterns.
+var rainbowAliases = map[string]string{
+	"htm": "html", "xhtml": "html", "coffee": "coffeescript",
+	"st": "smalltalk",
+}
+
+// rainbowLanguage determines the name of the language of a file for
+// rainbow.js from its extension.
+func rainbowLanguage(file string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(file), "."))
+	if name, ok := rainbowAliases[ext]; ok {
+		return name
+	}
+	if len(ext) == 0 {
+		return "generic"
+	}
+	return ext
+}
+
+// numberLines renders source code in a language which is not among
+// languages, so that rainbow.js can highlight it in the browser. The
+// code is left in a single code element, as rainbow.js expects, and
+// the line numbers, with the same anchors that highlight gives, are
+// placed beside it.
+func numberLines(src, name string) template.HTML {
+	src = strings.TrimSuffix(src, "\n")
+	var buf bytes.Buffer
+	buf.WriteString(`<div class="code numbered"><pre class="gutter">`)
+	for n := 1; n <= strings.Count(src, "\n")+1; n++ {
+		num := strconv.Itoa(n)
+		buf.WriteString(`<a class="line-number" id="L` + num +
+			`" href="#L` + num + `" data-line="` + num + `"></a>` + "\n")
+	}
+	buf.WriteString(`</pre><pre><code data-language="` +
+		html.EscapeString(name) + `">` + html.EscapeString(src) +
+		"</code></pre></div>")
+	return template.HTML(buf.String())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		file, contents, expected string
+	}{
+		{"main.go", "package main\n", "go"},
+		{"lib.H", "", "c"},
+		{"build", "#!/bin/sh\nmake\n", "sh"},
+		{"run", "#!/usr/bin/env python3\n", "python"},
+		{"conf", "# -*- mode: ruby; coding: utf-8 -*-\n", "ruby"},
+		{"x.txt", "int x;\n\n// vim: set ft=c:\n", "c"},
+		{"README", "Hello\n", ""},
+		{"app.ts", "", "typescript"},
+		{"Program.cs", "", "csharp"},
+		{"schema.SQL", "", "sql"},
+		{"Main.hs", "", "haskell"},
+		{"init.el", "", "lisp"},
+		{".travis.yml", "", "yaml"},
+		{"Cargo.toml", "", "ini"},
+		{"Makefile", "", "make"},
+		{"src/GNUmakefile", "", "make"},
+		{"index.html", "", ""},
+	}
+	for _, test := range tests {
+		lang := detectLanguage(test.file, []byte(test.contents))
+		if lang != languages[test.expected] {
+			t.Errorf("%s: expected %q", test.file, test.expected)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	src := "// Say \"hi\"\nfunc f() string {\n\treturn \"<hi>\" + `a\nb` /* 42 */\n}\n"
+	expected := []string{
+		`<span class="line" id="L1"><a class="line-number" href="#L1" data-line="1"></a><span class="comment">// Say &#34;hi&#34;</span>`,
+		`<span class="keyword">func</span> f() string {`,
+		`<span class="keyword">return</span> <span class="string">&#34;&lt;hi&gt;&#34;</span> + <span class="string">` + "`a</span>",
+		`<a class="line-number" href="#L4" data-line="4"></a><span class="string">b` + "`</span>",
+		`<span class="comment">/* 42 */</span>`,
+	}
+	h := string(highlight(src, languages["go"]))
+	for _, e := range expected {
+		if !strings.Contains(h, e) {
+			t.Errorf("Expected %q in:\n%s", e, h)
+		}
+	}
+	if strings.Contains(h, `id="L6"`) {
+		t.Errorf("Trailing newline began another line:\n%s", h)
+	}
+}
+
+func TestHighlightLanguages(t *testing.T) {
+	tests := []struct {
+		lang, src string
+		expected  []string
+	}{
+		// SQL keywords are matched in any case.
+		{"sql", "SELECT 'it''s' from t -- Note\n", []string{
+			`<span class="keyword">SELECT</span>`,
+			`<span class="keyword">from</span> t`,
+			`<span class="comment">-- Note</span>`,
+		}},
+		// A prime does not begin a string.
+		{"haskell", "f x' = \"s\" {- c -}\n", []string{
+			`f x&#39; = <span class="string">&#34;s&#34;</span>`,
+			`<span class="comment">{- c -}</span>`,
+		}},
+		{"yaml", "key: \"a#b\" # c\nx: true\n", []string{
+			`<span class="string">&#34;a#b&#34;</span> <span class="comment"># c</span>`,
+			`<span class="keyword">true</span>`,
+		}},
+		{"typescript", "let n: number = 1\n", []string{
+			`<span class="keyword">let</span> n: <span class="keyword">number</span>`,
+		}},
+	}
+	for _, test := range tests {
+		h := string(highlight(test.src, languages[test.lang]))
+		for _, e := range test.expected {
+			if !strings.Contains(h, e) {
+				t.Errorf("%s: expected %q in:\n%s", test.lang, e, h)
+			}
+		}
+	}
+}
+
+func TestNumberLines(t *testing.T) {
+	h := string(numberLines("<p>\n</p>\n", rainbowLanguage("index.HTM")))
+	expected := []string{
+		`<a class="line-number" id="L2" href="#L2" data-line="2"></a>`,
+		`<code data-language="html">&lt;p&gt;` + "\n" + `&lt;/p&gt;</code>`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(h, e) {
+			t.Errorf("Expected %q in:\n%s", e, h)
+		}
+	}
+	if strings.Contains(h, `id="L3"`) {
+		t.Errorf("Trailing newline began another line:\n%s", h)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"sort"
+	"strings"
+)
+
+// Orders in which the repository index can be sorted, as given in the
+// sort field of the form.
+const (
+	sortActivity = "activity" // Most recently committed to first
+	sortName     = "name"     // Alphabetically by path
+)
+
+// RepoSummary describes a repository in the index of a directory.
+type RepoSummary struct {
+	Name        string  // Path relative to the directory
+	Path        string  // URL path, with a trailing slash
+	Description string  // From the configuration or .git/description
+	Branch      string  // Currently checked out branch
+	Branches    int     // Number of branches
+	LastCommit  *Commit `json:",omitempty"` // Most recent commit, if any
+}
+
+// foundRepo is a repository found within one of the roots.
+type foundRepo struct {
+	Dir  string // Top level of the repository
+	Path string // URL path, with a trailing slash
+}
+
+// findRepositories finds every repository which the user may see
+// within the given directory, or if it is blank, within each of the
+// given roots.
+func findRepositories(rs []*Root, directory, remoteUser string) (repos []*foundRepo) {
+	for _, root := range rs {
+		dir := directory
+		if len(dir) == 0 {
+			dir = root.Dir
+		}
+		for _, repository := range root.Repositories(dir, remoteUser) {
+			repos = append(repos, &foundRepo{
+				Dir:  repository,
+				Path: root.URLPath() + repository[len(root.Dir):] + "/",
+			})
+		}
+	}
+	return
+}
+
+// summarize gathers the metadata of the repository whose top level is
+// dir, leaving its Name and Path blank. Parts which cannot be read,
+// such as the log of a repository without commits, are left out.
+func summarize(dir string) (s *RepoSummary) {
+	s = &RepoSummary{Description: description(dir)}
+	g := openRepository(dir)
+	var err error
+	if s.Branch, err = g.Branch("HEAD"); err != nil {
+		l.Debugf("Could not read branch of %q: %s\n", dir, err)
+	}
+	if branches, err := g.Branches(); err == nil {
+		s.Branches = len(branches)
+	}
+	commits, err := g.Commits(getRepoConfig(dir).Ref(), 1)
+	if err == nil && len(commits) > 0 {
+		s.LastCommit = commits[0]
+	}
+	return s
+}
+
+// description determines the description of the repository whose top
+// level is dir, from its settings or otherwise .git/description.
+func description(dir string) string {
+	if d := getRepoConfig(dir).Description; len(d) > 0 {
+		return d
+	}
+	return readDescription(dir)
+}
+
+// indexRepositories summarizes every repository which the user may see
+// within the given directory, or if it is blank, within each of the
+// given roots, and sorts them in the given order. The URL path of the
+// directory is given as dirPath.
+func indexRepositories(rs []*Root, directory, dirPath, remoteUser, order string) (index []*RepoSummary) {
+	for _, repo := range findRepositories(rs, directory, remoteUser) {
+		s, ok := registry.Summary(repo.Dir)
+		if !ok {
+			s = summarize(repo.Dir)
+		}
+		s.Name = strings.Trim(strings.TrimPrefix(repo.Path, dirPath), "/")
+		s.Path = repo.Path
+		index = append(index, s)
+	}
+	if order == sortName {
+		sort.Sort(summariesByName(index))
+	} else {
+		sort.Stable(summariesByActivity(index))
+	}
+	return
+}
+
+// summariesByName implements sort.Interface.
+type summariesByName []*RepoSummary
+
+func (ss summariesByName) Len() int           { return len(ss) }
+func (ss summariesByName) Less(i, j int) bool { return ss[i].Name < ss[j].Name }
+func (ss summariesByName) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+
+// summariesByActivity implements sort.Interface, sorting the most
+// recently committed to first, and those without commits last.
+type summariesByActivity []*RepoSummary
+
+func (ss summariesByActivity) Len() int      { return len(ss) }
+func (ss summariesByActivity) Swap(i, j int) { ss[i], ss[j] = ss[j], ss[i] }
+func (ss summariesByActivity) Less(i, j int) bool {
+	a, b := ss[i].LastCommit, ss[j].LastCommit
+	if a == nil || b == nil {
+		return b == nil && a != nil
+	}
+	return a.date.After(b.date)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestIndexRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-index-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Each repository is given a commit at the given time, unless it
+	// is blank.
+	repos := []struct {
+		name, date string
+	}{
+		{"old", "2013-01-01T12:00:00Z"},
+		{"new", "2013-07-04T12:00:00Z"},
+		{"group/mid", "2013-03-01T12:00:00Z"},
+		{"empty", ""},
+		{"b-empty", ""},
+	}
+	for _, repo := range repos {
+		p := path.Join(dir, repo.name)
+		if err = os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		commands := [][]string{{"init", "-q"}}
+		if len(repo.date) > 0 {
+			commands = append(commands, []string{"commit", "-q",
+				"--allow-empty", "-m", repo.name})
+		}
+		for _, args := range commands {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = p
+			cmd.Env = append(os.Environ(), "GIT_AUTHOR_DATE="+repo.date,
+				"GIT_COMMITTER_DATE="+repo.date)
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("git %s: %s\n%s", args, err, out)
+			}
+		}
+	}
+	rs := []*Root{{Dir: dir}}
+	registry.Scan(rs)
+
+	tests := []struct {
+		order    string
+		expected []string
+	}{
+		// Repositories without commits come last, in order of name.
+		{sortActivity, []string{"new", "group/mid", "old", "b-empty",
+			"empty"}},
+		{"", []string{"new", "group/mid", "old", "b-empty", "empty"}},
+		{sortName, []string{"b-empty", "empty", "group/mid", "new",
+			"old"}},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, s := range indexRepositories(rs, "", "/", "", test.order) {
+			names = append(names, s.Name)
+			if s.Path != "/"+s.Name+"/" {
+				t.Errorf("%s: got path %q", s.Name, s.Path)
+			}
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("%q: got %q, expected %q",
+				test.order, names, test.expected)
+		}
+	}
+
+	// The index of a directory names repositories relative to it.
+	index := indexRepositories(rs, path.Join(dir, "group"), "/group/",
+		"", sortName)
+	if len(index) != 1 || index[0].Name != "mid" ||
+		index[0].LastCommit == nil || index[0].LastCommit.Subject != "group/mid" {
+		t.Errorf("got %+v for the index of group", index)
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nativeRepo implements Repository by reading refs and objects
+// directly from the repository, rather than invoking git. It embeds
+// *git, so anything it does not implement itself, (such as diffs and
+// blame,) or any revision syntax it does not understand, is handled by
+// invoking git instead.
+type nativeRepo struct {
+	*git
+
+	gitDir    string // Directory holding HEAD, usually .git
+	commonDir string // Directory holding refs and objects
+	objects   *objectStore
+
+	packedRefs     map[string]objectID // Loaded on first use
+	packedRefsInfo os.FileInfo         // Used to notice changes
+}
+
+var (
+	// notNativeError is returned internally when a revision must be
+	// handled by git instead.
+	notNativeError = errors.New("native: unsupported revision")
+)
+
+// refSearchPath is the list of places in which a short ref name is
+// searched for, in order, as described in gitrevisions(7).
+var refSearchPath = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// openNativeRepo prepares a nativeRepo for the repository whose top
+// level is g.Path. It returns an error if the repository uses any
+// features which are not supported, such as alternates or SHA-256
+// object names.
+func openNativeRepo(g *git) (r *nativeRepo, err error) {
+	r = &nativeRepo{git: g}
+	r.gitDir, r.commonDir, err = gitDirs(g.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := ioutil.ReadFile(path.Join(r.commonDir, "config"))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Contains(bytes.ToLower(config), []byte("objectformat")) {
+		return nil, errors.New("native: unsupported object format")
+	}
+	objects := path.Join(r.commonDir, "objects")
+	if _, err := os.Stat(path.Join(objects, "info", "alternates")); err == nil {
+		return nil, errors.New("native: alternates are not supported")
+	}
+	r.objects = getObjectStore(objects)
+	return r, nil
+}
+
+// Branch returns the name of the current branch if ref is "HEAD",
+// and "HEAD" if it is detached. Other refs are handled by git.
+func (r *nativeRepo) Branch(ref string) (branch string, err error) {
+	if ref != "HEAD" {
+		return r.git.Branch(ref)
+	}
+	target, err := r.readRefFile(r.gitDir, "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(target, "ref: ") {
+		return "HEAD", nil
+	}
+	target = strings.TrimSpace(target[5:])
+	if !strings.HasPrefix(target, "refs/heads/") {
+		return r.git.Branch(ref)
+	}
+	if _, err := r.resolve("HEAD"); err != nil {
+		// The branch has no commits yet.
+		return "", err
+	}
+	return strings.TrimPrefix(target, "refs/heads/"), nil
+}
+
+// Branches lists the names of all local branches.
+func (r *nativeRepo) Branches() (branches []string, err error) {
+	return r.listRefs("refs/heads/")
+}
+
+// Tags lists the names of all tags.
+func (r *nativeRepo) Tags() (tags []string, err error) {
+	return r.listRefs("refs/tags/")
+}
+
+// SHA retrieves the short form (8 characters) of the given reference.
+func (r *nativeRepo) SHA(ref string) (sha string, err error) {
+	id, err := r.resolve(ref)
+	if err == notNativeError {
+		return r.git.SHA(ref)
+	} else if err != nil {
+		return "", err
+	}
+	return id.String()[:8], nil
+}
+
+// Resolve retrieves the full SHA of the commit named by the given
+// reference.
+func (r *nativeRepo) Resolve(ref string) (sha string, err error) {
+	id, err := r.resolve(ref)
+	if err == notNativeError {
+		return r.git.Resolve(ref)
+	} else if err != nil {
+		return "", err
+	}
+	c, err := r.peelCommit(id)
+	if err != nil {
+		return "", err
+	}
+	return c.ID.String(), nil
+}
+
+// RefExists returns true if the given ref names a commit.
+func (r *nativeRepo) RefExists(ref string) (exists bool) {
+	id, err := r.resolve(ref)
+	if err == notNativeError {
+		return r.git.RefExists(ref)
+	} else if err != nil {
+		return false
+	}
+	_, err = r.peelCommit(id)
+	return err == nil
+}
+
+// TotalCommits counts the commits reachable from any ref or HEAD, in
+// the same way as `git rev-list --all`.
+func (r *nativeRepo) TotalCommits() (commits int, err error) {
+	names, err := r.listRefs("refs/")
+	if err != nil {
+		return 0, err
+	}
+	var tips []objectID
+	for _, name := range append(names, "HEAD") {
+		if name != "HEAD" {
+			name = "refs/" + name
+		}
+		id, ok, err := r.readRef(name)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if c, err := r.peelCommit(id); err == nil {
+			tips = append(tips, c.ID)
+		}
+	}
+
+	seen := make(map[objectID]bool)
+	for len(tips) > 0 {
+		id := tips[len(tips)-1]
+		tips = tips[:len(tips)-1]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		c, err := r.readCommit(id)
+		if err != nil {
+			return 0, err
+		}
+		tips = append(tips, c.Parents...)
+	}
+	return len(seen), nil
+}
+
+// IsDir determines whether the given path is a file or directory as
+// of the given ref.
+func (r *nativeRepo) IsDir(ref, file string) (isDir bool, err error) {
+	id, err := r.resolve(ref)
+	if err == notNativeError {
+		return r.git.IsDir(ref, file)
+	} else if err != nil {
+		return false, err
+	}
+	t, _, err := r.lookup(id, file)
+	return t == objTree, err
+}
+
+// GetFile retrieves the contents of a file as of the given commit.
+// For directories, it produces the same listing as `git show`.
+func (r *nativeRepo) GetFile(commit, file string) (contents []byte, err error) {
+	id, err := r.resolve(commit)
+	if err == notNativeError {
+		return r.git.GetFile(commit, file)
+	} else if err != nil {
+		return nil, err
+	}
+	t, data, err := r.lookup(id, file)
+	if err != nil || t != objTree {
+		return data, err
+	}
+
+	names, err := treeNames(data)
+	if err != nil {
+		return nil, err
+	}
+	listing := "tree " + commit + ":" + file + "\n\n" +
+		strings.Join(names, "\n") + "\n"
+	return []byte(listing), nil
+}
+
+// GetDir lists the names in a directory as of the given commit, with
+// a trailing "/" for subdirectories.
+func (r *nativeRepo) GetDir(commit, dir string) (files []string, err error) {
+	id, err := r.resolve(commit)
+	if err == notNativeError {
+		return r.git.GetDir(commit, dir)
+	} else if err != nil {
+		return nil, err
+	}
+	t, data, err := r.lookup(id, dir)
+	if err != nil || t != objTree {
+		return nil, err
+	}
+	return treeNames(data)
+}
+
+// Tree lists the entries of a directory as of the given commit, in the
+// same form as git ls-tree. Reading the size of each file requires
+// reading the file itself.
+func (r *nativeRepo) Tree(commit, dir string) (entries []*TreeEntry, err error) {
+	id, err := r.resolve(commit)
+	if err == notNativeError {
+		return r.git.Tree(commit, dir)
+	} else if err != nil {
+		return nil, err
+	}
+	t, data, err := r.lookup(id, dir)
+	if err != nil {
+		return nil, err
+	}
+	if t != objTree {
+		return nil, PathNotFoundError
+	}
+	tree, err := parseTree(data)
+	if err != nil {
+		return nil, err
+	}
+	entries = make([]*TreeEntry, len(tree))
+	for n, e := range tree {
+		entry := &TreeEntry{
+			Name: e.Name,
+			Mode: e.Mode,
+			Type: "blob",
+			SHA:  e.ID.String(),
+		}
+		switch {
+		case e.IsDir():
+			// Trees store the mode without a leading zero.
+			entry.Type, entry.Mode = "tree", "0"+e.Mode
+		case e.IsSubmodule():
+			entry.Type = "commit"
+		default:
+			// Only the size is needed, so the blob is not read.
+			_, size, err := r.objects.Stat(e.ID)
+			if err != nil {
+				return nil, err
+			}
+			entry.Size = int64(size)
+		}
+		entries[n] = entry
+	}
+	return entries, nil
+}
+
+// Commits walks the history from the given ref, most recently
+// committed first, and returns up to max commits. Ranges are handled
+// by git.
+func (r *nativeRepo) Commits(ref string, max int) (commits []*Commit, err error) {
+	id, err := r.resolve(ref)
+	if err == notNativeError {
+		return r.git.Commits(ref, max)
+	} else if err != nil {
+		return nil, err
+	}
+	start, err := r.peelCommit(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk the history in order of commit time, as git log does by
+	// default.
+	queue := &commitQueue{}
+	seen := map[objectID]bool{start.ID: true}
+	heap.Push(queue, start)
+	for queue.Len() > 0 && (max <= 0 || len(commits) < max) {
+		c := heap.Pop(queue).(*commitObject)
+		commits = append(commits, c.toCommit())
+		for _, parent := range c.Parents {
+			if seen[parent] {
+				continue
+			}
+			seen[parent] = true
+			p, err := r.readCommit(parent)
+			if err != nil {
+				return nil, err
+			}
+			heap.Push(queue, p)
+		}
+	}
+	return commits, nil
+}
+
+// toCommit converts a parsed commit object to a Commit. The status of
+// its signature, if it has one, is left blank.
+func (c *commitObject) toCommit() *Commit {
+	parents := make([]string, len(c.Parents))
+	for n, p := range c.Parents {
+		parents[n] = p.String()
+	}
+	return &Commit{
+		SHA:            c.ID.String(),
+		Tree:           c.Tree.String(),
+		Parents:        parents,
+		Author:         c.Author.Name,
+		Email:          c.Author.Email,
+		AuthorDate:     c.Author.Time.Format(time.RFC3339),
+		Committer:      c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+		CommitDate:     c.Committer.Time.Format(time.RFC3339),
+		Time:           relativeTime(c.Committer.Time),
+		Subject:        c.Subject(),
+		Body:           c.Body(),
+		date:           c.Committer.Time,
+	}
+}
+
+// commitQueue is a priority queue of commits, ordered by commit time
+// with the most recent first, and otherwise in the order they were
+// added. It implements heap.Interface.
+type commitQueue struct {
+	commits []*commitObject
+	order   []int
+	next    int
+}
+
+func (q *commitQueue) Len() int { return len(q.commits) }
+
+func (q *commitQueue) Less(i, j int) bool {
+	ti, tj := q.commits[i].Committer.Time, q.commits[j].Committer.Time
+	if ti.Equal(tj) {
+		return q.order[i] < q.order[j]
+	}
+	return ti.After(tj)
+}
+
+func (q *commitQueue) Swap(i, j int) {
+	q.commits[i], q.commits[j] = q.commits[j], q.commits[i]
+	q.order[i], q.order[j] = q.order[j], q.order[i]
+}
+
+func (q *commitQueue) Push(x interface{}) {
+	q.commits = append(q.commits, x.(*commitObject))
+	q.order = append(q.order, q.next)
+	q.next++
+}
+
+func (q *commitQueue) Pop() interface{} {
+	n := len(q.commits) - 1
+	c := q.commits[n]
+	q.commits, q.order = q.commits[:n], q.order[:n]
+	return c
+}
+
+// resolve finds the object named by a revision. It understands ref
+// names, full and abbreviated SHAs, and any number of "^", "^<n>",
+// and "~<n>" suffixes. For anything else, it returns notNativeError.
+func (r *nativeRepo) resolve(rev string) (id objectID, err error) {
+	if len(rev) == 0 || strings.HasPrefix(rev, "-") {
+		return id, InvalidRefError
+	}
+	if strings.ContainsAny(rev, ":@{} \\") || strings.Contains(rev, "..") {
+		return id, notNativeError
+	}
+
+	base, suffix := rev, ""
+	if idx := strings.IndexAny(rev, "^~"); idx > -1 {
+		base, suffix = rev[:idx], rev[idx:]
+	}
+	if id, err = r.resolveName(base); err != nil {
+		return
+	}
+
+	for len(suffix) > 0 {
+		op := suffix[0]
+		digits := 1
+		for digits < len(suffix) && suffix[digits] >= '0' && suffix[digits] <= '9' {
+			digits++
+		}
+		n := 1
+		if digits > 1 {
+			n, _ = strconv.Atoi(suffix[1:digits])
+		}
+		suffix = suffix[digits:]
+
+		c, err := r.peelCommit(id)
+		if err != nil {
+			return id, err
+		}
+		switch {
+		case op == '^' && n == 0:
+			id = c.ID
+		case op == '^':
+			if n > len(c.Parents) {
+				return id, RefNotFoundError
+			}
+			id = c.Parents[n-1]
+		case op == '~':
+			for ; n > 0; n-- {
+				if len(c.Parents) == 0 {
+					return id, RefNotFoundError
+				}
+				if c, err = r.readCommit(c.Parents[0]); err != nil {
+					return id, err
+				}
+			}
+			id = c.ID
+		}
+	}
+	return id, nil
+}
+
+// resolveName finds the object named by a full SHA, ref name, or
+// abbreviated SHA, in that order of precedence.
+func (r *nativeRepo) resolveName(name string) (id objectID, err error) {
+	if id, ok := parseObjectID(name); ok {
+		if !r.objects.Has(id) {
+			return id, RefNotFoundError
+		}
+		return id, nil
+	}
+
+	if validRefName(name) {
+		for _, pattern := range refSearchPath {
+			id, ok, err := r.readRef(strings.Replace(pattern, "%s", name, 1))
+			if err != nil {
+				return id, err
+			}
+			if ok {
+				return id, nil
+			}
+		}
+	}
+
+	id, err = r.objects.Expand(name)
+	switch err {
+	case nil:
+		return id, nil
+	case objectNotFoundError:
+		return id, RefNotFoundError
+	case ambiguousIDError:
+		// Let git explain the ambiguity.
+		return id, notNativeError
+	}
+	return id, err
+}
+
+// validRefName returns false for names which could not be refs, and
+// especially those which could escape the repository directory.
+func validRefName(name string) bool {
+	if len(name) == 0 || strings.HasPrefix(name, "/") ||
+		strings.HasSuffix(name, "/") || strings.Contains(name, "//") ||
+		strings.HasSuffix(name, ".lock") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return false
+		}
+	}
+	for _, c := range name {
+		if c < ' ' || c == 0x7f || strings.ContainsRune("~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// readRef reads the object named by the given full ref, such as
+// "HEAD" or "refs/heads/master", following symbolic refs. If the ref
+// does not exist, ok is false.
+func (r *nativeRepo) readRef(name string) (id objectID, ok bool, err error) {
+	// Follow a limited number of symbolic refs, to avoid loops.
+	for depth := 0; depth < 5; depth++ {
+		if !strings.HasPrefix(name, "refs/") && !isPseudoRef(name) {
+			return id, false, nil
+		}
+		dir := r.commonDir
+		if isPseudoRef(name) {
+			dir = r.gitDir
+		}
+		content, err := r.readRefFile(dir, name)
+		if os.IsNotExist(err) {
+			id, ok, err = r.readPackedRef(name)
+			return id, ok, err
+		} else if err != nil {
+			// Directories, such as "refs/heads", are not refs.
+			return id, false, nil
+		}
+
+		if strings.HasPrefix(content, "ref: ") {
+			name = strings.TrimSpace(content[5:])
+			continue
+		}
+		if len(content) < 40 {
+			return id, false, nil
+		}
+		id, ok = parseObjectID(content[:40])
+		return id, ok, nil
+	}
+	return id, false, nil
+}
+
+// isPseudoRef returns true for refs such as "HEAD" and "FETCH_HEAD",
+// which are stored directly in the git directory.
+func isPseudoRef(name string) bool {
+	if !strings.HasSuffix(name, "HEAD") {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// readRefFile reads the contents of a loose ref.
+func (r *nativeRepo) readRefFile(dir, name string) (content string, err error) {
+	fi, err := os.Stat(path.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		return "", errors.New("native: ref is a directory")
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, name))
+	return string(data), err
+}
+
+// readPackedRef looks up a ref in the packed-refs file.
+func (r *nativeRepo) readPackedRef(name string) (id objectID, ok bool, err error) {
+	if err = r.loadPackedRefs(); err != nil {
+		return
+	}
+	id, ok = r.packedRefs[name]
+	return
+}
+
+// loadPackedRefs parses the packed-refs file, which consists of lines
+// of the form "<sha> <ref>", with comments beginning with "#" and
+// peeled tags beginning with "^". It does nothing if the file has not
+// changed since it was last loaded.
+func (r *nativeRepo) loadPackedRefs() error {
+	name := path.Join(r.commonDir, "packed-refs")
+	fi, err := os.Stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if r.packedRefs != nil && (fi == nil) == (r.packedRefsInfo == nil) &&
+		(fi == nil || (fi.ModTime().Equal(r.packedRefsInfo.ModTime()) &&
+			fi.Size() == r.packedRefsInfo.Size())) {
+		return nil
+	}
+
+	r.packedRefs = make(map[string]objectID)
+	r.packedRefsInfo = fi
+	if fi == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) < 42 || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		if id, ok := parseObjectID(line[:40]); ok {
+			r.packedRefs[strings.TrimSpace(line[41:])] = id
+		}
+	}
+	return nil
+}
+
+// listRefs lists the names of all refs beginning with the given
+// prefix, both loose and packed, with the prefix removed, sorted by
+// name.
+func (r *nativeRepo) listRefs(prefix string) (names []string, err error) {
+	found := make(map[string]bool)
+	if err = r.loadPackedRefs(); err != nil {
+		return nil, err
+	}
+	for name := range r.packedRefs {
+		if strings.HasPrefix(name, prefix) {
+			found[name[len(prefix):]] = true
+		}
+	}
+
+	root := path.Join(r.commonDir, prefix)
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.HasSuffix(p, ".lock") {
+			return nil
+		}
+		name, err := filepath.Rel(root, p)
+		if err == nil {
+			found[filepath.ToSlash(name)] = true
+		}
+		return nil
+	})
+
+	names = make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readCommit reads and parses a commit object.
+func (r *nativeRepo) readCommit(id objectID) (c *commitObject, err error) {
+	t, data, err := r.objects.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	if t != objCommit {
+		return nil, RefNotFoundError
+	}
+	return parseCommit(id, data)
+}
+
+// peelCommit follows any tags starting at the given object until it
+// reaches a commit, and returns it.
+func (r *nativeRepo) peelCommit(id objectID) (c *commitObject, err error) {
+	for depth := 0; depth < 10; depth++ {
+		t, data, err := r.objects.Read(id)
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case objCommit:
+			return parseCommit(id, data)
+		case objTag:
+			tag, err := parseTag(data)
+			if err != nil {
+				return nil, err
+			}
+			id = tag.Object
+		default:
+			return nil, RefNotFoundError
+		}
+	}
+	return nil, RefNotFoundError
+}
+
+// lookup finds the object at the given path, as of the given commit,
+// tag, or tree. If the path is blank, it is the tree itself.
+func (r *nativeRepo) lookup(id objectID, file string) (t objectType, data []byte, err error) {
+	// Find the tree of the commit.
+	c, err := r.peelCommit(id)
+	if err == nil {
+		t, data, err = r.objects.Read(c.Tree)
+	} else if err == RefNotFoundError {
+		// It may be a tree rather than a commit.
+		t, data, err = r.objects.Read(id)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if t != objTree {
+		return 0, nil, RefNotFoundError
+	}
+
+	// Then walk down the path.
+	for _, name := range strings.Split(file, "/") {
+		if len(name) == 0 {
+			continue
+		}
+		if t != objTree {
+			return 0, nil, PathNotFoundError
+		}
+		entries, err := parseTree(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		var entry *treeEntry
+		for _, e := range entries {
+			if e.Name == name {
+				entry = e
+				break
+			}
+		}
+		if entry == nil || entry.IsSubmodule() {
+			return 0, nil, PathNotFoundError
+		}
+		if t, data, err = r.objects.Read(entry.ID); err != nil {
+			return 0, nil, err
+		}
+	}
+	return t, data, nil
+}
+
+// treeNames lists the names of the entries in a tree, with a trailing
+// "/" for subtrees.
+func treeNames(data []byte) (names []string, err error) {
+	entries, err := parseTree(data)
+	if err != nil {
+		return nil, err
+	}
+	names = make([]string, len(entries))
+	for n, e := range entries {
+		names[n] = e.Name
+		if e.IsDir() {
+			names[n] += "/"
+		}
+	}
+	return names, nil
+}
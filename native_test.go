@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestNativeMatchesExec checks that the native backend gives the same
+// results as invoking git, both for loose objects and once they have
+// been packed.
+func TestNativeMatchesExec(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+
+	r, err := openNativeRepo(g)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %s", err)
+	}
+
+	for _, packed := range []bool{false, true} {
+		if packed {
+			if _, err = g.execute("gc", "-q"); err != nil {
+				t.Fatalf("Failed to pack repository: %s", err)
+			}
+		}
+		compare := func(name string, call func(Repository) (interface{}, error)) {
+			expected, expectedErr := call(g)
+			actual, actualErr := call(r)
+			if ErrorKind(expectedErr) != ErrorKind(actualErr) {
+				t.Errorf("%s (packed: %t): expected error %v, got %v",
+					name, packed, expectedErr, actualErr)
+			} else if !reflect.DeepEqual(expected, actual) {
+				t.Errorf("%s (packed: %t): expected %+v, got %+v",
+					name, packed, expected, actual)
+			}
+		}
+
+		compare("Branch", func(g Repository) (interface{}, error) {
+			return g.Branch("HEAD")
+		})
+		compare("SHA", func(g Repository) (interface{}, error) {
+			return g.SHA("HEAD")
+		})
+		compare("TotalCommits", func(g Repository) (interface{}, error) {
+			return g.TotalCommits()
+		})
+		compare("Commits", func(g Repository) (interface{}, error) {
+			commits, err := g.Commits("HEAD", 10)
+			values := make([]Commit, len(commits))
+			for n, c := range commits {
+				values[n] = *c
+				values[n].date = c.date.UTC()
+			}
+			return values, err
+		})
+		compare("GetFile", func(g Repository) (interface{}, error) {
+			return g.GetFile("HEAD", "1Kb.bin")
+		})
+		compare("GetDir", func(g Repository) (interface{}, error) {
+			return g.GetDir("HEAD", "")
+		})
+		compare("Tree", func(g Repository) (interface{}, error) {
+			entries, err := g.Tree("HEAD", "")
+			values := make([]TreeEntry, len(entries))
+			for n, e := range entries {
+				values[n] = *e
+			}
+			return values, err
+		})
+		compare("IsDir", func(g Repository) (interface{}, error) {
+			return g.IsDir("HEAD", "missing")
+		})
+	}
+}
@@ -0,0 +1,921 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// objectID is the binary form of a SHA-1 object name.
+type objectID [20]byte
+
+// objectType is the type of an object in the object database, as
+// numbered in packfiles.
+type objectType int
+
+const (
+	objCommit   objectType = 1
+	objTree     objectType = 2
+	objBlob     objectType = 3
+	objTag      objectType = 4
+	objOfsDelta objectType = 6
+	objRefDelta objectType = 7
+)
+
+var objectTypeNames = map[string]objectType{
+	"commit": objCommit,
+	"tree":   objTree,
+	"blob":   objBlob,
+	"tag":    objTag,
+}
+
+// maxDeltaDepth is the longest chain of deltas which will be resolved
+// to read an object. It matches the limit which git places on the
+// chains it creates, so longer ones, and cycles, are treated as
+// corruption.
+const maxDeltaDepth = 50
+
+var (
+	objectNotFoundError = errors.New("object: not found")
+	corruptObjectError  = errors.New("object: corrupt object")
+	ambiguousIDError    = errors.New("object: ambiguous short SHA")
+)
+
+// parseObjectID parses a full hexadecimal object name.
+func parseObjectID(s string) (id objectID, ok bool) {
+	if len(s) != 2*len(id) {
+		return id, false
+	}
+	_, err := hex.Decode(id[:], []byte(s))
+	return id, err == nil
+}
+
+func (id objectID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// objectStore reads objects directly from the object database of a
+// repository, both from loose objects and from packfiles. It is safe
+// for concurrent use.
+type objectStore struct {
+	Dir string // Path to the objects directory
+
+	mu    sync.Mutex
+	packs map[string]*packFile // Open packfiles by path
+}
+
+// objectStores holds one objectStore per objects directory, so that
+// packfile indexes are only read once.
+var (
+	objectStores   = make(map[string]*objectStore)
+	objectStoresMu sync.Mutex
+)
+
+// getObjectStore retrieves the shared objectStore for the given
+// objects directory, creating it if necessary.
+func getObjectStore(dir string) *objectStore {
+	objectStoresMu.Lock()
+	defer objectStoresMu.Unlock()
+	s, ok := objectStores[dir]
+	if !ok {
+		s = &objectStore{Dir: dir}
+		objectStores[dir] = s
+	}
+	return s
+}
+
+// Read retrieves the type and contents of an object, resolving any
+// deltas.
+func (s *objectStore) Read(id objectID) (t objectType, data []byte, err error) {
+	return s.read(id, 0)
+}
+
+// read is the same as Read, but the object is the base of a chain of
+// deltas which is already depth long.
+func (s *objectStore) read(id objectID, depth int) (t objectType, data []byte, err error) {
+	t, data, err = s.readLoose(id)
+	if err != objectNotFoundError {
+		return
+	}
+	p, offset, err := s.findPacked(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return p.ReadAt(offset, s, depth)
+}
+
+// Stat retrieves the type and size of an object, without reading its
+// contents. Only the headers of the object, and of any deltas, are
+// decompressed.
+func (s *objectStore) Stat(id objectID) (t objectType, size uint64, err error) {
+	return s.stat(id, 0)
+}
+
+// stat is the same as Stat, but the object is the base of a chain of
+// deltas which is already depth long.
+func (s *objectStore) stat(id objectID, depth int) (t objectType, size uint64, err error) {
+	t, size, err = s.statLoose(id)
+	if err != objectNotFoundError {
+		return
+	}
+	p, offset, err := s.findPacked(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.StatAt(offset, s, depth)
+}
+
+// findPacked finds the packfile containing an object, and its offset
+// within it.
+func (s *objectStore) findPacked(id objectID) (p *packFile, offset uint64, err error) {
+	// If it can't be found, the packs may have changed since they
+	// were loaded, so try again after reloading them.
+	for _, reload := range []bool{false, true} {
+		packs, err := s.getPacks(reload)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, p := range packs {
+			if offset, ok := p.Find(id); ok {
+				return p, offset, nil
+			}
+		}
+	}
+	return nil, 0, objectNotFoundError
+}
+
+// Has returns true if the object exists, without reading it.
+func (s *objectStore) Has(id objectID) bool {
+	hexID := id.String()
+	if _, err := os.Stat(path.Join(s.Dir, hexID[:2], hexID[2:])); err == nil {
+		return true
+	}
+	for _, reload := range []bool{false, true} {
+		packs, err := s.getPacks(reload)
+		if err != nil {
+			return false
+		}
+		for _, p := range packs {
+			if _, ok := p.Find(id); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Expand finds the full object name beginning with the given
+// hexadecimal prefix. If more than one object matches, it returns
+// ambiguousIDError.
+func (s *objectStore) Expand(prefix string) (id objectID, err error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 4 || len(prefix) > 40 {
+		return id, objectNotFoundError
+	}
+	if _, err := hex.DecodeString(prefix[:len(prefix)&^1]); err != nil {
+		return id, objectNotFoundError
+	}
+
+	var found []objectID
+	add := func(candidate objectID) {
+		for _, f := range found {
+			if f == candidate {
+				return
+			}
+		}
+		found = append(found, candidate)
+	}
+
+	// Check the loose objects first.
+	names, _ := readDirNames(path.Join(s.Dir, prefix[:2]))
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix[2:]) {
+			if candidate, ok := parseObjectID(prefix[:2] + name); ok {
+				add(candidate)
+			}
+		}
+	}
+
+	packs, err := s.getPacks(false)
+	if err != nil {
+		return id, err
+	}
+	for _, p := range packs {
+		for _, candidate := range p.FindPrefix(prefix) {
+			add(candidate)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return id, objectNotFoundError
+	case 1:
+		return found[0], nil
+	}
+	return id, ambiguousIDError
+}
+
+// readLoose reads a zlib-compressed loose object, which begins with a
+// header of the form "<type> <size>\0".
+func (s *objectStore) readLoose(id objectID) (t objectType, data []byte, err error) {
+	hexID := id.String()
+	f, err := os.Open(path.Join(s.Dir, hexID[:2], hexID[2:]))
+	if err != nil {
+		return 0, nil, objectNotFoundError
+	}
+	defer f.Close()
+
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, nil, corruptObjectError
+	}
+	defer z.Close()
+	raw, err := ioutil.ReadAll(z)
+	if err != nil {
+		return 0, nil, corruptObjectError
+	}
+
+	idx := bytes.IndexByte(raw, 0)
+	if idx < 0 {
+		return 0, nil, corruptObjectError
+	}
+	header := strings.SplitN(string(raw[:idx]), " ", 2)
+	t, ok := objectTypeNames[header[0]]
+	if !ok || len(header) != 2 {
+		return 0, nil, corruptObjectError
+	}
+	return t, raw[idx+1:], nil
+}
+
+// statLoose reads only the header of a loose object, which gives its
+// type and size.
+func (s *objectStore) statLoose(id objectID) (t objectType, size uint64, err error) {
+	hexID := id.String()
+	f, err := os.Open(path.Join(s.Dir, hexID[:2], hexID[2:]))
+	if err != nil {
+		return 0, 0, objectNotFoundError
+	}
+	defer f.Close()
+
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return 0, 0, corruptObjectError
+	}
+	defer z.Close()
+	// The header is short, so it must fit in the buffer.
+	raw, err := bufio.NewReader(z).ReadSlice(0)
+	if err != nil {
+		return 0, 0, corruptObjectError
+	}
+	header := strings.SplitN(string(raw[:len(raw)-1]), " ", 2)
+	t, ok := objectTypeNames[header[0]]
+	if !ok || len(header) != 2 {
+		return 0, 0, corruptObjectError
+	}
+	if size, err = strconv.ParseUint(header[1], 10, 64); err != nil {
+		return 0, 0, corruptObjectError
+	}
+	return t, size, nil
+}
+
+// getPacks returns the open packfiles, loading any new ones if reload
+// is true or they have never been loaded.
+func (s *objectStore) getPacks(reload bool) (packs []*packFile, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.packs == nil || reload {
+		names, err := readDirNames(path.Join(s.Dir, "pack"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		current := make(map[string]*packFile)
+		for _, name := range names {
+			if !strings.HasSuffix(name, ".idx") {
+				continue
+			}
+			base := path.Join(s.Dir, "pack", strings.TrimSuffix(name, ".idx"))
+			if p, ok := s.packs[base]; ok {
+				current[base] = p
+				continue
+			}
+			p, err := openPackFile(base)
+			if err != nil {
+				// The pack may be in the middle of being written, so
+				// skip it for now.
+				continue
+			}
+			current[base] = p
+		}
+		// Close any packs which have since been removed.
+		for base, p := range s.packs {
+			if _, ok := current[base]; !ok {
+				p.Close()
+			}
+		}
+		s.packs = current
+	}
+
+	packs = make([]*packFile, 0, len(s.packs))
+	for _, p := range s.packs {
+		packs = append(packs, p)
+	}
+	return packs, nil
+}
+
+// packFile is a packfile and the contents of its index.
+type packFile struct {
+	file    *os.File
+	names   []byte   // Sorted object names, 20 bytes each
+	offsets []uint64 // Offsets of the objects in the pack
+}
+
+// openPackFile opens the packfile and index with the given path,
+// excluding the ".pack" and ".idx" extensions. It supports both
+// version 1 and 2 indexes.
+func openPackFile(base string) (p *packFile, err error) {
+	idx, err := ioutil.ReadFile(base + ".idx")
+	if err != nil {
+		return nil, err
+	}
+
+	p = &packFile{}
+	var fanout []byte
+	if bytes.HasPrefix(idx, []byte("\377tOc")) {
+		// Version 2 begins with a magic number and the version,
+		// followed by the fanout table.
+		if len(idx) < 8+256*4 || binary.BigEndian.Uint32(idx[4:]) != 2 {
+			return nil, corruptObjectError
+		}
+		fanout = idx[8 : 8+256*4]
+		n := int(binary.BigEndian.Uint32(fanout[255*4:]))
+
+		// The names are followed by a table of CRCs, then a table of
+		// 4-byte offsets, then a table of 8-byte offsets for those
+		// which are too large.
+		namesStart := 8 + 256*4
+		offsetsStart := namesStart + n*20 + n*4
+		largeStart := offsetsStart + n*4
+		if len(idx) < largeStart {
+			return nil, corruptObjectError
+		}
+		p.names = idx[namesStart : namesStart+n*20]
+		p.offsets = make([]uint64, n)
+		for i := range p.offsets {
+			o := binary.BigEndian.Uint32(idx[offsetsStart+i*4:])
+			if o&0x80000000 == 0 {
+				p.offsets[i] = uint64(o)
+				continue
+			}
+			large := largeStart + int(o&0x7fffffff)*8
+			if len(idx) < large+8 {
+				return nil, corruptObjectError
+			}
+			p.offsets[i] = binary.BigEndian.Uint64(idx[large:])
+		}
+	} else {
+		// Version 1 is the fanout table, followed by entries of a
+		// 4-byte offset and a name.
+		if len(idx) < 256*4 {
+			return nil, corruptObjectError
+		}
+		fanout = idx[:256*4]
+		n := int(binary.BigEndian.Uint32(fanout[255*4:]))
+		if len(idx) < 256*4+n*24 {
+			return nil, corruptObjectError
+		}
+		p.names = make([]byte, n*20)
+		p.offsets = make([]uint64, n)
+		for i := 0; i < n; i++ {
+			entry := idx[256*4+i*24:]
+			p.offsets[i] = uint64(binary.BigEndian.Uint32(entry))
+			copy(p.names[i*20:], entry[4:24])
+		}
+	}
+
+	p.file, err = os.Open(base + ".pack")
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Close closes the underlying packfile.
+func (p *packFile) Close() error {
+	return p.file.Close()
+}
+
+// count returns the number of objects in the pack.
+func (p *packFile) count() int {
+	return len(p.offsets)
+}
+
+// name returns the object name of the nth object in the index.
+func (p *packFile) name(n int) (id objectID) {
+	copy(id[:], p.names[n*20:])
+	return
+}
+
+// Find locates the object with the given name in the pack, and
+// returns its offset.
+func (p *packFile) Find(id objectID) (offset uint64, ok bool) {
+	n := sort.Search(p.count(), func(i int) bool {
+		return bytes.Compare(p.names[i*20:i*20+20], id[:]) >= 0
+	})
+	if n < p.count() && p.name(n) == id {
+		return p.offsets[n], true
+	}
+	return 0, false
+}
+
+// FindPrefix returns the names of all objects in the pack which begin
+// with the given hexadecimal prefix.
+func (p *packFile) FindPrefix(prefix string) (ids []objectID) {
+	// Search for the first name which could match, by padding the
+	// prefix with zeroes.
+	var low objectID
+	hex.Decode(low[:], []byte((prefix + strings.Repeat("0", 40))[:40]))
+	n := sort.Search(p.count(), func(i int) bool {
+		return bytes.Compare(p.names[i*20:i*20+20], low[:]) >= 0
+	})
+	for ; n < p.count(); n++ {
+		id := p.name(n)
+		if !strings.HasPrefix(id.String(), prefix) {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return
+}
+
+// packEntry is the header of an entry in a packfile.
+type packEntry struct {
+	Type       objectType
+	Size       uint64   // Size of the object, or of the delta
+	BaseOffset uint64   // Offset of the base of an OFS_DELTA
+	BaseID     objectID // Name of the base of a REF_DELTA
+}
+
+// readEntry reads the header of the entry at the given offset, and
+// returns a reader positioned at its compressed data.
+func (p *packFile) readEntry(offset uint64) (e *packEntry, r *bufio.Reader, err error) {
+	r = bufio.NewReader(io.NewSectionReader(p.file, int64(offset), 1<<62))
+
+	// The entry begins with the type and size, encoded in a
+	// variable-length integer.
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, nil, corruptObjectError
+	}
+	e = &packEntry{
+		Type: objectType((c >> 4) & 7),
+		Size: uint64(c & 0x0f),
+	}
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return nil, nil, corruptObjectError
+		}
+		e.Size |= uint64(c&0x7f) << shift
+	}
+
+	switch e.Type {
+	case objOfsDelta:
+		// The base is given by its negative offset from this entry.
+		c, err = r.ReadByte()
+		if err != nil {
+			return nil, nil, corruptObjectError
+		}
+		rel := uint64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return nil, nil, corruptObjectError
+			}
+			rel = ((rel + 1) << 7) | uint64(c&0x7f)
+		}
+		if rel == 0 || rel > offset {
+			return nil, nil, corruptObjectError
+		}
+		e.BaseOffset = offset - rel
+	case objRefDelta:
+		// The base is given by its name.
+		if _, err = io.ReadFull(r, e.BaseID[:]); err != nil {
+			return nil, nil, corruptObjectError
+		}
+	}
+	return e, r, nil
+}
+
+// ReadAt reads the object at the given offset in the pack, resolving
+// deltas. Bases referenced by name are looked up in s. The depth is the
+// length of the chain of deltas of which the object is the base, and
+// if it exceeds maxDeltaDepth, the object is considered corrupt.
+func (p *packFile) ReadAt(offset uint64, s *objectStore, depth int) (t objectType, data []byte, err error) {
+	if depth > maxDeltaDepth {
+		return 0, nil, corruptObjectError
+	}
+	e, r, err := p.readEntry(offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	t, size := e.Type, e.Size
+
+	var baseType objectType
+	var base []byte
+	switch t {
+	case objOfsDelta:
+		baseType, base, err = p.ReadAt(e.BaseOffset, s, depth+1)
+	case objRefDelta:
+		baseType, base, err = s.read(e.BaseID, depth+1)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return 0, nil, corruptObjectError
+	}
+	defer z.Close()
+	// The size is not trusted to be reasonable until that much has
+	// actually been read.
+	if size >= math.MaxInt64 {
+		return 0, nil, corruptObjectError
+	}
+	var buf bytes.Buffer
+	_, err = buf.ReadFrom(io.LimitReader(z, int64(size)+1))
+	if err != nil || uint64(buf.Len()) != size {
+		return 0, nil, corruptObjectError
+	}
+	data = buf.Bytes()
+
+	if base != nil {
+		data, err = applyDelta(base, data)
+		return baseType, data, err
+	}
+	return t, data, nil
+}
+
+// StatAt reads the type and size of the object at the given offset in
+// the pack, as ReadAt would produce it. The size of a delta's result is
+// read from the start of the delta, and its type from its base.
+func (p *packFile) StatAt(offset uint64, s *objectStore, depth int) (t objectType, size uint64, err error) {
+	if depth > maxDeltaDepth {
+		return 0, 0, corruptObjectError
+	}
+	e, r, err := p.readEntry(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch e.Type {
+	case objOfsDelta:
+		t, _, err = p.StatAt(e.BaseOffset, s, depth+1)
+	case objRefDelta:
+		t, _, err = s.stat(e.BaseID, depth+1)
+	default:
+		return e.Type, e.Size, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The delta begins with the sizes of its base and of its result.
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return 0, 0, corruptObjectError
+	}
+	defer z.Close()
+	dr := bufio.NewReader(z)
+	for n := 0; n < 2; n++ {
+		size = 0
+		for shift := uint(0); ; shift += 7 {
+			c, err := dr.ReadByte()
+			if err != nil || shift > 63 {
+				return 0, 0, corruptObjectError
+			}
+			size |= uint64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				break
+			}
+		}
+	}
+	return t, size, nil
+}
+
+// applyDelta reconstructs an object from its base and a delta, which
+// consists of the sizes of the base and result, followed by
+// instructions to either copy from the base or insert new data.
+func applyDelta(base, delta []byte) (result []byte, err error) {
+	readSize := func() (size uint64) {
+		for shift := uint(0); len(delta) > 0; shift += 7 {
+			c := delta[0]
+			delta = delta[1:]
+			size |= uint64(c&0x7f) << shift
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		return
+	}
+	if readSize() != uint64(len(base)) {
+		return nil, corruptObjectError
+	}
+	// Space is only set aside for the result up to the size of its
+	// inputs, because the size it claims is not trusted.
+	resultSize := readSize()
+	room := uint64(len(base) + len(delta))
+	if resultSize < room {
+		room = resultSize
+	}
+	result = make([]byte, 0, room)
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+		if op&0x80 == 0 {
+			// Insert the next op bytes.
+			if op == 0 || int(op) > len(delta) {
+				return nil, corruptObjectError
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+
+		// Copy from the base. The low four bits mark which bytes of
+		// the offset are present, and the next three mark which
+		// bytes of the size are present.
+		var offset, size uint64
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, corruptObjectError
+			}
+			if i < 4 {
+				offset |= uint64(delta[0]) << (8 * i)
+			} else {
+				size |= uint64(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if offset+size > uint64(len(base)) {
+			return nil, corruptObjectError
+		}
+		result = append(result, base[offset:offset+size]...)
+	}
+	if uint64(len(result)) != resultSize {
+		return nil, corruptObjectError
+	}
+	return result, nil
+}
+
+// treeEntry is a single entry of a tree object.
+type treeEntry struct {
+	Mode string   // Octal mode, such as "100644" or "40000"
+	Name string   // Name of the entry
+	ID   objectID // Name of the object
+}
+
+// IsDir returns true if the entry refers to another tree.
+func (e *treeEntry) IsDir() bool {
+	return e.Mode == "40000"
+}
+
+// IsSubmodule returns true if the entry refers to a commit in another
+// repository.
+func (e *treeEntry) IsSubmodule() bool {
+	return e.Mode == "160000"
+}
+
+// parseTree parses the contents of a tree object, which consists of
+// entries of the form "<mode> <name>\0<20-byte object name>".
+func parseTree(data []byte) (entries []*treeEntry, err error) {
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		null := bytes.IndexByte(data, 0)
+		if space < 0 || null < space || len(data) < null+21 {
+			return nil, corruptObjectError
+		}
+		e := &treeEntry{
+			Mode: string(data[:space]),
+			Name: string(data[space+1 : null]),
+		}
+		copy(e.ID[:], data[null+1:null+21])
+		entries = append(entries, e)
+		data = data[null+21:]
+	}
+	return
+}
+
+// signature is the identity and time from an author, committer, or
+// tagger header.
+type signature struct {
+	Name  string
+	Email string
+	Time  time.Time
+}
+
+// parseSignature parses a header value of the form
+// "Name <email> <unix time> <zone>".
+func parseSignature(s string) (sig signature) {
+	open, close := strings.Index(s, "<"), strings.LastIndex(s, ">")
+	if open < 0 || close < open {
+		sig.Name = s
+		return
+	}
+	sig.Name = strings.TrimSpace(s[:open])
+	sig.Email = s[open+1 : close]
+
+	fields := strings.Fields(s[close+1:])
+	if len(fields) < 1 {
+		return
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return
+	}
+	sig.Time = time.Unix(sec, 0)
+	if len(fields) > 1 && len(fields[1]) == 5 {
+		// Apply the zone, which is of the form "+hhmm".
+		hours, _ := strconv.Atoi(fields[1][1:3])
+		minutes, _ := strconv.Atoi(fields[1][3:5])
+		offset := hours*60*60 + minutes*60
+		if fields[1][0] == '-' {
+			offset = -offset
+		}
+		sig.Time = sig.Time.In(time.FixedZone(fields[1], offset))
+	}
+	return
+}
+
+// commitObject is a parsed commit object.
+type commitObject struct {
+	ID        objectID
+	Tree      objectID
+	Parents   []objectID
+	Author    signature
+	Committer signature
+	Message   string
+}
+
+// parseCommit parses the headers and message of a commit object.
+func parseCommit(id objectID, data []byte) (c *commitObject, err error) {
+	c = &commitObject{ID: id}
+	headers, message := splitObjectMessage(data)
+	for _, h := range headers {
+		parts := strings.SplitN(h, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "tree":
+			if c.Tree, err = parseHexID(parts[1]); err != nil {
+				return nil, err
+			}
+		case "parent":
+			parent, err := parseHexID(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			c.Parents = append(c.Parents, parent)
+		case "author":
+			c.Author = parseSignature(parts[1])
+		case "committer":
+			c.Committer = parseSignature(parts[1])
+		}
+	}
+	c.Message = message
+	return
+}
+
+// Subject returns the first paragraph of the commit message, joined
+// into one line, in the same manner as git's "%s" format.
+func (c *commitObject) Subject() string {
+	subject, _ := c.splitMessage()
+	return subject
+}
+
+// Body returns the commit message without the subject, in the same
+// manner as git's "%b" format, with trailing newlines removed.
+func (c *commitObject) Body() string {
+	_, body := c.splitMessage()
+	return strings.TrimRight(body, "\n")
+}
+
+// splitMessage splits the commit message into the subject and body as
+// git does. Paragraphs are separated by lines containing only
+// whitespace, and the lines of the subject are stripped of trailing
+// whitespace only.
+func (c *commitObject) splitMessage() (subject, body string) {
+	lines := strings.SplitAfter(c.Message, "\n")
+	isBlank := func(line string) bool {
+		return len(strings.TrimSpace(line)) == 0
+	}
+
+	n := 0
+	for n < len(lines) && isBlank(lines[n]) {
+		n++
+	}
+	var subjectLines []string
+	for ; n < len(lines) && !isBlank(lines[n]); n++ {
+		subjectLines = append(subjectLines,
+			strings.TrimRightFunc(lines[n], unicode.IsSpace))
+	}
+	for n < len(lines) && isBlank(lines[n]) {
+		n++
+	}
+	return strings.Join(subjectLines, " "), strings.Join(lines[n:], "")
+}
+
+// tagObject is a parsed annotated tag object.
+type tagObject struct {
+	Object  objectID
+	Type    objectType
+	Name    string
+	Tagger  signature
+	Message string
+}
+
+// parseTag parses the headers and message of a tag object.
+func parseTag(data []byte) (t *tagObject, err error) {
+	t = &tagObject{}
+	headers, message := splitObjectMessage(data)
+	for _, h := range headers {
+		parts := strings.SplitN(h, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "object":
+			if t.Object, err = parseHexID(parts[1]); err != nil {
+				return nil, err
+			}
+		case "type":
+			t.Type = objectTypeNames[parts[1]]
+		case "tag":
+			t.Name = parts[1]
+		case "tagger":
+			t.Tagger = parseSignature(parts[1])
+		}
+	}
+	t.Message = message
+	return
+}
+
+// splitObjectMessage splits a commit or tag object into its headers
+// and message. Continuation lines of headers, (such as in a "gpgsig"
+// header,) are dropped.
+func splitObjectMessage(data []byte) (headers []string, message string) {
+	s := string(data)
+	end := strings.Index(s, "\n\n")
+	if end < 0 {
+		end = len(s)
+	} else {
+		message = s[end+2:]
+	}
+	for _, h := range strings.Split(s[:end], "\n") {
+		if !strings.HasPrefix(h, " ") {
+			headers = append(headers, h)
+		}
+	}
+	return
+}
+
+// parseHexID parses a full hexadecimal object name within an object.
+func parseHexID(s string) (id objectID, err error) {
+	id, ok := parseObjectID(strings.TrimSpace(s))
+	if !ok {
+		return id, corruptObjectError
+	}
+	return id, nil
+}
+
+// readDirNames lists the names of the entries in a directory.
+func readDirNames(dir string) (names []string, err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
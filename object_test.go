@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPackFileCorrupt(t *testing.T) {
+	var blob bytes.Buffer
+	z := zlib.NewWriter(&blob)
+	z.Write([]byte("grove"))
+	z.Close()
+
+	// A chain of deltas, each based on the entry before it, which is
+	// longer than git would ever create.
+	var chain []byte
+	for n := 0; n <= maxDeltaDepth+1; n++ {
+		chain = append(chain, byte(objOfsDelta)<<4, 2)
+	}
+
+	tests := []struct {
+		name   string
+		pack   []byte
+		offset uint64
+	}{
+		{"delta based on itself", []byte{byte(objOfsDelta) << 4, 0}, 0},
+		{"delta chain too deep", chain, uint64(len(chain) - 2)},
+		{"size too large", append([]byte{byte(objBlob)<<4 | 0x8f,
+			0xff, 0xff, 0xff, 0xff, 0x7f}, blob.Bytes()...), 0},
+		{"size too small", append([]byte{byte(objBlob)<<4 | 4},
+			blob.Bytes()...), 0},
+	}
+	for _, test := range tests {
+		f, err := ioutil.TempFile("", "grove-pack-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		if _, err = f.Write(test.pack); err != nil {
+			t.Fatal(err)
+		}
+
+		p := &packFile{file: f}
+		if _, _, err = p.ReadAt(test.offset, nil, 0); err != corruptObjectError {
+			t.Errorf("%s: got error %v, expected %v",
+				test.name, err, corruptObjectError)
+		}
+	}
+}
+
+// TestObjectStoreStat checks that the type and size of every object,
+// whether loose, packed, or stored as a delta, agree with git.
+func TestObjectStoreStat(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+
+	// Commit a second, similar version of a file, so that one of
+	// them is stored as a delta of the other once they are packed.
+	lines := bytes.Repeat([]byte("grove grove grove grove\n"), 1000)
+	for _, extra := range []string{"", "one more line\n"} {
+		err = ioutil.WriteFile(g.Path+"/text", append(lines, extra...), 0644)
+		if err == nil {
+			_, err = g.execute("add", "text")
+		}
+		if err == nil {
+			_, err = g.execute("commit", "-q", "-m", "Text")
+		}
+		if err != nil {
+			t.Fatalf("Failed to commit: %s", err)
+		}
+	}
+
+	r, err := openNativeRepo(g)
+	if err != nil {
+		t.Fatalf("Failed to open repository: %s", err)
+	}
+	for _, packed := range []bool{false, true} {
+		if packed {
+			if _, err = g.execute("gc", "-q", "--aggressive"); err != nil {
+				t.Fatalf("Failed to pack repository: %s", err)
+			}
+		}
+		objects, err := g.execute("cat-file", "--batch-all-objects",
+			"--batch-check=%(objectname) %(objecttype) %(objectsize)")
+		if err != nil {
+			t.Fatalf("Failed to list objects: %s", err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(objects), "\n") {
+			fields := strings.Fields(line)
+			id, _ := parseObjectID(fields[0])
+			typ, size, err := r.objects.Stat(id)
+			if err != nil {
+				t.Errorf("%s (packed: %t): %s", fields[0], packed, err)
+			} else if typ != objectTypeNames[fields[1]] ||
+				strconv.FormatUint(size, 10) != fields[2] {
+				t.Errorf("%s (packed: %t): got type %d and size %d, expected %s",
+					fields[0], packed, typ, size, line)
+			}
+		}
+	}
+}
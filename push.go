@@ -0,0 +1,147 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// credentials maps usernames to the bcrypt hashes of their passwords,
+// as read from the file given by -credentials.
+var credentials map[string][]byte
+
+// dummyHash is compared against when a username is not known, so that
+// it takes as long to reject as a wrong password.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("grove"),
+	bcrypt.DefaultCost)
+
+// verified remembers credentials which have already been checked, so
+// that browsers, which send them with every request, do not pay for
+// bcrypt each time. It is keyed by a hash of the username, password,
+// and stored hash.
+var verified = struct {
+	sync.Mutex
+	users map[[sha256.Size]byte]bool
+}{users: make(map[[sha256.Size]byte]bool)}
+
+// maxVerified is the number of entries in verified beyond which it is
+// emptied.
+const maxVerified = 1024
+
+// pushAnyUser is the entry in a repository's push list which allows
+// any authenticated user to push.
+const pushAnyUser = "*"
+
+// loadCredentials reads a credentials file, which consists of lines of
+// the form "<user>:<bcrypt hash>", as produced by `htpasswd -nB`.
+// Blank lines and lines beginning with "#" are ignored.
+func loadCredentials(name string) (creds map[string][]byte, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	creds = make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, fmt.Errorf("%s:%d: expected <user>:<hash>",
+				name, n)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, n, err)
+		}
+		creds[parts[0]] = []byte(parts[1])
+	}
+	return creds, scanner.Err()
+}
+
+// authenticate checks the HTTP Basic credentials given with the
+// request, and returns the username if they are valid.
+func authenticate(req *http.Request) (user string, ok bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, known := credentials[user]
+	if !known {
+		hash = dummyHash
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + password + "\x00" +
+		string(hash)))
+	verified.Lock()
+	ok = verified.users[key]
+	verified.Unlock()
+	if ok {
+		return user, true
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if !known || err != nil {
+		return user, false
+	}
+	verified.Lock()
+	if len(verified.users) >= maxVerified {
+		verified.users = make(map[[sha256.Size]byte]bool)
+	}
+	verified.users[key] = true
+	verified.Unlock()
+	return user, true
+}
+
+// isPushRequest returns true if the request is part of a push, which
+// git-http-backend serves with receive-pack.
+func isPushRequest(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/git-receive-pack") ||
+		req.URL.Query().Get("service") == "git-receive-pack"
+}
+
+// CanPush returns true if the given authenticated user is in the list
+// of users allowed to push to the repository.
+func (rc *RepoConfig) CanPush(user string) bool {
+	for _, u := range rc.Push {
+		if u == user || u == pushAnyUser {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizePush checks that the request may push to the repository
+// with the given settings. If it may not, it writes the appropriate
+// error and returns false. Otherwise, it returns the authenticated
+// user.
+func authorizePush(w http.ResponseWriter, req *http.Request, rc *RepoConfig) (user string, ok bool) {
+	if !*fPush || len(rc.Push) == 0 {
+		http.Error(w, "Pushing is not enabled for this repository",
+			http.StatusForbidden)
+		return "", false
+	}
+	user, ok = authenticate(req)
+	if !ok {
+		requestLogin(w)
+		http.Error(w, http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return "", false
+	}
+	if !rc.CanPush(user) {
+		http.Error(w, http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return "", false
+	}
+	return user, true
+}
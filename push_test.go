@@ -0,0 +1,49 @@
+package main
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "grove-credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# Users who may push\nalice:" + string(hash) + "\n")
+	f.Close()
+
+	if credentials, err = loadCredentials(f.Name()); err != nil {
+		t.Fatalf("Failed to load credentials: %s", err)
+	}
+
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(test.user, test.password)
+		if _, ok := authenticate(req); ok != test.ok {
+			t.Errorf("%s:%s: expected %t, got %t",
+				test.user, test.password, test.ok, ok)
+		}
+	}
+
+	rc := &RepoConfig{Push: []string{"alice"}}
+	if !rc.CanPush("alice") || rc.CanPush("bob") {
+		t.Errorf("Push list not respected")
+	}
+}
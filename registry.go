@@ -0,0 +1,229 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registry holds every repository within the roots being served. It
+// is filled when the server starts, and kept up to date by rescanning
+// periodically, so that requests need only look repositories up.
+var registry = newRepoRegistry()
+
+// maxRepositoryDepth is the number of directories below the top of a
+// root in which repositories are looked for. It also prevents symlinks
+// from causing endless scans.
+const maxRepositoryDepth = 8
+
+// repoRegistry is a set of repositories, keyed by their top levels,
+// along with metadata about each. It is safe for concurrent use.
+type repoRegistry struct {
+	mu    sync.RWMutex
+	repos map[string]*repoEntry
+}
+
+// repoEntry is the metadata of a repository in a repoRegistry.
+type repoEntry struct {
+	mu      sync.Mutex
+	refs    string       // State of the refs when summary was made
+	summary *RepoSummary // Without Name or Path, which vary
+}
+
+// newRepoRegistry creates an empty repoRegistry.
+func newRepoRegistry() *repoRegistry {
+	return &repoRegistry{repos: make(map[string]*repoEntry)}
+}
+
+// isRepository returns true if dir is the top level of a repository,
+// meaning that it contains a .git directory or file.
+func isRepository(dir string) bool {
+	if path.Base(dir) == ".git" {
+		// The inside of a .git directory is not a work tree.
+		return false
+	}
+	_, err := os.Stat(path.Join(dir, ".git"))
+	return err == nil
+}
+
+// Scan searches each of the roots for repositories, and replaces the
+// contents of the registry with those found. The metadata of those
+// which were already known is kept.
+func (reg *repoRegistry) Scan(rs []*Root) (found int) {
+	var dirs []string
+	var scan func(dir string, depth int)
+	scan = func(dir string, depth int) {
+		f, err := os.Open(dir)
+		if err != nil {
+			return
+		}
+		names, err := f.Readdirnames(0)
+		f.Close()
+		if err != nil {
+			return
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			// We use os.Stat() so that symlinks are followed, as in
+			// directory listings.
+			p := path.Join(dir, name)
+			if info, err := os.Stat(p); err != nil || !info.IsDir() {
+				continue
+			}
+			if isRepository(p) {
+				dirs = append(dirs, p)
+			} else if depth < maxRepositoryDepth {
+				scan(p, depth+1)
+			}
+		}
+	}
+	for _, r := range rs {
+		if isRepository(r.Dir) {
+			dirs = append(dirs, r.Dir)
+		} else {
+			scan(r.Dir, 1)
+		}
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	repos := make(map[string]*repoEntry, len(dirs))
+	for _, dir := range dirs {
+		if e, ok := reg.repos[dir]; ok {
+			repos[dir] = e
+		} else {
+			repos[dir] = &repoEntry{}
+		}
+	}
+	reg.repos = repos
+	return len(repos)
+}
+
+// Rescan scans the roots repeatedly, waiting for the given interval
+// between each scan. It does not return.
+func (reg *repoRegistry) Rescan(rs []*Root, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		start := time.Now()
+		found := reg.Scan(rs)
+		l.Debugf("Rescanned for repositories in %s; found %d\n",
+			time.Since(start), found)
+	}
+}
+
+// Find determines the top level of the repository which contains the
+// absolute path p, within the directory top. If none does, ok is
+// false. Repositories which have been created since the last scan are
+// found and added, and those which no longer exist are removed.
+func (reg *repoRegistry) Find(top, p string) (repository string, ok bool) {
+	dirs := parents(top, p)
+	reg.mu.RLock()
+	for _, dir := range dirs {
+		if _, ok = reg.repos[dir]; ok {
+			repository = dir
+			break
+		}
+	}
+	reg.mu.RUnlock()
+	if ok {
+		if isRepository(repository) {
+			return repository, true
+		}
+		reg.remove(repository)
+	}
+
+	// If no known repository contains the path, check whether a new
+	// one does.
+	for _, dir := range dirs {
+		if isRepository(dir) {
+			reg.add(dir)
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// parents lists p and each of its parents, up to and including top,
+// from the longest to the shortest.
+func parents(top, p string) (dirs []string) {
+	for dir := path.Clean(p); strings.HasPrefix(dir, top); dir = path.Dir(dir) {
+		dirs = append(dirs, dir)
+		if len(dir) <= len(top) {
+			break
+		}
+	}
+	return
+}
+
+// add adds a repository to the registry, if it is not already there.
+func (reg *repoRegistry) add(dir string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.repos[dir]; !ok {
+		reg.repos[dir] = &repoEntry{}
+	}
+}
+
+// remove removes a repository from the registry.
+func (reg *repoRegistry) remove(dir string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.repos, dir)
+}
+
+// Within lists the top levels of the known repositories within the
+// directory dir, in order.
+func (reg *repoRegistry) Within(dir string) (repositories []string) {
+	prefix := dir
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	for repository := range reg.repos {
+		if repository == dir || strings.HasPrefix(repository, prefix) {
+			repositories = append(repositories, repository)
+		}
+	}
+	sort.Strings(repositories)
+	return
+}
+
+// Summary retrieves the metadata of a repository, which is gathered
+// again only if its refs have changed. Its Name and Path are blank.
+// If the repository is not in the registry, ok is false.
+func (reg *repoRegistry) Summary(dir string) (s *RepoSummary, ok bool) {
+	reg.mu.RLock()
+	e, ok := reg.repos[dir]
+	reg.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	refs, err := refsState(dir)
+	if err != nil || refs != e.refs || e.summary == nil {
+		e.summary = summarize(dir)
+		e.refs = refs
+	}
+
+	// Copy the summary, so that the caller can fill in the rest, and
+	// update the relative time of its commit. The description is read
+	// every time, because changing it does not change the refs.
+	summary := *e.summary
+	summary.Description = description(dir)
+	if c := summary.LastCommit; c != nil {
+		commit := *c
+		commit.Time = relativeTime(commit.date)
+		summary.LastCommit = &commit
+	}
+	return &summary, true
+}
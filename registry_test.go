@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"a/.git", "b/c/.git", "b/d", ".hidden/.git"} {
+		if err = os.MkdirAll(path.Join(dir, p), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reg := newRepoRegistry()
+	if found := reg.Scan([]*Root{{Dir: dir}}); found != 2 {
+		t.Errorf("Expected 2 repositories, found %d", found)
+	}
+	expected := []string{path.Join(dir, "a"), path.Join(dir, "b/c")}
+	if repos := reg.Within(dir); !reflect.DeepEqual(repos, expected) {
+		t.Errorf("Expected %v, got %v", expected, repos)
+	}
+
+	tests := []struct {
+		p, repository string
+	}{
+		{"a", "a"},
+		{"a/tree/sub/file", "a"},
+		{"b/c/x", "b/c"},
+		{"b/d", ""},
+		{"b", ""},
+		{"e/f/g", "e/f"}, // Created after the scan
+	}
+	if err = os.MkdirAll(path.Join(dir, "e/f/.git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		repository, ok := reg.Find(dir, path.Join(dir, test.p))
+		if len(test.repository) > 0 {
+			test.repository = path.Join(dir, test.repository)
+		}
+		if repository != test.repository || ok != (len(test.repository) > 0) {
+			t.Errorf("%s: expected %q, got %q", test.p,
+				test.repository, repository)
+		}
+	}
+
+	// Removed repositories must not be found.
+	os.RemoveAll(path.Join(dir, "a"))
+	if repository, ok := reg.Find(dir, path.Join(dir, "a/file")); ok {
+		t.Errorf("Removed repository found at %q", repository)
+	}
+}
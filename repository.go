@@ -0,0 +1,194 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// Repository is the interface through which the web interface and API
+// read from git repositories. The git type implements it by invoking
+// git, and nativeRepo implements it by reading the repository
+// directly, falling back to git for anything it does not support.
+type Repository interface {
+	// Dir returns the top level directory of the repository.
+	Dir() string
+
+	User() (user string, err error)
+	Email() (email string, err error)
+	Branch(ref string) (branch string, err error)
+	Branches() (branches []string, err error)
+	Tags() (tags []string, err error)
+	Refs(namespace string) (refs []*Ref, err error)
+	AheadBehind(base, ref string) (ahead, behind int, err error)
+	SHA(ref string) (sha string, err error)
+	Resolve(ref string) (sha string, err error)
+	RefExists(ref string) (exists bool)
+	TotalCommits() (commits int, err error)
+	GetBranchDescription(branch string) (description string, err error)
+
+	IsDir(ref, file string) (isDir bool, err error)
+	GetFile(commit, file string) (contents []byte, err error)
+	GetDir(commit, dir string) (files []string, err error)
+	Tree(commit, dir string) (entries []*TreeEntry, err error)
+
+	Commits(ref string, max int) (commits []*Commit, err error)
+	CommitsByFile(ref, file string, max int) (commits []*Commit, err error)
+	CommitsMatching(ref string, f *LogFilter, max int) (commits []*Commit, err error)
+	Show(ref string) (info *CommitInfo, err error)
+	Diff(from, to string) (diffs []*FileDiff, err error)
+	Blame(ref, file string) (lines []*BlameLine, err error)
+	Grep(ref string, q *GrepQuery, max int) (matches []*GrepMatch, err error)
+	Archive(w io.Writer, ref, format, prefix, dir string) (err error)
+}
+
+// Blob is a file in a repository, along with its contents.
+type Blob struct {
+	Path     string // Path within the repository
+	Mode     string // Octal mode, such as "100644"
+	SHA      string // Full SHA of the blob
+	Size     int64  // Size in bytes
+	Binary   bool   // True if the contents are not text
+	Encoding string // Encoding of Content: "utf-8" or "base64"
+	Content  string // Contents of the file, base64 encoded if Binary
+}
+
+// Backends which can be selected with the -backend flag.
+const (
+	backendExec   = "exec"   // Invoke git for everything
+	backendNative = "native" // Read repositories directly where possible
+)
+
+// openRepository returns a Repository for the repository whose top
+// level is dir, using the backend selected by the -backend flag. If
+// the native backend cannot read the repository, it falls back to
+// invoking git. Unless caching is disabled, the result is wrapped in
+// a cachedRepo.
+func openRepository(dir string) Repository {
+	var r Repository = &git{Path: dir}
+	if *fBackend == backendNative {
+		if native, err := openNativeRepo(r.(*git)); err != nil {
+			l.Debugf("Falling back to git for %q: %s\n", dir, err)
+		} else {
+			r = native
+		}
+	}
+	if objectCache != nil {
+		r = &cachedRepo{Repository: r}
+	}
+	return r
+}
+
+// gitDirs locates the git directory of the repository whose top level
+// is dir, which holds HEAD, and the common directory, which holds refs
+// and objects. These differ only in linked worktrees.
+func gitDirs(dir string) (gitDir, commonDir string, err error) {
+	gitDir = path.Join(dir, ".git")
+
+	// If .git is a file, such as in a linked worktree, it points to
+	// the real directory.
+	fi, err := os.Stat(gitDir)
+	if err != nil {
+		return "", "", err
+	}
+	if !fi.IsDir() {
+		link, err := ioutil.ReadFile(gitDir)
+		if err != nil {
+			return "", "", err
+		}
+		gitDir = strings.TrimSpace(strings.TrimPrefix(string(link), "gitdir:"))
+		if !filepath.IsAbs(gitDir) {
+			gitDir = path.Join(dir, gitDir)
+		}
+	}
+	commonDir = gitDir
+	if common, err := ioutil.ReadFile(path.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(common))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = path.Join(gitDir, commonDir)
+		}
+		commonDir = path.Clean(commonDir)
+	}
+	return gitDir, commonDir, nil
+}
+
+// defaultDescription is the description which git gives to new
+// repositories, which is treated as no description at all.
+const defaultDescription = "Unnamed repository; edit this file 'description' to name the repository."
+
+// readDescription reads the description of the repository whose top
+// level is dir, as used by gitweb, from the description file in its
+// common directory. If there is none, it returns a blank string.
+func readDescription(dir string) string {
+	_, commonDir, err := gitDirs(dir)
+	if err != nil {
+		return ""
+	}
+	b, err := ioutil.ReadFile(path.Join(commonDir, "description"))
+	if err != nil {
+		return ""
+	}
+	description := strings.TrimSpace(string(b))
+	if description == defaultDescription {
+		return ""
+	}
+	return description
+}
+
+// readBlob retrieves a file as of the given ref, along with its mode,
+// SHA, and size. The contents are returned both as they are and
+// encoded in the Blob, where binary files are base64 encoded. If the
+// path is not a file, it returns PathNotFoundError.
+func readBlob(g Repository, ref, file string) (blob *Blob, contents []byte, err error) {
+	file = strings.Trim(file, "/")
+	dir := path.Dir(file)
+	if dir == "." {
+		dir = ""
+	}
+	entries, err := g.Tree(ref, dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, e := range entries {
+		if e.Name == path.Base(file) && e.Type == "blob" {
+			blob = &Blob{Path: file, Mode: e.Mode, SHA: e.SHA, Size: e.Size}
+			break
+		}
+	}
+	if blob == nil {
+		return nil, nil, PathNotFoundError
+	}
+
+	if contents, err = g.GetFile(ref, file); err != nil {
+		return nil, nil, err
+	}
+	blob.Binary = isBinary(contents)
+	if blob.Binary {
+		blob.Encoding = "base64"
+		blob.Content = base64.StdEncoding.EncodeToString(contents)
+	} else {
+		blob.Encoding = "utf-8"
+		blob.Content = string(contents)
+	}
+	return blob, contents, nil
+}
+
+// isBinary determines whether the contents of a file are binary, in
+// the same way as git: by looking for a NUL byte within the first 8000
+// bytes. Contents which are not valid UTF-8 are also binary, so that
+// they can be encoded.
+func isBinary(contents []byte) bool {
+	head := contents
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) >= 0 || !utf8.Valid(contents)
+}
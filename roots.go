@@ -0,0 +1,209 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Root is a directory which is served under its own URL prefix, with
+// its own permission policy.
+type Root struct {
+	Name  string // First element of the URL path, or blank for "/"
+	Dir   string // Absolute path of the directory
+	Perms uint   // Which permission bits must be set, as with Perms
+
+	handler *cgi.Handler // git-http-backend CGI handler
+	policy  policyCache  // Access policy, read from accessFile
+}
+
+var roots []*Root // All served roots, sorted by name
+
+// permLevels are the names of the values of Perms, as used by the
+// -perms flag and the configuration file.
+var permLevels = map[string]uint{
+	"world": 0,
+	"group": 1,
+	"owner": 2,
+}
+
+// reservedRootNames cannot be used as the names of roots, because
+// they would conflict with other URLs, such as the resources beneath
+// /res/ and the API beneath apiV1Prefix.
+var reservedRootNames = map[string]bool{
+	"res": true,
+	"api": true,
+}
+
+// parsePerms determines the value of Perms from its name.
+func parsePerms(name string) (perms uint, err error) {
+	perms, ok := permLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown permission level %q", name)
+	}
+	return perms, nil
+}
+
+// parseRoot parses a root given on the command line, in the form
+// "[name=]directory". Relative directories are taken to be relative to
+// the working directory.
+func parseRoot(arg string) (r *Root, err error) {
+	r = &Root{Perms: Perms}
+	dir := arg
+	if idx := strings.Index(arg, "="); idx > -1 {
+		r.Name, dir = arg[:idx], arg[idx+1:]
+	}
+	if r.Dir, err = absPath(expandHome(dir)); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// absPath cleans p and makes it absolute, relative to the working
+// directory.
+func absPath(p string) (abs string, err error) {
+	p = path.Clean(p)
+	if !path.IsAbs(p) {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		p = path.Join(wd, p)
+	}
+	return p, nil
+}
+
+// setRoots checks that the given roots can be served together, and if
+// so, sorts them by name and sets roots. A root without a name can
+// only be served alone.
+func setRoots(rs []*Root) error {
+	if len(rs) == 0 {
+		return errors.New("no directory to serve")
+	}
+	names := make(map[string]bool)
+	for _, r := range rs {
+		switch {
+		case len(r.Name) == 0 && len(rs) > 1:
+			return fmt.Errorf("%q must be given a name to be served "+
+				"with other directories", r.Dir)
+		case strings.ContainsAny(r.Name, "/?#%") || r.Name == "." ||
+			r.Name == ".." || reservedRootNames[r.Name]:
+			return fmt.Errorf("%q cannot be used as a name", r.Name)
+		case names[r.Name]:
+			return fmt.Errorf("%q is used as a name more than once",
+				r.Name)
+		}
+		names[r.Name] = true
+	}
+	sort.Sort(rootsByName(rs))
+	roots = rs
+	return nil
+}
+
+// rootsByName implements sort.Interface.
+type rootsByName []*Root
+
+func (rs rootsByName) Len() int           { return len(rs) }
+func (rs rootsByName) Less(i, j int) bool { return rs[i].Name < rs[j].Name }
+func (rs rootsByName) Swap(i, j int)      { rs[i], rs[j] = rs[j], rs[i] }
+
+// findRoot determines which root serves the given URL path, and
+// returns the rest of the path within it, beginning with "/". If no
+// root serves the path, r is nil.
+func findRoot(urlPath string) (r *Root, rest string) {
+	if len(roots) == 1 && len(roots[0].Name) == 0 {
+		return roots[0], urlPath
+	}
+	name := strings.TrimPrefix(urlPath, "/")
+	if idx := strings.Index(name, "/"); idx > -1 {
+		name, rest = name[:idx], name[idx:]
+	}
+	if len(rest) == 0 {
+		rest = "/"
+	}
+	for _, r := range roots {
+		if r.Name == name {
+			return r, rest
+		}
+	}
+	return nil, ""
+}
+
+// URLPath returns the URL path of the root, without a trailing slash.
+func (r *Root) URLPath() string {
+	if len(r.Name) == 0 {
+		return ""
+	}
+	return "/" + r.Name
+}
+
+// CheckPerms returns true if the file is readable according to the
+// policy of the root, and its name does not begin with a ".".
+func (r *Root) CheckPerms(info os.FileInfo) (canServe bool) {
+	if strings.HasPrefix(info.Name(), ".") {
+		return false
+	}
+	return r.CheckPermBits(info)
+}
+
+// CheckPermBits returns true if the file is readable according to the
+// policy of the root.
+func (r *Root) CheckPermBits(info os.FileInfo) (canServe bool) {
+	permBits := 0004
+	if info.IsDir() {
+		permBits = 0005
+	}
+
+	// For example, consider the following:
+	//
+	//       rwl rwl rwl       r-l
+	//    0b 111 101 101 & (0b 101 << 3)  > 0
+	//    0b 111 101 101 & 0b 000 101 000 > 0
+	//    0b 000 101 000                  > 0
+	//    TRUE
+	//
+	// Thus, the file is readable and listable by the group, and
+	// therefore okay to serve.
+	return (info.Mode().Perm()&os.FileMode((permBits<<(r.Perms*3))) > 0)
+}
+
+// Repositories lists the top levels of all of the repositories within
+// the directory dir, as known to the registry, which the given user
+// may see. That is, the user must be able to see every directory
+// between dir and the repository.
+func (r *Root) Repositories(dir, user string) (repositories []string) {
+	visible := make(map[string]bool)
+	canSee := func(p string) bool {
+		v, ok := visible[p]
+		if !ok {
+			info, err := os.Stat(p)
+			v = err == nil && r.CanServe(p, info, user) == http.StatusOK &&
+				!getRepoConfig(p).Hidden
+			visible[p] = v
+		}
+		return v
+	}
+
+	for _, repository := range registry.Within(dir) {
+		ok := true
+		for _, p := range parents(dir, repository) {
+			if p == dir {
+				break
+			} else if !canSee(p) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			repositories = append(repositories, repository)
+		}
+	}
+	return
+}
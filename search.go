@@ -0,0 +1,150 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// defaultResults is the default maximum number of matching lines to
+// show in a search.
+const defaultResults = 100
+
+// SearchResult is a line which matched a search, along with the
+// repository and ref in which it was found.
+type SearchResult struct {
+	Repository string // URL path of the repository, with a trailing slash
+	Ref        string // Ref which was searched
+	*GrepMatch
+	Highlights []Span // Each match within Text
+}
+
+// Span is a range of bytes within a string.
+type Span struct {
+	Start, End int
+}
+
+// formQuery reads a search from the form. The pattern is given as q,
+// and it is treated as a regular expression if regexp is given, and
+// without regard to case if icase is given.
+func formQuery(req *http.Request) *GrepQuery {
+	_, re := req.Form["regexp"]
+	_, icase := req.Form["icase"]
+	return &GrepQuery{
+		Pattern:    req.FormValue("q"),
+		Regexp:     re,
+		IgnoreCase: icase,
+	}
+}
+
+// formResults retrieves the maximum number of search results to show
+// from the form, or the default if it is not given.
+func formResults(req *http.Request) int {
+	max, err := strconv.Atoi(req.FormValue("limit"))
+	if err != nil {
+		return defaultResults
+	}
+	return max
+}
+
+// compile produces a regular expression which matches the same text as
+// the query, so that matches can be highlighted. Go's syntax agrees
+// with git's extended regular expressions for all but unusual
+// patterns. If the pattern is invalid, it returns InvalidPatternError.
+func (q *GrepQuery) compile() (re *regexp.Regexp, err error) {
+	expr := q.Pattern
+	if !q.Regexp {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if q.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	if re, err = regexp.Compile(expr); err != nil {
+		return nil, InvalidPatternError
+	}
+	return re, nil
+}
+
+// searchRepository searches the given ref of g, whose URL path is
+// repository, for up to max lines matching the query. If the pattern
+// is blank, nothing is searched.
+func searchRepository(g Repository, repository, ref string, q *GrepQuery, max int) (results []*SearchResult, err error) {
+	if len(q.Pattern) == 0 {
+		return nil, nil
+	}
+	re, err := q.compile()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := g.Grep(ref, q, max)
+	if err != nil {
+		return nil, err
+	}
+	results = make([]*SearchResult, len(matches))
+	for n, m := range matches {
+		results[n] = &SearchResult{
+			Repository: repository,
+			Ref:        ref,
+			GrepMatch:  m,
+		}
+		for _, loc := range re.FindAllStringIndex(m.Text, -1) {
+			results[n].Highlights = append(results[n].Highlights,
+				Span{loc[0], loc[1]})
+		}
+	}
+	return results, nil
+}
+
+// searchRepositories searches the default branch of every repository
+// which the user may see within the given directory, or if it is
+// blank, within each of the given roots, for up to max lines in total
+// which match the query. Repositories which cannot be searched, such
+// as those without any commits, are left out.
+func searchRepositories(rs []*Root, directory, remoteUser string, q *GrepQuery, max int) (results []*SearchResult, err error) {
+	if len(q.Pattern) == 0 {
+		return nil, nil
+	}
+	// Report an invalid pattern once, rather than for every
+	// repository.
+	if _, err = q.compile(); err != nil {
+		return nil, err
+	}
+	for _, repo := range findRepositories(rs, directory, remoteUser) {
+		remaining := max
+		if max > 0 {
+			if remaining = max - len(results); remaining <= 0 {
+				break
+			}
+		}
+		g := openRepository(repo.Dir)
+		found, err := searchRepository(g, repo.Path,
+			getRepoConfig(repo.Dir).Ref(), q, remaining)
+		if err != nil {
+			l.Debugf("Could not search %q: %s\n", repo.Dir, err)
+			continue
+		}
+		results = append(results, found...)
+	}
+	return results, nil
+}
+
+// highlight escapes the text of the result for HTML, and wraps each
+// match in a mark element.
+func (r *SearchResult) highlight() template.HTML {
+	var buf bytes.Buffer
+	last := 0
+	for _, h := range r.Highlights {
+		buf.WriteString(html.EscapeString(r.Text[last:h.Start]))
+		buf.WriteString("<mark>")
+		buf.WriteString(html.EscapeString(r.Text[h.Start:h.End]))
+		buf.WriteString("</mark>")
+		last = h.End
+	}
+	buf.WriteString(html.EscapeString(r.Text[last:]))
+	return template.HTML(buf.String())
+}
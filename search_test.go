@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSearchHighlight(t *testing.T) {
+	tests := []struct {
+		q        GrepQuery
+		text     string
+		expected string
+	}{
+		{GrepQuery{Pattern: "a.b"}, "a.b axb", "<mark>a.b</mark> axb"},
+		{GrepQuery{Pattern: "a.b", Regexp: true}, "a.b axb",
+			"<mark>a.b</mark> <mark>axb</mark>"},
+		{GrepQuery{Pattern: "<B>", IgnoreCase: true}, "x<b>y",
+			"x<mark>&lt;b&gt;</mark>y"},
+	}
+	for _, test := range tests {
+		output := parseGrep("HEAD:dir/file.go\x0042\x00"+test.text+"\n",
+			"HEAD")
+		if len(output) != 1 || output[0].File != "dir/file.go" ||
+			output[0].Line != 42 || output[0].Text != test.text {
+			t.Fatalf("Failed to parse match: %+v", output)
+		}
+		results, err := searchRepository(&grepRepo{matches: output},
+			"/proj/", "HEAD", &test.q, 0)
+		if err != nil || len(results) != 1 {
+			t.Fatalf("%q: unexpected results %v: %s", test.q.Pattern,
+				results, err)
+		}
+		if h := string(results[0].highlight()); h != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.q.Pattern,
+				test.expected, h)
+		}
+	}
+
+	if _, err := searchRepository(&grepRepo{}, "/proj/", "HEAD",
+		&GrepQuery{Pattern: "(", Regexp: true}, 0); err != InvalidPatternError {
+		t.Errorf("Expected InvalidPatternError, got %v", err)
+	}
+}
+
+// grepRepo is a Repository whose searches always produce the given
+// matches.
+type grepRepo struct {
+	Repository
+	matches []*GrepMatch
+}
+
+func (r *grepRepo) Grep(ref string, q *GrepQuery, max int) ([]*GrepMatch, error) {
+	return r.matches, nil
+}
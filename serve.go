@@ -11,21 +11,24 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 var (
 	Perms = uint(0)
-	// Used to specify which files can be served:
+	// Used to specify which files can be served, unless a root
+	// specifies otherwise:
 	// 0: readable globally
 	// 1: readable by group
 	// 2: readable
 
-	handler *cgi.Handler       // git-http-backend CGI handler
-	t       *template.Template // Template containing all webui templates
+	t *template.Template // Template containing all webui templates
 
 	templateFiles = []string{ // Basenames of the HTML templates
-		"dir.html", "file.html",
+		"dir.html", "index.html", "file.html",
 		"gitpage.html", "tree.html",
+		"commit.html", "compare.html", "blame.html",
+		"history.html", "search.html", "refs.html",
 		"error.html", "about.html",
 	}
 
@@ -40,19 +43,29 @@ type gzipResponseWriter struct {
 
 // Serve creates an HTTP server using net/http and initializes it
 // appropriately. If the fWeb flagg is true, it will serve directory
-// trees and git repositories to incoming requests.
-func Serve(repodir string) {
-	handler = &cgi.Handler{
-		Path: gitVarExecPath() + "/" + gitHttpBackend,
-		Root: "/",
-		Dir:  repodir,
-		Env: []string{"GIT_PROJECT_ROOT=" + repodir,
-			"GIT_HTTP_EXPORT_ALL=TRUE"},
-		Logger: &l.Logger,
+// trees and git repositories in each of the roots to incoming
+// requests.
+func Serve() {
+	execPath, err := gitVarExecPath()
+	if err != nil {
+		l.Emergf("Could not locate git: %s\n", err)
+		return
+	}
+	for _, r := range roots {
+		r.handler = &cgi.Handler{
+			Path: execPath + "/" + gitHttpBackend,
+			Root: "/",
+			Dir:  r.Dir,
+			Env: []string{"GIT_PROJECT_ROOT=" + r.Dir,
+				"GIT_HTTP_EXPORT_ALL=TRUE"},
+			Logger: &l.Logger,
+		}
+	}
+	user, err = (&git{roots[0].Dir}).User()
+	if err != nil {
+		l.Errf("Could not determine username: %s\n", err)
 	}
-	user = (&git{repodir}).User()
 
-	var err error
 	t, err = getTemplate()
 	if err != nil {
 		l.Emerg("HTML templates failed to load; exiting\n")
@@ -61,12 +74,40 @@ func Serve(repodir string) {
 		l.Debug("Templates loaded successfully\n")
 	}
 
+	// Find the repositories being served, and keep looking for new
+	// ones in the background.
+	start := time.Now()
+	found := registry.Scan(roots)
+	l.Infof("Found %d repositories in %s\n", found, time.Since(start))
+	if *fRescan > 0 {
+		go registry.Rescan(roots, *fRescan)
+	}
+
 	l.Infof("Starting server on %s:%s\n", *fBind, *fPort)
-	l.Infof("Serving %q\n", repodir)
+	for _, r := range roots {
+		l.Infof("Serving %q at %q\n", r.Dir, r.URLPath()+"/")
+		if policy, err := r.Policy(); err != nil {
+			l.Errf("Access policy of %q could not be read: %s\n",
+				r.Dir, err)
+		} else if policy != nil {
+			l.Infof("Access policy: %s\n", path.Join(r.Dir, accessFile))
+		}
+	}
 	l.Infof("Username: %s\n", user)
 	l.Infof("Prefix: %s", *fPrefix)
 	l.Infof("Web access: %t\n", *fWeb)
 	l.Infof("Theme: %s", *fTheme)
+	l.Infof("Backend: %s", *fBackend)
+	l.Infof("Cache: %d MB", *fCache)
+	l.Infof("Push: %t", *fPush)
+	l.Infof("TLS: %t", tlsEnabled())
+	if !tlsEnabled() && len(credentials) > 0 {
+		l.Warning("Passwords will be sent without encryption; " +
+			"consider -tls-cert or -tls-self-signed\n")
+	}
+	if len(*fRedirectPort) > 0 {
+		l.Infof("Redirecting HTTP on port %s\n", *fRedirectPort)
+	}
 
 	// Set the prefixLength variable, for easy use in the future.
 	prefixLength = len(*fPrefix)
@@ -76,12 +117,30 @@ func Serve(repodir string) {
 	http.HandleFunc(*fPrefix+"/res/", HandleRes)
 	
 	if *fWeb {
+		http.HandleFunc(*fPrefix+apiV1Prefix, gzipHandler(HandleAPI))
 		http.HandleFunc("/", gzipHandler(HandleWeb))
  	} else {
 		http.HandleFunc("/", gzipHandler(HandleAbout))
 	}
 
-	err = http.ListenAndServe(*fBind+":"+*fPort, nil)
+	// Serve HTTPS if it is enabled, and if requested, redirect plain
+	// HTTP to it from another port.
+	if tlsEnabled() {
+		cert, key, err := tlsFiles()
+		if err != nil {
+			l.Fatalf("Could not set up TLS: %s\n", err)
+		}
+		if len(*fRedirectPort) > 0 {
+			go func() {
+				err := http.ListenAndServe(*fBind+":"+*fRedirectPort,
+					http.HandlerFunc(redirectHTTPS))
+				l.Errf("Redirect server crashed: %s", err)
+			}()
+		}
+		err = http.ListenAndServeTLS(*fBind+":"+*fPort, cert, key, nil)
+	} else {
+		err = http.ListenAndServe(*fBind+":"+*fPort, nil)
+	}
 	if err != nil {
 		l.Fatalf("Server crashed: %s", err)
 	}
@@ -123,7 +182,58 @@ func HandleWeb(w http.ResponseWriter, req *http.Request) {
 	} else {
 		req.URL.Path = req.URL.Path[prefixLength:]
 	}
-	p := path.Join(handler.Dir, req.URL.Path)
+
+	// Determine who, if anyone, has logged in, for the access policy.
+	// Invalid credentials are treated as no login at all.
+	remoteUser, ok := authenticate(req)
+	if !ok {
+		remoteUser = ""
+	}
+
+	// Then determine which root the request is for. If they have
+	// names, the top level lists them, or serves the index or the
+	// activity of all of them.
+	root, rest := findRoot(req.URL.Path)
+	if root == nil {
+		if req.URL.Path == "/" {
+			var err error
+			req.ParseForm()
+			_, useAPI := req.Form["api"]
+			_, index := req.Form["index"]
+			_, search := req.Form["search"]
+			switch {
+			case useAPI && search:
+				err = ServeGroveSearchAPI(w, req, roots, "", remoteUser,
+					formQuery(req), formResults(req))
+			case useAPI && index:
+				err = ServeIndexAPI(w, req, roots, "", "/", remoteUser,
+					req.FormValue("sort"))
+			case useAPI:
+				err = ServeGroveAPI(w, req, roots, "", "/", remoteUser,
+					formFilter(req), formCommits(req))
+			case search:
+				var status int
+				err, status = MakeGroveSearchPage(w, rootsPageInfo(), roots,
+					"", remoteUser, formQuery(req), formResults(req))
+				if err != nil {
+					Error(w, status)
+				}
+			case index:
+				err, _ = MakeIndexPage(w, rootsPageInfo(), roots, "",
+					remoteUser, req.FormValue("sort"))
+			default:
+				err = MakeRootsPage(w)
+			}
+			if err != nil {
+				l.Errf("View of %q from %q caused error: %s",
+					req.URL.Path, req.RemoteAddr, err)
+			}
+			return
+		}
+		Error(w, http.StatusNotFound)
+		return
+	}
+	p := path.Join(root.Dir, rest)
 
 	// Send the request to the git http backend if it is to a .git
 	// URL.
@@ -132,8 +242,6 @@ func HandleWeb(w http.ResponseWriter, req *http.Request) {
 		l.Debugf("Git request to %q from %q\n",
 			req.URL, req.RemoteAddr)
 
-		// Check to make sure that the repository is globally
-		// readable.
 		fi, err := os.Stat(gitPath)
 		if err != nil {
 			l.Errf("Git request of %q from %q produced error: %s\n",
@@ -141,14 +249,59 @@ func HandleWeb(w http.ResponseWriter, req *http.Request) {
 			http.NotFound(w, req)
 			return
 		}
-		if !CheckPermBits(fi) {
+		repository := path.Clean(gitPath)
+		if path.Base(repository) == ".git" {
+			repository = path.Dir(repository)
+		}
+
+		// Check to make sure that the repository may be read, either
+		// according to the access policy or, if it is not listed,
+		// because it is globally readable.
+		status, decided := root.Access(repository, remoteUser)
+		if !decided {
+			status = http.StatusOK
+			if !root.CheckPermBits(fi) {
+				status = http.StatusForbidden
+			}
+		}
+		if status != http.StatusOK {
 			l.Noticef("Git request to %q from %q denied\n",
 				req.URL.Path, req.RemoteAddr)
-			http.Error(w, http.StatusText(http.StatusForbidden),
-				http.StatusForbidden)
+			if status == http.StatusUnauthorized {
+				requestLogin(w)
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		rc := getRepoConfig(repository)
+		if rc.Hidden {
+			l.Noticef("Git request to hidden %q from %q denied\n",
+				req.URL.Path, req.RemoteAddr)
+			http.NotFound(w, req)
 			return
 		}
 
+		// Pushes must be authorized, and the backend will only accept
+		// them if it is told who the user is.
+		handler := root.handler
+		if isPushRequest(req) {
+			user, ok := authorizePush(w, req, rc)
+			if !ok {
+				l.Noticef("Push to %q from %q denied\n",
+					req.URL.Path, req.RemoteAddr)
+				return
+			}
+			l.Infof("Push to %q from %q by %q\n",
+				req.URL.Path, req.RemoteAddr, user)
+			pushHandler := *handler
+			pushHandler.Env = append([]string{"REMOTE_USER=" + user},
+				handler.Env...)
+			handler = &pushHandler
+		}
+
+		// The backend expects the path within the root.
+		req.URL.Path = rest
 		handler.ServeHTTP(w, req)
 		return
 	}
@@ -156,18 +309,27 @@ func HandleWeb(w http.ResponseWriter, req *http.Request) {
 	// Figure out which directory is being requested, and check
 	// whether we're allowed to serve it.
 
-	repository, file, g, isDir, status := AnalyzePath(handler.Dir,
-		p, req.Form.Get("ref"))
+	repository, file, g, isDir, status, err := AnalyzePath(root,
+		p, req.FormValue("ref"), remoteUser)
 	if status == http.StatusOK {
-		MakePage(w, req, g, repository, file, isDir)
+		MakePage(w, req, root, g, repository, file, isDir, remoteUser)
+		return
 	}
+	l.Errf("View of %q from %q caused error: %s",
+		req.URL.Path, req.RemoteAddr, err)
+	if status == http.StatusUnauthorized {
+		requestLogin(w)
+	}
+	Error(w, status)
 }
 
 // If the client accepts gzipped responses, that's what we'll send,
-// otherwise use the default http handler to send data.
+// otherwise use the default http handler to send data. Archives are
+// already compressed, so they are sent as they are.
 func gzipHandler(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") ||
+			strings.Contains(r.URL.Path, "/"+viewPrefix+viewArchive+"/") {
 			fn(w, r)
 			return
 		}
@@ -192,117 +354,84 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 // to split apart the given path "p" into the containing repository,
 // file within that repository, whether that file is a directory, and
 // the appropriate http status. It will return g if "p" points to a
-// path within a git repository, such that g.Path is the top level of
-// that repository, and nil if it does not.
-func AnalyzePath(toplevel, p, ref string) (repository, file string, g *git, isDir bool, status int) {
-	toplevel, p = path.Clean(toplevel), path.Clean(p)
-
-	// l will be the length of the path which represents the
-	// repository level which is being checked.
-	l := len(p)
-
-	g = &git{}
-	// Loop through until the repository is set.
-	for {
-		g.Path = p[:l]
-		repository = g.TopLevel()
-
-		// If we encounter an error, such as the file not existing,
-		// then we modify l to move the path up one directory, and
-		// then, if the next path is appropriate, continue. If it is
-		// not, go on to the next check and allow it to return.
-		if len(repository) == 0 && l > len(toplevel) {
-			l = strings.LastIndex(g.Path, "/")
-			if l > len(toplevel) { // implies l != -1
-				continue
-			}
-		}
-
-		// If we do not encounter an error, but find the lowest level
-		// repository which we are in to be above the top level, then
-		// we must behave as if we did not find one.
-		if l < len(toplevel) || len(repository) < len(toplevel) {
-			repository = p
-			g = nil
-			status = http.StatusOK
-			return
+// path within a git repository, such that g.Dir() is the top level of
+// that repository, and nil if it does not. Access is checked for the
+// given user, which is blank if no one has logged in. If the status is
+// not http.StatusOK, err describes the reason.
+func AnalyzePath(root *Root, p, ref, user string) (repository, file string, g Repository, isDir bool, status int, err error) {
+	// Look up the repository containing the path in the registry. If
+	// there is none, then the path is an ordinary directory.
+	p = path.Clean(p)
+	repository, ok := registry.Find(root.Dir, p)
+	if !ok {
+		// The directory may still be refused by the access policy.
+		// Otherwise, its permissions are checked when it is listed.
+		if status, decided := root.Access(p, user); decided &&
+			status != http.StatusOK {
+			return "", "", nil, false, status, accessError(status)
 		}
+		return p, "", nil, false, http.StatusOK, nil
+	}
 
-		if len(repository) > 0 && len(repository) > len(toplevel) {
-			// If the repository was discovered, then we now have to
-			// check if we are allowed to serve the parent directory.
-			fi, err := os.Stat(repository)
-			if err != nil {
-				// An error at this point would imply that the server
-				// is in error.
-				status = http.StatusInternalServerError
-				return
-			}
-
-			// If all is well, check if it's servable.
-			if !CheckPerms(fi) {
-				// If not, 403 Forbidden.
-				status = http.StatusForbidden
-				return
-			}
-
-			// If it can be served, split off the rest of the path and
-			// set the file to be returned.
-			file = strings.TrimLeft(p[len(repository):], "/")
-			println(file)
-
-			// Next, check the status of the file. We must sanitize
-			// the ref, if possible.
-			if !g.RefExists(ref) {
-				ref = "HEAD"
-			}
-
-			isDir, err = g.IsDir(ref, file)
-			if err != nil {
-				// If there is an error at this point, the file
-				// probably does not exist at the given ref.
-				status = http.StatusNotFound
-			}
-
-			// Set up g so that it can used properly. Note that it is
-			// *not* reallocated from earlier.
-			g.Path = repository
+	// If the repository was discovered, then we now have to check if
+	// we are allowed to serve it.
+	if status, err = checkRepository(root, repository, user); err != nil {
+		return "", "", nil, false, status, err
+	}
+	rc := getRepoConfig(repository)
+
+	// If it can be served, split off the rest of the path and set the
+	// file to be returned. Open the repository with the selected
+	// backend so that it can be used properly.
+	file = strings.TrimLeft(p[len(repository):], "/")
+	g = openRepository(repository)
+
+	// Next, check that the ref exists, if one was given.
+	if len(ref) == 0 {
+		ref = rc.Ref()
+	} else if !g.RefExists(ref) {
+		return "", "", nil, false, http.StatusNotFound, RefNotFoundError
+	}
 
-			// If everything up to this point has been executed
-			// properly, we can set the status as OK and return.
-			status = http.StatusOK
-			return
+	// Then check the status of the file, unless the path selects a
+	// view rather than a file.
+	if view, _ := splitView(file); len(view) == 0 {
+		isDir, err = g.IsDir(ref, file)
+		if err != nil && len(file) == 0 && isUnborn(g, ref) {
+			// A repository without any commits yet is shown as an
+			// empty directory, rather than as missing.
+			isDir, err = true, nil
+		}
+		if err != nil {
+			// If there is an error at this point, the file probably
+			// does not exist at the given ref.
+			return "", "", nil, false, gitStatus(err), err
 		}
 	}
-	// Something is very wrong if we get here.
-	status = http.StatusInternalServerError
-	return
-}
 
-func CheckPerms(info os.FileInfo) (canServe bool) {
-	if strings.HasPrefix(info.Name(), ".") {
-		return false
-	}
-	return CheckPermBits(info)
+	// If everything up to this point has been executed properly, we
+	// can set the status as OK and return.
+	return repository, file, g, isDir, http.StatusOK, nil
 }
 
-func CheckPermBits(info os.FileInfo) (canServe bool) {
-	permBits := 0004
-	if info.IsDir() {
-		permBits = 0005
+// checkRepository determines whether the repository, which was found
+// within the root, may be served to the user, either according to the
+// access policy or the permission bits. Repositories which are hidden
+// by the configuration behave as if they do not exist.
+func checkRepository(root *Root, repository, user string) (status int, err error) {
+	fi, err := os.Stat(repository)
+	if err != nil {
+		// An error at this point would imply that the server is in
+		// error.
+		return http.StatusInternalServerError, err
 	}
-
-	// For example, consider the following:
-	//
-	//       rwl rwl rwl       r-l
-	//    0b 111 101 101 & (0b 101 << 3)  > 0
-	//    0b 111 101 101 & 0b 000 101 000 > 0
-	//    0b 000 101 000                  > 0
-	//    TRUE
-	//
-	// Thus, the file is readable and listable by the group, and
-	// therefore okay to serve.
-	return (info.Mode().Perm()&os.FileMode((permBits<<(Perms*3))) > 0)
+	if status = root.CanServe(repository, fi, user); status != http.StatusOK {
+		return status, accessError(status)
+	}
+	if getRepoConfig(repository).Hidden {
+		return http.StatusNotFound, notFound
+	}
+	return http.StatusOK, nil
 }
 
 // getTemplate uses the global variables templateFiles and *fRes to
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+)
+
+func TestAnalyzePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-analyze-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// "proj" has a single commit, "empty" has none at all, and "plain"
+	// is not a repository.
+	run := func(repo string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = path.Join(dir, repo)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s\n%s", args, err, out)
+		}
+	}
+	for _, repo := range []string{"proj", "empty", "plain"} {
+		if err = os.Mkdir(path.Join(dir, repo), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("proj", "init", "-q")
+	if err = os.Mkdir(path.Join(dir, "proj", "sub"), 0755); err == nil {
+		err = ioutil.WriteFile(path.Join(dir, "proj", "sub", "file"),
+			[]byte("grove\n"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("proj", "add", "sub")
+	run("proj", "commit", "-q", "-m", "Initial commit")
+	run("empty", "init", "-q")
+
+	root := &Root{Dir: dir}
+	tests := []struct {
+		p, ref     string
+		repository string
+		file       string
+		isDir      bool
+		status     int
+	}{
+		{"plain", "", "plain", "", false, http.StatusOK},
+		{"proj", "", "proj", "", true, http.StatusOK},
+		{"proj/sub", "", "proj", "sub", true, http.StatusOK},
+		{"proj/sub/file", "", "proj", "sub/file", false, http.StatusOK},
+		{"proj/-/tags", "", "proj", "-/tags", false, http.StatusOK},
+		{"proj/missing", "", "", "", false, http.StatusNotFound},
+		{"proj", "missing", "", "", false, http.StatusNotFound},
+		{"proj", "-p", "", "", false, http.StatusNotFound},
+		// A repository without commits is empty, but nothing may be
+		// found inside of it.
+		{"empty", "", "empty", "", true, http.StatusOK},
+		{"empty/file", "", "", "", false, http.StatusNotFound},
+		{"empty", "master", "", "", false, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		repository, file, _, isDir, status, err := AnalyzePath(root,
+			path.Join(dir, test.p), test.ref, "")
+		if len(test.repository) > 0 {
+			test.repository = path.Join(dir, test.repository)
+		}
+		if repository != test.repository || file != test.file ||
+			isDir != test.isDir || status != test.status {
+			t.Errorf("%s (ref %q): got %q, %q, %t, %d (%v); expected %q, %q, %t, %d",
+				test.p, test.ref, repository, file, isDir, status, err,
+				test.repository, test.file, test.isDir, test.status)
+		}
+	}
+}
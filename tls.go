@@ -0,0 +1,182 @@
+package main
+
+// Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Default locations of the certificate and key which are generated
+// by -tls-self-signed, if -tls-cert and -tls-key are not given.
+const (
+	selfSignedCert = "~/.config/grove/cert.pem"
+	selfSignedKey  = "~/.config/grove/key.pem"
+)
+
+// selfSignedValidity is how long a generated certificate is valid.
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// tlsEnabled returns true if the server is to use HTTPS.
+func tlsEnabled() bool {
+	return len(*fTLSCert) > 0 || len(*fTLSKey) > 0 || *fTLSSelfSigned
+}
+
+// tlsFiles determines the certificate and key files to serve with. If
+// -tls-self-signed is given and they do not exist yet, a self-signed
+// certificate is generated and written to them, so that it stays the
+// same from one start to the next.
+func tlsFiles() (cert, key string, err error) {
+	cert, key = expandHome(*fTLSCert), expandHome(*fTLSKey)
+	if !*fTLSSelfSigned {
+		if len(cert) == 0 || len(key) == 0 {
+			return "", "", fmt.Errorf("both -tls-cert and -tls-key " +
+				"must be given")
+		}
+		return cert, key, nil
+	}
+	if len(cert) == 0 {
+		cert = expandHome(selfSignedCert)
+	}
+	if len(key) == 0 {
+		key = expandHome(selfSignedKey)
+	}
+
+	_, certErr := os.Stat(cert)
+	_, keyErr := os.Stat(key)
+	switch {
+	case certErr == nil && keyErr == nil:
+		return cert, key, nil
+	case !os.IsNotExist(certErr) || !os.IsNotExist(keyErr):
+		// Only one exists, or they cannot be checked, so do not
+		// overwrite anything.
+		return "", "", fmt.Errorf("%q and %q must both exist or "+
+			"both be missing", cert, key)
+	}
+	fingerprint, err := generateCert(cert, key)
+	if err != nil {
+		return "", "", err
+	}
+	l.Noticef("Generated self-signed certificate %q with SHA-256 "+
+		"fingerprint %s\n", cert, fingerprint)
+	return cert, key, nil
+}
+
+// generateCert creates a self-signed certificate for this host and
+// writes it and its private key to the given files, in PEM format. It
+// returns the SHA-256 fingerprint of the certificate, so that users
+// can check it when they first connect.
+func generateCert(certFile, keyFile string) (fingerprint string, err error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"Grove"},
+			CommonName:   hostname,
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if ip := net.ParseIP(*fBind); ip != nil && !ip.IsUnspecified() {
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&priv.PublicKey, priv)
+	if err != nil {
+		return "", err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+
+	// The key is written first, and kept private, so that a
+	// certificate is never left without its key.
+	if err = os.MkdirAll(path.Dir(keyFile), 0700); err != nil {
+		return "", err
+	}
+	if err = writePEM(keyFile, "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(path.Dir(certFile), 0755); err != nil {
+		return "", err
+	}
+	if err = writePEM(certFile, "CERTIFICATE", der, 0644); err != nil {
+		os.Remove(keyFile)
+		return "", err
+	}
+	return fmt.Sprintf("%X", sha256.Sum256(der)), nil
+}
+
+// writePEM creates a file with the given permissions, which must not
+// already exist, and writes a single PEM block to it.
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// redirectHTTPS is a handler which sends every request to the same
+// URL over HTTPS, on the port being served.
+func redirectHTTPS(w http.ResponseWriter, req *http.Request) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.Trim(host, "[]")
+	}
+	if *fPort != "443" {
+		host = net.JoinHostPort(host, *fPort)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 address
+	}
+	http.Redirect(w, req, "https://"+host+req.URL.RequestURI(),
+		http.StatusMovedPermanently)
+}
+
+// requestScheme returns the scheme, "http" or "https", with which the
+// request was made, so that links to the server can use the same.
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGenerateCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := path.Join(dir, "config/cert.pem")
+	keyFile := path.Join(dir, "private/key.pem")
+
+	fingerprint, err := generateCert(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Failed to load generated pair: %s", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := fmt.Sprintf("%X", sha256.Sum256(cert.Raw)); f != fingerprint {
+		t.Errorf("got fingerprint %s, expected %s", fingerprint, f)
+	}
+	if err = cert.CheckSignature(cert.SignatureAlgorithm,
+		cert.RawTBSCertificate, cert.Signature); err != nil {
+		t.Errorf("Certificate is not self-signed: %s", err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err = cert.VerifyHostname(host); err != nil {
+			t.Errorf("%s: %s", host, err)
+		}
+	}
+	// A client which is given the certificate, as git is with
+	// http.sslCAInfo, should trust the server.
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{pair}}
+	srv.StartTLS()
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := client.Get(srv.URL); err != nil {
+		t.Errorf("Client does not trust the certificate: %s", err)
+	} else {
+		resp.Body.Close()
+	}
+
+	if fi, err := os.Stat(keyFile); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("Key is not private: %v, %v", fi.Mode(), err)
+	}
+
+	// Existing files are never overwritten.
+	if _, err = generateCert(certFile, keyFile); err == nil {
+		t.Errorf("Generated a certificate over an existing one")
+	}
+	if again, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil ||
+		string(again.Certificate[0]) != string(pair.Certificate[0]) {
+		t.Errorf("Existing certificate was changed: %v", err)
+	}
+}
+
+func TestTLSFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-tls-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := path.Join(dir, "cert.pem"), path.Join(dir, "key.pem")
+	if _, err = generateCert(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	missing := path.Join(dir, "missing.pem")
+
+	defer func(cert, key string, selfSigned bool) {
+		*fTLSCert, *fTLSKey, *fTLSSelfSigned = cert, key, selfSigned
+	}(*fTLSCert, *fTLSKey, *fTLSSelfSigned)
+	tests := []struct {
+		cert, key  string
+		selfSigned bool
+		ok         bool
+	}{
+		{certFile, keyFile, false, true},
+		{certFile, "", false, false},
+		{"", keyFile, false, false},
+		// Existing files are used as they are, but if only one of
+		// them exists, neither is generated.
+		{certFile, keyFile, true, true},
+		{certFile, missing, true, false},
+		{missing, keyFile, true, false},
+	}
+	for _, test := range tests {
+		*fTLSCert, *fTLSKey, *fTLSSelfSigned = test.cert, test.key,
+			test.selfSigned
+		cert, key, err := tlsFiles()
+		if (err == nil) != test.ok {
+			t.Errorf("%q, %q (self-signed: %t): got error %v",
+				test.cert, test.key, test.selfSigned, err)
+		} else if test.ok && (cert != test.cert || key != test.key) {
+			t.Errorf("%q, %q (self-signed: %t): got %q, %q",
+				test.cert, test.key, test.selfSigned, cert, key)
+		}
+	}
+	if _, err = os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("%s was created", missing)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	defer func(port string) { *fPort = port }(*fPort)
+	tests := []struct {
+		host, port, expected string
+	}{
+		{"example.com", "443", "https://example.com/proj/?ref=v1"},
+		{"example.com:80", "443", "https://example.com/proj/?ref=v1"},
+		{"example.com:8080", "8443", "https://example.com:8443/proj/?ref=v1"},
+		{"10.0.0.1", "8443", "https://10.0.0.1:8443/proj/?ref=v1"},
+		{"[::1]:80", "443", "https://[::1]/proj/?ref=v1"},
+		{"[::1]", "8443", "https://[::1]:8443/proj/?ref=v1"},
+	}
+	for _, test := range tests {
+		*fPort = test.port
+		req := httptest.NewRequest("GET", "/proj/?ref=v1", nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		redirectHTTPS(w, req)
+		if w.Code != http.StatusMovedPermanently ||
+			w.Header().Get("Location") != test.expected {
+			t.Errorf("%s on port %s: got %d to %q, expected %q",
+				test.host, test.port, w.Code,
+				w.Header().Get("Location"), test.expected)
+		}
+	}
+}
+
+func TestRequestScheme(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	if scheme := requestScheme(req); scheme != "http" {
+		t.Errorf("got %q for HTTP", scheme)
+	}
+	req = httptest.NewRequest("GET", "https://example.com/", nil)
+	if scheme := requestScheme(req); scheme != "https" {
+		t.Errorf("got %q for HTTPS", scheme)
+	}
+}
@@ -3,12 +3,15 @@ package main
 // Copyright ⓒ 2013 Alexander Bauer and Luke Evers (see LICENSE.md)
 
 import (
+	"bytes"
 	"encoding/base64"
 	"errors"
 	"github.com/russross/blackfriday"
 	"html"
 	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
@@ -16,25 +19,38 @@ import (
 )
 
 type pageinfo struct {
-	Prefix     string // URL prefix to be prepended
-	Owner      string
-	InRepoPath string
-	URL        string
-	GitDir     string
-	Branch     string
-	Branches   []string
-	RootLink   string
-	TagNum     string
-	Path       string
-	CommitNum  string
-	SHA        string
-	Content    template.HTML
-	List       []*dirList
-	Logs       []*gitLog
-	Version    string
-	Query      template.URL
-	Status     string
-	Theme      string
+	Prefix      string // URL prefix to be prepended
+	Owner       string
+	InRepoPath  string
+	File        string // Path within the repository
+	Ref         string // Requested ref
+	URL         string
+	GitDir      string
+	Branch      string
+	Branches    []string
+	Description string // Description of the repository
+	RootLink    string
+	TagNum      string
+	Path        string
+	CommitNum   string
+	SHA         string
+	Content     template.HTML
+	List        []*dirList
+	Index       []*RepoSummary // Repositories within a directory
+	Sort        string         // Order of the index
+	Logs        []*gitLog
+	Commit      *commitView
+	Compare     *compareView
+	Diffs       []*diffView
+	Blame       []*blameView
+	Search      *searchView
+	Refs        *refsView
+	More        template.URL // Query to load more of the log
+	Filter      *LogFilter   // Restrictions on the log, if any
+	Version     string
+	Query       template.URL
+	Status      string
+	Theme       string
 }
 
 type gitLog struct {
@@ -46,6 +62,51 @@ type gitLog struct {
 	IsOwner bool
 }
 
+type commitView struct {
+	*CommitInfo
+	Body      template.HTML
+	Additions int // Total lines added across all files
+	Deletions int // Total lines removed across all files
+}
+
+type compareView struct {
+	From      string // Base of the comparison
+	To        string // Tip of the comparison
+	Additions int    // Total lines added across all files
+	Deletions int    // Total lines removed across all files
+}
+
+type diffView struct {
+	*FileDiff
+	Name    string // Display name, such as "old -> new" for renames
+	Content template.HTML
+}
+
+type blameView struct {
+	*BlameLine
+	Time  string // Relative time of authorship
+	First bool   // True if this is the first line from the commit
+}
+
+type searchView struct {
+	*GrepQuery
+	Ref     string // Ref searched, or blank if searching the grove
+	Results []*searchResultView
+	More    template.URL // Query to show more results
+}
+
+type searchResultView struct {
+	*SearchResult
+	Link    string        // File page, at the matching line
+	Content template.HTML // Text with each match highlighted
+}
+
+type refsView struct {
+	Kind string // "Branches" or "Tags"
+	Base string // Default branch, to which the refs are compared
+	Refs []*Ref
+}
+
 type dirList struct {
 	URL   template.URL
 	Name  string
@@ -58,27 +119,82 @@ const (
 	defaultCommits = 10     // Default number of commits to show
 )
 
+// Views are pages other than the file browser, such as
+// "/repo/-/commit/<sha>". They are found beneath viewPrefix, rather
+// than immediately inside of the repository, so that they do not hide
+// directories with the same names. A directory named "-" is all that
+// they can collide with.
+const (
+	viewPrefix = "-/"
+
+	viewTree     = "tree"
+	viewCommit   = "commit"
+	viewCompare  = "compare"
+	viewSearch   = "search"
+	viewBranches = "branches"
+	viewTags     = "tags"
+	viewArchive  = "archive"
+)
+
+var views = map[string]bool{
+	viewTree:     true,
+	viewCommit:   true,
+	viewCompare:  true,
+	viewSearch:   true,
+	viewBranches: true,
+	viewTags:     true,
+	viewArchive:  true,
+}
+
+// archiveFormats lists the extensions of the archives which can be
+// downloaded, along with the format in which git archive produces
+// each, and its Content-Type.
+var archiveFormats = []struct {
+	Ext, Format, ContentType string
+}{
+	{".tar.gz", "tar.gz", "application/gzip"},
+	{".zip", "zip", "application/zip"},
+}
+
 var (
 	internalServerError = errors.New(
 		http.StatusText(http.StatusInternalServerError))
+	unauthorized = errors.New(
+		http.StatusText(http.StatusUnauthorized))
 	forbidden = errors.New(
 		http.StatusText(http.StatusForbidden))
 	notFound = errors.New(
 		http.StatusText(http.StatusNotFound))
 )
 
+// gitStatus determines the appropriate HTTP status for an error
+// returned by a git method.
+func gitStatus(err error) int {
+	switch ErrorKind(err) {
+	case nil:
+		return http.StatusOK
+	case RefNotFoundError, PathNotFoundError:
+		return http.StatusNotFound
+	case InvalidRefError, InvalidPatternError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // MakePage acts as a multiplexer for the various complex http
 // functions. It handles logging and web error reporting.
-func MakePage(w http.ResponseWriter, req *http.Request, g *git, repository string, file string, isDir bool) {
+func MakePage(w http.ResponseWriter, req *http.Request, root *Root, g Repository, repository string, file string, isDir bool, remoteUser string) {
 	// First, establish the template and fill out some of the pageinfo.
 	pi := &pageinfo{
 		Prefix:     *fPrefix,
 		Owner:      user,
 		InRepoPath: path.Join(path.Base(repository), file),
-		Path:       repository[len(handler.Dir):] + "/", // Path without in-git
+		File:       file,
+		Path:       root.URLPath() + repository[len(root.Dir):] + "/", // Path without in-git
 		Version:    Version,
 		Theme:      *fTheme,
-		RootLink:   "http://" + req.Host,
+		RootLink:   requestScheme(req) + "://" + req.Host,
 	}
 
 	pi.URL = *fPrefix + strings.TrimRight(
@@ -90,38 +206,56 @@ func MakePage(w http.ResponseWriter, req *http.Request, g *git, repository strin
 		pi.Query = template.URL("?" + req.URL.RawQuery)
 	}
 
+	// maxCommits is the maximum number of commits to be loaded via the
+	// log.
+	maxCommits := formCommits(req)
+	filter := formFilter(req)
+	var err error
+
 	// Now, check if the given directory is a git repository, and if
 	// so, parse some of the possible http forms.
 	var ref string
-	var maxCommits int
-	var raw bool
+	var raw, blame, history bool
 	if g != nil {
-		// ref is the git commit reference. If the form is not submitted,
-		// (or is invalid), it is set to "HEAD".
+		// ref is the git commit reference. If the form is not
+		// submitted, it is set to the default branch of the
+		// repository, or "HEAD". AnalyzePath has already reported
+		// refs which do not exist.
+		rc := getRepoConfig(repository)
 		ref = req.FormValue("ref")
-		if len(ref) == 0 || !g.RefExists(ref) {
-			ref = "HEAD" // The commit or branch reference
+		if len(ref) == 0 {
+			ref = rc.Ref() // The commit or branch reference
 		}
+		pi.Ref = ref
+		pi.Description = rc.Description
 
 		// The form value since is just a shortcut for
 		// "?ref=<ref>..<since>", so we check it here. Note that the
 		// results will include <ref> and exclude <since>.
-		if since := req.FormValue("since"); g.RefExists(since) {
+		if since := req.FormValue("since"); len(since) > 0 {
+			if !g.RefExists(since) {
+				l.Debugf("View of %q from %q requested missing ref %q\n",
+					req.URL.Path, req.RemoteAddr, since)
+				Error(w, http.StatusNotFound)
+				return
+			}
+			pi.Compare = &compareView{From: since, To: ref}
 			ref = since + ".." + ref
 		}
 
-		// maxCommits is the maximum number of commits to be loaded via
-		// the log.
-		var err error
-		maxCommits, err = strconv.Atoi(req.FormValue("c"))
-		if err != nil {
-			maxCommits = 10
-		}
 
 		// raw is whether or not to display the file (if serving a
-		// file) in the raw form.
+		// file) in the raw form, and blame is whether to annotate
+		// each line with the commit that last changed it.
 		if !isDir {
 			_, raw = req.Form["raw"]
+			_, blame = req.Form["blame"]
+		}
+
+		// history is whether to show the log of the commits which
+		// affected the file or directory, rather than its contents.
+		if view, _ := splitView(file); len(view) == 0 && len(file) > 0 {
+			_, history = req.Form["log"]
 		}
 
 		// Now, switch to using the API if it is requested. We access
@@ -129,7 +263,35 @@ func MakePage(w http.ResponseWriter, req *http.Request, g *git, repository strin
 		// case, we would fall back to checking the Accept field in
 		// the header.)
 		if _, useAPI := req.Form["api"]; useAPI {
-			err = ServeAPI(w, req, g, ref, maxCommits)
+			var logFile string
+			if history {
+				logFile = file
+			}
+			// Directories and files give their contents, unless
+			// their log or a feed is requested.
+			contents := !history && !requestsFeed(req)
+			view, arg := splitView(file)
+			switch {
+			case view == viewCompare:
+				err = ServeCompareAPI(w, req, g, pi.Path, arg,
+					maxCommits)
+			case view == viewSearch:
+				err = ServeSearchAPI(w, req, g, pi.Path, ref,
+					formQuery(req), formResults(req))
+			case view == viewBranches:
+				err = ServeRefsAPI(w, req, g, refsBranches)
+			case view == viewTags:
+				err = ServeRefsAPI(w, req, g, refsTags)
+			case view == viewTree && contents:
+				err = ServeTreeAPI(w, req, g, ref, arg)
+			case len(view) == 0 && len(file) > 0 && contents && isDir:
+				err = ServeTreeAPI(w, req, g, ref, file)
+			case len(view) == 0 && len(file) > 0 && contents:
+				err = ServeBlobAPI(w, req, g, ref, file)
+			default:
+				err = ServeAPI(w, req, g, pi.Path, ref, logFile,
+					filter, maxCommits)
+			}
 			if err != nil {
 				l.Errf("API request %q from %q failed: %s",
 					req.URL, req.RemoteAddr, err)
@@ -140,36 +302,114 @@ func MakePage(w http.ResponseWriter, req *http.Request, g *git, repository strin
 			return
 		}
 
-		pi.Branch = g.Branch("HEAD")
-		pi.TagNum = strconv.Itoa(len(g.Tags()))
-		pi.CommitNum = strconv.Itoa(g.TotalCommits())
-		pi.SHA = g.SHA(ref)
-		pi.GitDir = ".git" // This may be worth removing.
+		err = fillRepoInfo(pi, g, ref)
+		if err != nil {
+			l.Errf("View of %q from %q caused error: %s",
+				req.URL.Path, req.RemoteAddr, err)
+			Error(w, gitStatus(err))
+			return
+		}
+	} else if _, useAPI := req.Form["api"]; useAPI {
+		// Directories which are not repositories serve the activity
+		// of all of the repositories within them, or their index.
+		if status := root.CanList(repository,
+			remoteUser); status != http.StatusOK {
+			Error(w, status)
+			return
+		}
+		_, index := req.Form["index"]
+		_, search := req.Form["search"]
+		switch {
+		case search:
+			err = ServeGroveSearchAPI(w, req, []*Root{root}, repository,
+				remoteUser, formQuery(req), formResults(req))
+		case index:
+			err = ServeIndexAPI(w, req, []*Root{root}, repository,
+				pi.Path, remoteUser, req.FormValue("sort"))
+		default:
+			err = ServeGroveAPI(w, req, []*Root{root}, repository,
+				pi.Path, remoteUser, filter, maxCommits)
+		}
+		if err != nil {
+			l.Errf("API request %q from %q failed: %s",
+				req.URL, req.RemoteAddr, err)
+		} else {
+			l.Debugf("API request %q from %q\n",
+				req.URL, req.RemoteAddr)
+		}
+		return
 	}
 
-	var err error
 	var status int
+	view, arg := splitView(file)
+	_, search := req.Form["search"]
 	switch {
+	case g == nil && search:
+		// This will catch searches of all of the repositories within
+		// a directory.
+		err, status = MakeGroveSearchPage(w, pi, []*Root{root},
+			repository, remoteUser, formQuery(req), formResults(req))
+	case g == nil && showIndex(req, root, repository):
+		// This will catch requests for the index of the repositories
+		// within a directory, which is also the main page of a root.
+		err, status = MakeIndexPage(w, pi, []*Root{root}, repository,
+			remoteUser, req.FormValue("sort"))
 	case g == nil:
-		// This will catch all non-git cases, eliminating the need for
-		// them below.
-		err, status = MakeDirPage(w, pi, repository)
+		// This will catch all other non-git cases, eliminating the
+		// need for them below.
+		err, status = MakeDirPage(w, pi, root, repository, remoteUser)
+	case len(file) == 0:
+		// This will catch cases serving the main page of a repository
+		// directory.
+		err, status = MakeGitPage(w, pi, g, ref, file, filter,
+			maxCommits)
+	case view == viewTree:
+		// This will catch the tree view, which is linked from the
+		// main page of a repository.
+		pi.File = arg
+		err, status = MakeTreePage(w, pi, g, ref, arg)
+	case view == viewCommit:
+		// This will catch cases needing to serve a single commit.
+		err, status = MakeCommitPage(w, pi, g, arg)
+	case view == viewCompare:
+		// This will catch cases needing to compare two refs.
+		err, status = MakeComparePage(w, pi, g, arg, maxCommits)
+	case view == viewBranches:
+		// This will catch the list of branches.
+		err, status = MakeRefsPage(w, pi, g, refsBranches)
+	case view == viewTags:
+		// This will catch the list of tags.
+		err, status = MakeRefsPage(w, pi, g, refsTags)
+	case view == viewArchive:
+		// This will catch downloads of archives of a ref.
+		err, status = MakeArchivePage(w, req, g, path.Base(repository),
+			arg, req.FormValue("path"))
+	case view == viewSearch:
+		// This will catch searches of the files of a ref.
+		err, status = MakeSearchPage(w, pi, g, ref, formQuery(req),
+			formResults(req))
+	case history:
+		// This will catch cases needing to show the log of a file or
+		// directory.
+		err, status = MakeHistoryPage(w, pi, g, ref, file, filter,
+			maxCommits)
 	case isDir:
 		// This will catch cases needing to serve directories within
 		// git repositories.
 		err, status = MakeTreePage(w, pi, g, ref, file)
+	case !isDir && blame:
+		// This will catch cases needing to annotate files.
+		err, status = MakeBlamePage(w, pi, g, ref, file)
 	case !isDir && !raw:
 		// This will catch cases needing to serve files.
 		err, status = MakeFilePage(w, pi, g, ref, file)
 	case !isDir && raw:
-		// This will catch cases needing to serve files directly.
+		// This will catch cases needing to serve files directly. If
+		// the ref is a full SHA, then the file can never change.
+		if isFullSHA(ref) && setImmutable(w, req, ref+":"+file) {
+			break
+		}
 		err, status = MakeRawPage(w, file, ref, g)
-	case g != nil:
-		// This will catch cases serving the main page of a repository
-		// directory. This needs to be last because the above cases
-		// for "tree" and "blob" will also have `git` as true.
-		println("here2")
-		err, status = MakeGitPage(w, pi, g, ref, file, maxCommits)
 	default:
 		// If this case is reached, report an error page.
 		err = errors.New("reached default case")
@@ -188,6 +428,147 @@ func MakePage(w http.ResponseWriter, req *http.Request, g *git, repository strin
 	}
 }
 
+// showIndex returns true if the index of the repositories within the
+// given directory should be shown instead of its listing. This is the
+// case if it is requested with "?index", or if the directory is the
+// top of the root and the listing is not requested with "?dirs".
+func showIndex(req *http.Request, root *Root, directory string) bool {
+	if _, index := req.Form["index"]; index {
+		return true
+	}
+	_, dirs := req.Form["dirs"]
+	return directory == root.Dir && !dirs
+}
+
+// formCommits retrieves the maximum number of commits to show from the
+// form, or the default if it is not given.
+func formCommits(req *http.Request) int {
+	maxCommits, err := strconv.Atoi(req.FormValue("c"))
+	if err != nil {
+		return defaultCommits
+	}
+	return maxCommits
+}
+
+// formFilter reads a filter for the log from the form. The fields
+// author, committer, and grep are regular expressions, after and
+// before are dates, and path is a path within the repository. If none
+// of them are given, it returns nil.
+func formFilter(req *http.Request) *LogFilter {
+	f := &LogFilter{
+		Author:    req.FormValue("author"),
+		Committer: req.FormValue("committer"),
+		Grep:      req.FormValue("grep"),
+		After:     req.FormValue("after"),
+		Before:    req.FormValue("before"),
+		Path:      strings.Trim(req.FormValue("path"), "/"),
+	}
+	if *f == (LogFilter{}) {
+		return nil
+	}
+	return f
+}
+
+// filterValues produces the form fields which select the filter, which
+// may be nil.
+func filterValues(f *LogFilter) url.Values {
+	v := url.Values{}
+	if f == nil {
+		return v
+	}
+	for name, value := range map[string]string{
+		"author":    f.Author,
+		"committer": f.Committer,
+		"grep":      f.Grep,
+		"after":     f.After,
+		"before":    f.Before,
+		"path":      f.Path,
+	} {
+		if len(value) > 0 {
+			v.Set(name, value)
+		}
+	}
+	return v
+}
+
+// logCommits retrieves the log of the given ref, up to max commits. If
+// f is not nil, only the commits which pass it are included.
+func logCommits(g Repository, ref string, f *LogFilter, max int) (commits []*Commit, err error) {
+	if f == nil {
+		return g.Commits(ref, max)
+	}
+	return g.CommitsMatching(ref, f, max)
+}
+
+// fileFilter restricts the filter f, which may be nil, to the commits
+// which affected the file, following it through renames.
+func fileFilter(f *LogFilter, file string) *LogFilter {
+	ff := &LogFilter{}
+	if f != nil {
+		*ff = *f
+	}
+	ff.Path, ff.Follow = file, true
+	return ff
+}
+
+// fillRepoInfo fills out the fields of the pageinfo which describe the
+// repository as a whole, and which are shown at the top of every page
+// within it.
+func fillRepoInfo(pi *pageinfo, g Repository, ref string) (err error) {
+	if isUnborn(g, ref) {
+		// There is no branch, tag, or commit to describe.
+		pi.TagNum, pi.CommitNum = "0", "0"
+		pi.GitDir = ".git"
+		return nil
+	}
+	if pi.Branch, err = g.Branch("HEAD"); err != nil {
+		return
+	}
+	tags, err := g.Tags()
+	if err != nil {
+		return
+	}
+	commits, err := g.TotalCommits()
+	if err != nil {
+		return
+	}
+	if pi.SHA, err = g.SHA(ref); err != nil {
+		return
+	}
+	pi.TagNum = strconv.Itoa(len(tags))
+	pi.CommitNum = strconv.Itoa(commits)
+	pi.GitDir = ".git" // This may be worth removing.
+	return
+}
+
+// isUnborn reports whether ref is HEAD, and HEAD names a branch which
+// has no commits yet, such as in a repository which has only just
+// been created.
+func isUnborn(g Repository, ref string) bool {
+	if ref != defaultRef {
+		return false
+	}
+	_, err := g.Resolve(ref)
+	return ErrorKind(err) == RefNotFoundError
+}
+
+// splitView separates the given path within a repository into a view
+// and its argument, if the path begins with viewPrefix and one of the
+// views. Otherwise, view is blank.
+func splitView(file string) (view, arg string) {
+	if !strings.HasPrefix(file, viewPrefix) {
+		return "", file
+	}
+	parts := strings.SplitN(file[len(viewPrefix):], "/", 2)
+	if !views[parts[0]] {
+		return "", file
+	}
+	if len(parts) == 2 {
+		arg = strings.Trim(parts[1], "/")
+	}
+	return parts[0], arg
+}
+
 // Error reports an error of the given status to the given http
 // connection using http.StatusText().
 func Error(w http.ResponseWriter, status int) {
@@ -198,6 +579,7 @@ func Error(w http.ResponseWriter, status int) {
 		Theme:   *fTheme,
 	}
 
+	w.WriteHeader(status)
 	t.ExecuteTemplate(w, "error.html", pi)
 }
 
@@ -213,11 +595,11 @@ func MakeAboutPage(w http.ResponseWriter) {
 
 // MakeRawPAge makes the raw page of which the files are shown as
 // completely raw files.
-func MakeRawPage(w http.ResponseWriter, file, ref string, g *git) (err error, status int) {
-	f := g.GetFile(ref, file)
-	if len(f) == 0 {
+func MakeRawPage(w http.ResponseWriter, file, ref string, g Repository) (err error, status int) {
+	f, err := g.GetFile(ref, file)
+	if err != nil {
 		// If the file is not retrieved from git, return the error.
-		return notFound, http.StatusNotFound
+		return err, gitStatus(err)
 	}
 	// If it is found, write the contents to the connection directly.
 	w.Write(f)
@@ -227,16 +609,17 @@ func MakeRawPage(w http.ResponseWriter, file, ref string, g *git) (err error, st
 // MakeDirPage makes filesystem directory listings, which are not
 // contained within git projects. It writes the webpage to the
 // provided http.ResponseWriter.
-func MakeDirPage(w http.ResponseWriter, pi *pageinfo, directory string) (err error, status int) {
+func MakeDirPage(w http.ResponseWriter, pi *pageinfo, root *Root, directory, remoteUser string) (err error, status int) {
+	// First, check that the user may see the directory. The root
+	// itself is always served.
+	if status = root.CanList(directory, remoteUser); status != http.StatusOK {
+		return accessError(status), status
+	}
 	// Open the file so that it can be read.
 	f, err := os.Open(directory)
 	if err != nil {
 		return err, http.StatusNotFound
 	}
-	// If there is no error, check the permissions of the directory.
-	if fi, err := f.Stat(); err != nil && !CheckPerms(fi) {
-		return forbidden, http.StatusForbidden
-	}
 
 	// Now get the list of directory names. This is used to size
 	// pi.List. Note that we use f.Readdirnames( rather than
@@ -266,11 +649,14 @@ func MakeDirPage(w http.ResponseWriter, pi *pageinfo, directory string) (err err
 	}
 
 	// We have the directory names; go on to calling os.Stat() and
-	// checking their permissions. If appropriate, add them to the
-	// list.
+	// checking whether the user may see them. If appropriate, add them
+	// to the list.
 	for _, name := range dirnames {
-		info, err := os.Stat(directory + "/" + name)
-		if err == nil && CheckPerms(info) {
+		p := path.Join(directory, name)
+		info, err := os.Stat(p)
+		if err == nil &&
+			root.CanServe(p, info, remoteUser) == http.StatusOK &&
+			!getRepoConfig(p).Hidden {
 			pi.List = append(pi.List, &dirList{
 				URL: template.URL(*fPrefix + pi.Path +
 					info.Name() + "/"),
@@ -285,15 +671,59 @@ func MakeDirPage(w http.ResponseWriter, pi *pageinfo, directory string) (err err
 		http.StatusInternalServerError
 }
 
+// MakeIndexPage shows the repositories which the user may see within
+// the given directory, or if it is blank, within each of the given
+// roots, along with a summary of each, sorted in the given order. It
+// writes the webpage to the provided http.ResponseWriter.
+func MakeIndexPage(w http.ResponseWriter, pi *pageinfo, rs []*Root, directory, remoteUser, order string) (err error, status int) {
+	if order != sortName {
+		order = sortActivity
+	}
+	pi.Sort = order
+	pi.Index = indexRepositories(rs, directory, pi.Path, remoteUser,
+		order)
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "index.html", pi),
+		http.StatusInternalServerError
+}
+
+// rootsPageInfo produces the pageinfo for the top level when the roots
+// have names.
+func rootsPageInfo() *pageinfo {
+	return &pageinfo{
+		Prefix:  *fPrefix,
+		Owner:   user,
+		Path:    "/",
+		Version: Version,
+		Theme:   *fTheme,
+	}
+}
+
+// MakeRootsPage lists the roots being served, for the top level when
+// they have names. It writes the webpage to the provided
+// http.ResponseWriter.
+func MakeRootsPage(w http.ResponseWriter) (err error) {
+	pi := rootsPageInfo()
+	pi.List = make([]*dirList, len(roots))
+	for n, r := range roots {
+		pi.List[n] = &dirList{
+			URL:  template.URL(*fPrefix + r.URLPath() + "/"),
+			Name: r.Name,
+		}
+	}
+	return t.ExecuteTemplate(w, "dir.html", pi)
+}
+
 // MakeFilePage shows the contents of a file within a git project. It
 // writes the webpage to the provided http.ResponseWriter.
-func MakeFilePage(w http.ResponseWriter, pi *pageinfo, g *git, ref string, file string) (err error, status int) {
-	// First we need to get the file's contents. Note that it will be
-	// a []byte here.
-	fileContents := g.GetFile(ref, file)
-	if len(fileContents) == 0 {
-		// If there is no content, return an error.
-		return notFound, http.StatusNotFound
+func MakeFilePage(w http.ResponseWriter, pi *pageinfo, g Repository, ref string, file string) (err error, status int) {
+	// First we need to get the file's contents, in the same way as
+	// the API. Note that it will be a []byte here.
+	blob, fileContents, err := readBlob(g, ref, file)
+	if err != nil {
+		return err, gitStatus(err)
 	}
 
 	var contents string
@@ -306,11 +736,20 @@ func MakeFilePage(w http.ResponseWriter, pi *pageinfo, g *git, ref string, file
 		contents = "<img src=\"data:image/" + strings.TrimLeft(extention, ".") +
 			";base64," + base64.StdEncoding.EncodeToString(fileContents) +
 			"\"/>"
+	} else if blob.Binary {
+		// Other binary files can only be viewed raw.
+		contents = "<p>Binary file, " +
+			strconv.FormatInt(blob.Size, 10) + " bytes</p>"
 	} else {
-		lang := strings.Split(file, ".")
-		contents += "<code data-language=\""+lang[len(lang)-1]+"\">"
-		contents += html.EscapeString(string(fileContents))
-		contents += "</code>"
+		// Otherwise, highlight it according to its language, which
+		// is detected from its contents and name. Languages which
+		// Grove does not know are left to rainbow.js.
+		if lang := detectLanguage(file, fileContents); lang != nil {
+			contents = string(highlight(string(fileContents), lang))
+		} else {
+			contents = string(numberLines(string(fileContents),
+				rainbowLanguage(file)))
+		}
 	}
 
 	pi.Content = template.HTML(contents)
@@ -323,77 +762,516 @@ func MakeFilePage(w http.ResponseWriter, pi *pageinfo, g *git, ref string, file
 }
 
 // MakeGitPage shows the "front page" that is the main directory of a
-// git reposiory, including the README and a directory listing. It
-// writes the webpage to the provided http.ResponseWriter.
-func MakeGitPage(w http.ResponseWriter, pi *pageinfo, g *git, ref, file string, maxCommits int) (err error, status int) {
+// git reposiory, including the README and a directory listing. If f is
+// not nil, the log only includes the commits which pass it. It writes
+// the webpage to the provided http.ResponseWriter.
+func MakeGitPage(w http.ResponseWriter, pi *pageinfo, g Repository, ref, file string, f *LogFilter, maxCommits int) (err error, status int) {
 	// Get the Grove owner's email from the repository configuration.
-	ownerEmail := g.Email()
+	ownerEmail, err := g.Email()
+	if err != nil {
+		return err, gitStatus(err)
+	}
+
+	// Parse the log to retrieve the commits, unless there are none.
+	var commits []*Commit
+	unborn := isUnborn(g, ref)
+	if !unborn {
+		if commits, err = logCommits(g, ref, f, maxCommits); err != nil {
+			return err, gitStatus(err)
+		}
+	}
+	pi.Logs = makeGitLogs(commits, ownerEmail)
+	pi.Filter = f
+
+	// Grab the list of branches.
+	if pi.Branches, err = g.Branches(); err != nil {
+		return err, gitStatus(err)
+	}
+
+	if len(file) == 0 && !unborn {
+		if pi.Content, err = renderReadme(g, ref, file); err != nil {
+			return err, gitStatus(err)
+		}
+	}
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "gitpage.html", pi),
+		http.StatusInternalServerError
+}
+
+// renderReadme renders the README of the directory dir as of the
+// given ref, if one can be located. To locate it, it goes through a
+// list of possible names and uses the first one found. The result is
+// cached by the commit the ref resolves to and the directory, because
+// rendering can be slow.
+func renderReadme(g Repository, ref, dir string) (content template.HTML, err error) {
+	// Read the README from the resolved commit, so that it is the
+	// same one which the cache entry describes.
+	if sha, err := g.Resolve(ref); err == nil {
+		ref = sha
+	}
+	var key string
+	if objectCache != nil && isFullSHA(ref) {
+		key = "readme\x00" + g.Dir() + "\x00" + ref + "\x00" + dir
+		if v, ok := objectCache.Get(key); ok {
+			return v.(template.HTML), nil
+		}
+	}
 
-	// Parse the log to retrieve the commits.
-	commits := g.Commits(ref, maxCommits)
+	for _, fn := range []string{"README", "README.txt", "README.md"} {
+		readme, err := g.GetFile(ref, path.Join(dir, fn))
+		if err == nil {
+			content = template.HTML(blackfriday.MarkdownCommon(readme))
+			break
+		} else if ErrorKind(err) != PathNotFoundError {
+			return "", err
+		}
+	}
+	if len(key) > 0 {
+		objectCache.Add(key, content, len(content)+cacheEntryOverhead)
+	}
+	return content, nil
+}
 
-	pi.Logs = make([]*gitLog, len(commits))
-	for n, c := range commits {
+// makeGitLogs prepares a list of commits for display in a log,
+// marking those whose email matches that of the Grove owner.
+func makeGitLogs(commits []*Commit, ownerEmail string) (logs []*gitLog) {
+	logs = make([]*gitLog, 0, len(commits))
+	for _, c := range commits {
 		if len(c.SHA) == 0 {
 			// If, for some reason, the commit doesn't have content,
 			// skip it.
 			continue
 		}
 
-		pi.Logs[n] = &gitLog{
+		logs = append(logs, &gitLog{
 			Author:  c.Author,
 			SHA:     c.SHA,
 			Time:    c.Time,
 			Subject: template.HTML(html.EscapeString(c.Subject)),
 			Body:    template.HTML(strings.Replace(html.EscapeString(c.Body), "\n", "<br/>", -1)),
 			IsOwner: c.Email == ownerEmail,
+		})
+	}
+	return
+}
+
+// MakeTreePage makes directory listings from within git repositories.
+// It writes the webpage to the provided http.ResponseWriter.
+func MakeTreePage(w http.ResponseWriter, pi *pageinfo, g Repository, ref, file string) (err error, status int) {
+	// Retrieve the entries of the directory from the repository, in
+	// the same way as the API. If it is not a directory, this reports
+	// that the path was not found.
+	entries, err := g.Tree(ref, file)
+	if err != nil && len(file) == 0 && isUnborn(g, ref) {
+		// The top level of a repository without commits is empty.
+		entries, err = nil, nil
+	}
+	if err != nil {
+		return err, gitStatus(err)
+	}
+
+	pi.List = make([]*dirList, len(entries))
+	for n, e := range entries {
+		name := e.Name
+		if e.Type == "tree" {
+			name += "/"
+		}
+		pi.List[n] = &dirList{
+			Name: name,
+			Link: path.Join(file, e.Name),
 		}
 	}
 
-	// Grab the list of branches.
-	pi.Branches = g.Branches()
-
-	if len(file) == 0 {
-		// Load the README if it can be located. To locate, go through
-		// a list of possible names and break the loop at the first
-		// one.
-		for _, fn := range []string{"README", "README.txt", "README.md"} {
-			readme := g.GetFile(ref, fn)
-			if len(readme) != 0 {
-				pi.Content = template.HTML(
-					blackfriday.MarkdownCommon(readme))
-				break
-			}
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "tree.html", pi),
+		http.StatusInternalServerError
+}
+
+// MakeCommitPage shows a single commit, including its parents, author
+// and committer, and the diff that it introduces. It writes the
+// webpage to the provided http.ResponseWriter.
+func MakeCommitPage(w http.ResponseWriter, pi *pageinfo, g Repository, ref string) (err error, status int) {
+	info, err := g.Show(ref)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+
+	pi.Commit = &commitView{
+		CommitInfo: info,
+		Body: template.HTML(strings.Replace(
+			html.EscapeString(info.Body), "\n", "<br/>", -1)),
+	}
+	pi.Diffs = makeDiffViews(info.Diffs)
+	for _, d := range info.Diffs {
+		pi.Commit.Additions += d.Additions
+		pi.Commit.Deletions += d.Deletions
+	}
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "commit.html", pi),
+		http.StatusInternalServerError
+}
+
+// makeDiffViews prepares a list of FileDiffs for display, rendering
+// each patch as HTML.
+func makeDiffViews(diffs []*FileDiff) (views []*diffView) {
+	views = make([]*diffView, len(diffs))
+	for n, d := range diffs {
+		views[n] = &diffView{
+			FileDiff: d,
+			Name:     d.NewPath,
+		}
+		file := d.NewPath
+		switch {
+		case len(d.NewPath) == 0:
+			views[n].Name = d.OldPath
+			file = d.OldPath
+		case len(d.OldPath) != 0 && d.OldPath != d.NewPath:
+			views[n].Name = d.OldPath + " → " + d.NewPath
+		}
+		// Only the name of the file is available to determine its
+		// language.
+		views[n].Content = renderDiff(d.Patch, detectLanguage(file, nil))
+	}
+	return
+}
+
+// renderDiff escapes the hunks of a diff for HTML, and wraps each
+// added, removed, and hunk header line in a span with an appropriate
+// class, so that the themes can style them. If lang is not nil, the
+// code on each line is highlighted as well. Lines are highlighted one
+// at a time, because a hunk may begin or end partway through a comment
+// or string.
+func renderDiff(patch string, lang *language) template.HTML {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(patch, "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		var class string
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			class = "diff-hunk"
+		case line[0] == '+':
+			class = "diff-add"
+		case line[0] == '-':
+			class = "diff-del"
+		}
+		if len(class) > 0 {
+			buf.WriteString("<span class=\"" + class + "\">")
+		}
+		switch {
+		case lang == nil || class == "diff-hunk" || line[0] == '\\':
+			// The hunk headers, and notes such as "\ No newline at
+			// end of file", are not code.
+			buf.WriteString(html.EscapeString(line))
+		default:
+			buf.WriteString(html.EscapeString(line[:1]))
+			highlightTokens(&buf, line[1:], lang)
 		}
+		if len(class) > 0 {
+			buf.WriteString("</span>")
+		}
+	}
+	return template.HTML(buf.String())
+}
+
+// MakeComparePage shows the commits between two refs, given in the
+// form "<from>..<to>", and the combined diff of the changes made on
+// <to> since it diverged from <from>. It writes the webpage to the
+// provided http.ResponseWriter.
+func MakeComparePage(w http.ResponseWriter, pi *pageinfo, g Repository, refs string, maxCommits int) (err error, status int) {
+	from, to, ok := splitRange(refs)
+	if !ok {
+		return InvalidRefError, http.StatusBadRequest
+	}
+	if !g.RefExists(from) || !g.RefExists(to) {
+		return RefNotFoundError, http.StatusNotFound
+	}
+
+	diffs, err := g.Diff(from, to)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	commits, err := g.Commits(from+".."+to, maxCommits)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	ownerEmail, err := g.Email()
+	if err != nil {
+		return err, gitStatus(err)
+	}
+
+	pi.Compare = &compareView{From: from, To: to}
+	pi.Logs = makeGitLogs(commits, ownerEmail)
+	pi.Diffs = makeDiffViews(diffs)
+	for _, d := range diffs {
+		pi.Compare.Additions += d.Additions
+		pi.Compare.Deletions += d.Deletions
 	}
 
 	// We return 500 here because the error will only be reported
 	// if t.ExecuteTemplate() results in an error.
-	return t.ExecuteTemplate(w, "gitpage.html", pi),
+	return t.ExecuteTemplate(w, "compare.html", pi),
 		http.StatusInternalServerError
 }
 
-// MakeTreePage makes directory listings from within git repositories.
-// It writes the webpage to the provided http.ResponseWriter.
-func MakeTreePage(w http.ResponseWriter, pi *pageinfo, g *git, ref, file string) (err error, status int) {
-	// Retrieve the list of files from the repository.
-	files := g.GetDir(ref, file)
+// splitRange separates a range of the form "<from>..<to>" or
+// "<from>...<to>" into its two refs. If either is missing, ok is
+// false.
+func splitRange(refs string) (from, to string, ok bool) {
+	sep := "..."
+	idx := strings.Index(refs, sep)
+	if idx < 0 {
+		sep = ".."
+		idx = strings.Index(refs, sep)
+	}
+	if idx < 0 {
+		return "", "", false
+	}
+	from, to = refs[:idx], refs[idx+len(sep):]
+	return from, to, len(from) > 0 && len(to) > 0
+}
 
-	// If there are no files, return an error.
-	if len(files) == 0 {
-		return notFound, http.StatusNotFound
-	} // Otherwise, continue as normal.
+// MakeBlamePage shows the contents of a file within a git project,
+// with each line annotated by the commit which last changed it. It
+// writes the webpage to the provided http.ResponseWriter.
+func MakeBlamePage(w http.ResponseWriter, pi *pageinfo, g Repository, ref, file string) (err error, status int) {
+	lines, err := g.Blame(ref, file)
+	if err != nil {
+		return err, gitStatus(err)
+	}
 
-	pi.List = make([]*dirList, len(files))
-	for n, f := range files {
-		pi.List[n] = &dirList{
-			Name: f,
-			Link: path.Join(file, f),
+	pi.Blame = make([]*blameView, len(lines))
+	for n, l := range lines {
+		pi.Blame[n] = &blameView{
+			BlameLine: l,
+			Time:      relativeTime(l.Time),
+			First:     n == 0 || lines[n-1].SHA != l.SHA,
 		}
 	}
 
 	// We return 500 here because the error will only be reported
 	// if t.ExecuteTemplate() results in an error.
-	return t.ExecuteTemplate(w, "tree.html", pi),
+	return t.ExecuteTemplate(w, "blame.html", pi),
+		http.StatusInternalServerError
+}
+
+// MakeHistoryPage shows the log of commits which affected a file or
+// directory within a git project, following it through renames. If f
+// is not nil, only the commits which also pass it are included. It
+// writes the webpage to the provided http.ResponseWriter.
+func MakeHistoryPage(w http.ResponseWriter, pi *pageinfo, g Repository, ref, file string, f *LogFilter, maxCommits int) (err error, status int) {
+	var commits []*Commit
+	if f == nil {
+		commits, err = g.CommitsByFile(ref, file, maxCommits)
+	} else {
+		commits, err = g.CommitsMatching(ref, fileFilter(f, file),
+			maxCommits)
+	}
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	if len(commits) == 0 && f == nil {
+		// If there are no commits, the file does not exist at the
+		// given ref. If the log is filtered, there may simply be no
+		// commits which pass.
+		return PathNotFoundError, http.StatusNotFound
+	}
+	ownerEmail, err := g.Email()
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	pi.Logs = makeGitLogs(commits, ownerEmail)
+	pi.Filter = f
+
+	// If the log was cut off, link to a longer one.
+	if maxCommits > 0 && len(commits) == maxCommits {
+		v := filterValues(f)
+		v.Set("ref", pi.Ref)
+		v.Set("log", "")
+		v.Set("c", strconv.Itoa(maxCommits+defaultCommits))
+		pi.More = template.URL("?" + v.Encode())
+	}
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "history.html", pi),
+		http.StatusInternalServerError
+}
+
+// MakeSearchPage shows the lines of the files of the given ref of a
+// git project which match the query, up to max of them. It writes the
+// webpage to the provided http.ResponseWriter.
+func MakeSearchPage(w http.ResponseWriter, pi *pageinfo, g Repository, ref string, q *GrepQuery, max int) (err error, status int) {
+	results, err := searchRepository(g, pi.Path, ref, q, max)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	pi.Search = makeSearchView(q, ref, results, max)
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "search.html", pi),
+		http.StatusInternalServerError
+}
+
+// MakeGroveSearchPage shows the lines matching the query across every
+// repository which the user may see within the given directory, or if
+// it is blank, within each of the given roots, up to max of them. It
+// writes the webpage to the provided http.ResponseWriter.
+func MakeGroveSearchPage(w http.ResponseWriter, pi *pageinfo, rs []*Root, directory, remoteUser string, q *GrepQuery, max int) (err error, status int) {
+	results, err := searchRepositories(rs, directory, remoteUser, q, max)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	pi.Search = makeSearchView(q, "", results, max)
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "search.html", pi),
+		http.StatusInternalServerError
+}
+
+// makeSearchView prepares the results of a search of the given ref,
+// or of the grove if it is blank, for display. If the results were
+// cut off at max, it links to a longer search.
+func makeSearchView(q *GrepQuery, ref string, results []*SearchResult, max int) (s *searchView) {
+	s = &searchView{
+		GrepQuery: q,
+		Ref:       ref,
+		Results:   make([]*searchResultView, len(results)),
+	}
+	for n, r := range results {
+		s.Results[n] = &searchResultView{
+			SearchResult: r,
+			Link: *fPrefix + r.Repository + r.File + "?ref=" +
+				url.QueryEscape(r.Ref) + "#L" + strconv.Itoa(r.Line),
+			Content: r.highlight(),
+		}
+	}
+
+	if max > 0 && len(results) == max {
+		v := url.Values{
+			"q":     {q.Pattern},
+			"limit": {strconv.Itoa(max + defaultResults)},
+		}
+		if q.Regexp {
+			v.Set("regexp", "")
+		}
+		if q.IgnoreCase {
+			v.Set("icase", "")
+		}
+		if len(ref) > 0 {
+			v.Set("ref", ref)
+		} else {
+			v.Set("search", "")
+		}
+		s.More = template.URL("?" + v.Encode())
+	}
+	return
+}
+
+// MakeRefsPage lists the branches or tags of a git project, as
+// selected by the namespace, with the tip of each and how far it has
+// diverged from the default branch. It writes the webpage to the
+// provided http.ResponseWriter.
+func MakeRefsPage(w http.ResponseWriter, pi *pageinfo, g Repository, namespace string) (err error, status int) {
+	base := defaultBranch(g)
+	refs, err := listRefs(g, namespace, base)
+	if err != nil {
+		return err, gitStatus(err)
+	}
+	pi.Refs = &refsView{Kind: "Branches", Base: base, Refs: refs}
+	if namespace == refsTags {
+		pi.Refs.Kind = "Tags"
+	}
+
+	// We return 500 here because the error will only be reported
+	// if t.ExecuteTemplate() results in an error.
+	return t.ExecuteTemplate(w, "refs.html", pi),
 		http.StatusInternalServerError
 }
+
+// defaultBranch determines the default branch of the repository, from
+// its settings or otherwise the branch which is checked out. If
+// neither is known, it returns "HEAD".
+func defaultBranch(g Repository) string {
+	ref := getRepoConfig(g.Dir()).Ref()
+	if ref == defaultRef {
+		if branch, err := g.Branch(ref); err == nil && branch != ref {
+			return branch
+		}
+	}
+	return ref
+}
+
+// listRefs lists the refs in the given namespace, with the number of
+// commits by which each is ahead of and behind base.
+func listRefs(g Repository, namespace, base string) (refs []*Ref, err error) {
+	if refs, err = g.Refs(namespace); err != nil {
+		return nil, err
+	}
+	for _, r := range refs {
+		r.Ahead, r.Behind, err = g.AheadBehind(base, r.Commit.SHA)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+// MakeArchivePage streams an archive of the files of a ref, which is
+// requested by a name such as "master.tar.gz", or of only those within
+// the directory dir if it is not blank. The archive is named after the
+// repository, the ref, and the directory.
+func MakeArchivePage(w http.ResponseWriter, req *http.Request, g Repository, name, arg, dir string) (err error, status int) {
+	var ref, ext, format, contentType string
+	for _, f := range archiveFormats {
+		if strings.HasSuffix(arg, f.Ext) {
+			ref = strings.TrimSuffix(arg, f.Ext)
+			ext, format, contentType = f.Ext, f.Format, f.ContentType
+			break
+		}
+	}
+	if len(ref) == 0 {
+		return notFound, http.StatusNotFound
+	}
+	// Resolve the ref to a commit before anything is written, so that
+	// ranges and tags of blobs or trees are refused with a 404 rather
+	// than producing an empty archive.
+	sha, err := g.Resolve(ref)
+	if err != nil {
+		return RefNotFoundError, http.StatusNotFound
+	}
+	if dir = strings.Trim(dir, "/"); len(dir) > 0 {
+		if isDir, err := g.IsDir(sha, dir); err != nil || !isDir {
+			return PathNotFoundError, http.StatusNotFound
+		}
+	}
+
+	// If the ref is a full SHA, then the archive can never change.
+	if isFullSHA(ref) && setImmutable(w, req,
+		"archive:"+ref+":"+dir+":"+format) {
+		return nil, http.StatusNotModified
+	}
+
+	base := name + "-" + strings.Replace(ref, "/", "-", -1)
+	if len(dir) > 0 {
+		base += "-" + strings.Replace(dir, "/", "-", -1)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(
+		"attachment", map[string]string{"filename": base + ext}))
+	if err = g.Archive(w, sha, format, base+"/", dir); err != nil {
+		// Once the archive has begun, the error can no longer be
+		// reported to the client.
+		l.Errf("Archive of %q from %q failed: %s",
+			req.URL.Path, req.RemoteAddr, err)
+	}
+	return nil, http.StatusOK
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitView(t *testing.T) {
+	tests := []struct {
+		file, view, arg string
+	}{
+		{"", "", ""},
+		{"main.go", "", "main.go"},
+		{"-/commit/abc123", viewCommit, "abc123"},
+		{"-/tree/", viewTree, ""},
+		{"-/tree/sub/dir/", viewTree, "sub/dir"},
+		{"-/tags", viewTags, ""},
+		{"-/archive/v1.0.tar.gz", viewArchive, "v1.0.tar.gz"},
+		{"-/unknown/x", "", "-/unknown/x"},
+		// Directories named after views are ordinary paths.
+		{"tags", "", "tags"},
+		{"archive/y.c", "", "archive/y.c"},
+		{"commit/abc123", "", "commit/abc123"},
+	}
+	for _, test := range tests {
+		view, arg := splitView(test.file)
+		if view != test.view || arg != test.arg {
+			t.Errorf("%q: got %q, %q; expected %q, %q",
+				test.file, view, arg, test.view, test.arg)
+		}
+	}
+}
+
+func TestRenderDiff(t *testing.T) {
+	patch := "@@ -1,2 +1,2 @@ func main() {\n" +
+		" \treturn\n" +
+		"-x := \"<a>\" // Old\n" +
+		"+x := 42\n" +
+		"\\ No newline at end of file\n"
+	tests := []struct {
+		name     string
+		lang     *language
+		expected []string
+	}{
+		{"plain", nil, []string{
+			`<span class="diff-hunk">@@ -1,2 +1,2 @@ func main() {` + "\n</span>",
+			" \treturn\n",
+			`<span class="diff-del">-x := &#34;&lt;a&gt;&#34; // Old` + "\n</span>",
+			`<span class="diff-add">+x := 42` + "\n</span>",
+			`\ No newline at end of file`,
+		}},
+		{"go", languages["go"], []string{
+			// Hunk headers are not highlighted.
+			`<span class="diff-hunk">@@ -1,2 +1,2 @@ func main() {` + "\n</span>",
+			" \t<span class=\"keyword\">return</span>",
+			`<span class="diff-del">-x := <span class="string">&#34;&lt;a&gt;&#34;</span> <span class="comment">// Old</span>` + "\n</span>",
+			`<span class="diff-add">+x := <span class="constant numeric">42</span>` + "\n</span>",
+			`\ No newline at end of file`,
+		}},
+	}
+	for _, test := range tests {
+		h := string(renderDiff(patch, test.lang))
+		for _, e := range test.expected {
+			if !strings.Contains(h, e) {
+				t.Errorf("%s: expected %q in:\n%s", test.name, e, h)
+			}
+		}
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	tests := []struct {
+		refs, from, to string
+		ok             bool
+	}{
+		{"master..topic", "master", "topic", true},
+		{"master...topic", "master", "topic", true},
+		{"v1.0..HEAD~2", "v1.0", "HEAD~2", true},
+		{"a...b..c", "a", "b..c", true},
+		{"master..", "master", "", false},
+		{"..topic", "", "topic", false},
+		{"...", "", "", false},
+		{"master", "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		from, to, ok := splitRange(test.refs)
+		if from != test.from || to != test.to || ok != test.ok {
+			t.Errorf("%q: got %q, %q, %t; expected %q, %q, %t", test.refs,
+				from, to, ok, test.from, test.to, test.ok)
+		}
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	f := &LogFilter{Author: "luke", Path: "other"}
+	tests := []struct {
+		f        *LogFilter
+		expected LogFilter
+	}{
+		{nil, LogFilter{Path: "c.txt", Follow: true}},
+		{f, LogFilter{Author: "luke", Path: "c.txt", Follow: true}},
+	}
+	for _, test := range tests {
+		if ff := fileFilter(test.f, "c.txt"); *ff != test.expected {
+			t.Errorf("%+v: got %+v, expected %+v", test.f, *ff, test.expected)
+		}
+	}
+	// The filter given must be left as it was.
+	if f.Path != "other" || f.Follow {
+		t.Errorf("filter was changed to %+v", *f)
+	}
+}
+
+func TestGitStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{RefNotFoundError, http.StatusNotFound},
+		{&GitError{Kind: PathNotFoundError}, http.StatusNotFound},
+		{InvalidRefError, http.StatusBadRequest},
+		{&GitError{Kind: InvalidPatternError}, http.StatusBadRequest},
+		{&GitError{Kind: GitFailedError}, http.StatusInternalServerError},
+		{NotRepositoryError, http.StatusInternalServerError},
+		{notFound, http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if status := gitStatus(test.err); status != test.status {
+			t.Errorf("%v: got %d, expected %d", test.err, status, test.status)
+		}
+	}
+}
+
+func TestListRefs(t *testing.T) {
+	g := prepareRefs(t)
+	defer removeTempDir()
+
+	type refSummary struct {
+		Name          string
+		Ahead, Behind int
+		Message       string
+	}
+	tests := []struct {
+		namespace string
+		expected  []refSummary
+	}{
+		{refsBranches, []refSummary{
+			{"master", 0, 0, ""},
+			{"topic", 1, 0, ""},
+		}},
+		// Tags of blobs and trees are left out.
+		{refsTags, []refSummary{
+			{"light", 0, 0, ""},
+			{"v1", 0, 0, "Version 1"},
+		}},
+	}
+	for _, test := range tests {
+		refs, err := listRefs(g, test.namespace, "master")
+		if err != nil {
+			t.Errorf("%s: %s", test.namespace, err)
+			continue
+		}
+		var actual []refSummary
+		for _, r := range refs {
+			actual = append(actual,
+				refSummary{r.Name, r.Ahead, r.Behind, r.Message})
+		}
+		// Refs made in the same second are in no particular order.
+		sort.Slice(actual, func(i, j int) bool {
+			return actual[i].Name < actual[j].Name
+		})
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: got %+v, expected %+v",
+				test.namespace, actual, test.expected)
+		}
+	}
+}
+
+func TestMakeArchivePage(t *testing.T) {
+	g := prepareRefs(t)
+	defer removeTempDir()
+
+	tests := []struct {
+		arg, dir    string
+		status      int
+		contentType string
+		filename    string
+	}{
+		{"master.tar.gz", "", http.StatusOK, "application/gzip",
+			"proj-master.tar.gz"},
+		{"master.zip", "", http.StatusOK, "application/zip",
+			"proj-master.zip"},
+		{"v1.zip", "", http.StatusOK, "application/zip", "proj-v1.zip"},
+		{"master.tar", "", http.StatusNotFound, "", ""},
+		{".zip", "", http.StatusNotFound, "", ""},
+		{"missing.zip", "", http.StatusNotFound, "", ""},
+		{"HEAD..HEAD.tar.gz", "", http.StatusNotFound, "", ""},
+		{"blobtag.tar.gz", "", http.StatusNotFound, "", ""},
+		{"treetag.zip", "", http.StatusNotFound, "", ""},
+		{"master.zip", "missing", http.StatusNotFound, "", ""},
+		{"master.zip", "1Kb.bin", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/proj/-/archive/"+test.arg, nil)
+		_, status := MakeArchivePage(w, req, g, "proj", test.arg, test.dir)
+		if status != test.status {
+			t.Errorf("%s %q: got status %d, expected %d",
+				test.arg, test.dir, status, test.status)
+			continue
+		}
+		// Nothing may be written for an archive which is refused.
+		if ct := w.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s %q: got Content-Type %q, expected %q",
+				test.arg, test.dir, ct, test.contentType)
+		}
+		if len(test.filename) > 0 && !strings.Contains(
+			w.Header().Get("Content-Disposition"), test.filename) {
+			t.Errorf("%s %q: got Content-Disposition %q, expected %q",
+				test.arg, test.dir,
+				w.Header().Get("Content-Disposition"), test.filename)
+		}
+		if (status == http.StatusOK) != (w.Body.Len() > 0) {
+			t.Errorf("%s %q: got %d bytes", test.arg, test.dir, w.Body.Len())
+		}
+	}
+}
+
+func TestRenderReadme(t *testing.T) {
+	g, err := prepareRepository()
+	if err != nil {
+		t.Fatalf("Failed to prepare repository: %s", err)
+	}
+	defer removeTempDir()
+	err = ioutil.WriteFile(g.Path+"/README.md", []byte("# Grove\n"), 0644)
+	if err == nil {
+		_, err = g.execute("add", "README.md")
+	}
+	if err == nil {
+		_, err = g.execute("commit", "-q", "-m", "Readme")
+	}
+	if err != nil {
+		t.Fatalf("Failed to commit: %s", err)
+	}
+	sha, err := g.Resolve("HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(c *lruCache) { objectCache = c }(objectCache)
+	objectCache = newLRUCache(1 << 20)
+	content, err := renderReadme(g, "HEAD", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "<h1>Grove</h1>") {
+		t.Errorf("got %q", content)
+	}
+
+	// The rendered README is kept by commit and directory, so later
+	// requests by any name of the commit do not render it again.
+	key := "readme\x00" + g.Dir() + "\x00" + sha + "\x00"
+	if v, ok := objectCache.Get(key); !ok || v.(template.HTML) != content {
+		t.Fatalf("got cached %v, expected %q", v, content)
+	}
+	objectCache.Add(key, template.HTML("cached"), cacheEntryOverhead)
+	if content, _ = renderReadme(g, sha, ""); content != "cached" {
+		t.Errorf("got %q, expected the cached README", content)
+	}
+}